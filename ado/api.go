@@ -1,6 +1,7 @@
 package ado
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -12,14 +13,35 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // API provides access to the RestApi functions and uses the Service interface for interacting with Azure DevOps
 type API struct {
-	adoService Service
-	logger Logging
+	serviceFactory ServiceFactory
+	logger         Logging
+	concurrency    Concurrency
+	requests       limiter
+	hosts          hostAllowlist
+	rulePacks      rulePacks
+	fingerprintKey []byte
+	// defaultExclusions are the paths left out of scans that don't disable them
+	defaultExclusions *regexp.Regexp
+	// maxArchiveSize is the largest repository fetched as an archive when the criteria leave the choice to the server
+	maxArchiveSize int64
+	// retry is the policy for retrying throttled and failed Azure DevOps calls
+	retry retryPolicy
+	// pauses are the throttling pauses of each organization, shared by its scans
+	pauses *orgPauses
+	// rateLimiter is shared by the replicas to limit the calls made to each organization, nil when it is off
+	rateLimiter *rateLimiter
+	// state keeps what incremental scans remember of each repository, nil turns incremental scans into full ones
+	state Cache
+	// blobs caches the content of the files scans read by object ID, nil when it is off
+	blobs *blobCache
 }
 
 func (api *API) decodeSearchCriteria(w http.ResponseWriter, body io.ReadCloser) (criteria *SearchCriteria) {
@@ -100,82 +122,134 @@ func (api *API) decodeSearchCriteria(w http.ResponseWriter, body io.ReadCloser)
 	return criteria
 }
 
-func (api *API) postCacheHandler(client redis.Cmdable) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+// decodeScanRequest validates the headers and body shared by every endpoint that starts a scan, it writes the
+// error response and returns nil criteria when the request is not valid, org is returned as the collection URL
+func (api *API) decodeScanRequest(w http.ResponseWriter, r *http.Request) (org, personalAccessToken string, criteria *SearchCriteria) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		http.Error(w, "Content-Type header is not application/json", http.StatusUnsupportedMediaType)
+		return "", "", nil
+	}
 
-		contentType := r.Header.Get("Content-Type")
-		if contentType != "application/json" {
-			http.Error(w, "Content-Type header is not application/json", http.StatusUnsupportedMediaType)
-			return
-		}
+	org, personalAccessToken, ok := api.decodeCaller(w, r)
+	if !ok {
+		return "", "", nil
+	}
 
-		org := r.Header.Get("Org")
-		if org == "" {
-			http.Error(w, "Org header is required", http.StatusBadRequest)
-			return
-		}
-		personalAccessToken := r.Header.Get("PAT")
-		if personalAccessToken == "" {
-			http.Error(w, "PAT header is required", http.StatusBadRequest)
-			return
-		}
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+
+	criteria = api.decodeSearchCriteria(w, r.Body)
+	if criteria == nil {
+		return "", "", nil
+	}
+	if err := criteria.validate(api.rulePacks); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", nil
+	}
+	return org, personalAccessToken, criteria
+}
 
-		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+// decodeCaller reads the collection and token of the caller from the Org and PAT headers, it writes the error response
+// and returns false when either is missing or the collection isn't allowed
+func (api *API) decodeCaller(w http.ResponseWriter, r *http.Request) (org, personalAccessToken string, ok bool) {
+	org = r.Header.Get("Org")
+	if org == "" {
+		http.Error(w, "Org header is required", http.StatusBadRequest)
+		return "", "", false
+	}
+	org, err := api.hosts.collectionURL(org)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	personalAccessToken = r.Header.Get("PAT")
+	if personalAccessToken == "" {
+		http.Error(w, "PAT header is required", http.StatusBadRequest)
+		return "", "", false
+	}
+	return org, personalAccessToken, true
+}
 
-		criteria := api.decodeSearchCriteria(w, r.Body)
+func (api *API) postCacheHandler(cache Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		org, personalAccessToken, criteria := api.decodeScanRequest(w, r)
 		if criteria == nil {
 			return
 		}
 
-		redisKey := fmt.Sprintf("%s%s%s%s", org, criteria.ProjectNamePattern, criteria.FileNamePattern, criteria.ContentPattern)
+		resultsKey, err := cacheKey(org, personalAccessToken, criteria, api.rulePacks, api.defaultExclusions)
+		if err != nil {
+			api.writeScanError(w, err)
+			return
+		}
+		format := streamFormat(r)
 
-		val := api.getContentFromRedis(client, redisKey)
-		if val == "" {
-			msg := fmt.Sprintf("Cache miss for %s", redisKey)
+		val := api.getContentFromCache(cache, resultsKey)
+		if val == nil {
+			msg := fmt.Sprintf("Cache miss for %s", resultsKey)
 			api.logger.LogInfo(msg)
 			log.Println(msg)
-			response, e := api.getContentFromAdo(org, personalAccessToken, criteria)
-			if e != nil {
-				api.logger.LogError(e)
-
-				if e.Error() == "unable to connect to azure devops" {
-					http.Error(w, e.Error(), http.StatusServiceUnavailable)
-					return
-				}
+			if format != "" {
+				api.streamContentFromAdo(r.Context(), w, format, cache, resultsKey, org, personalAccessToken, criteria)
+				return
+			}
 
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			response, cached, e := api.getContentFromAdo(r.Context(), org, personalAccessToken, criteria)
+			if e != nil {
+				api.writeScanError(w, e)
 				return
 			}
 
-			err := client.Set(redisKey, *response, time.Hour*24).Err()
-			if err != nil {
-				api.logger.LogError(err)
-				log.Println(err)
+			// Incomplete results are not cached so the next request gets another chance at a full scan
+			if cached != nil {
+				err := cache.Set(resultsKey, cached, time.Hour*24)
+				if err != nil {
+					api.logger.LogError(err)
+					log.Println(err)
+				}
 			}
-			if api.processResponse(w, *response) {
+			if api.processResponse(w, response) {
 				return
 			}
 		} else {
-			msg := fmt.Sprintf("Cache Hit for %s", redisKey)
+			msg := fmt.Sprintf("Cache Hit for %s", resultsKey)
 			api.logger.LogInfo(msg)
 			log.Println(msg)
-			if api.processResponse(w, []byte(val)) {
+			if format != "" {
+				api.replayResults(r.Context(), w, format, val)
+				return
+			}
+			if api.processResponse(w, val) {
 				return
 			}
 		}
 	}
 }
 
-func (api *API) getContentFromRedis(client redis.Cmdable, redisKey string) string {
-	val, err := client.Get(redisKey).Result()
-	if err == redis.Nil {
-		return ""
+// writeScanError logs an error that stopped the scan from running and sends the matching status to the client
+func (api *API) writeScanError(w http.ResponseWriter, e error) {
+	api.logger.LogError(e)
+
+	if e.Error() == "unable to connect to azure devops" {
+		http.Error(w, e.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// getContentFromCache returns nil on a miss, a cache that can't be reached is treated as a miss so the scan still runs
+func (api *API) getContentFromCache(cache Cache, key string) []byte {
+	val, err := cache.Get(key)
+	if err == ErrCacheMiss {
+		return nil
 	}
 	if err != nil {
 		api.logger.LogError(err)
-		log.Printf("unable to connect to redis: %s", err)
-		return ""
+		log.Printf("unable to read from cache: %s", err)
+		return nil
 	}
 	return val
 }
@@ -192,19 +266,87 @@ func (api *API) processResponse(w http.ResponseWriter, val []byte) bool {
 	return false
 }
 
-func (api *API) getContentFromAdo(org, personalAccessToken string, criteria *SearchCriteria) (*[]byte, error) {
-	organizationURL := fmt.Sprintf("https://dev.azure.com/%s", org)
+// getContentFromAdo scans and returns the response along with the value to cache, which is nil for incomplete results
+func (api *API) getContentFromAdo(ctx context.Context, org, personalAccessToken string, criteria *SearchCriteria) ([]byte, []byte, error) {
+	results, err := api.scan(ctx, org, personalAccessToken, criteria, new(Progress), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := json.Marshal(results)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, nil, err
+	}
+	if results.Incomplete {
+		return result, nil, nil
+	}
+
+	cached, err := cachedResults(results)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, nil, err
+	}
+	return result, cached, nil
+}
+
+// cachedResults returns the results as they are cached, without the summaries of how the scan that found them ran as
+// those don't describe the requests answered from the cache
+func cachedResults(results *Results) ([]byte, error) {
+	cached := *results
+	cached.Retries = nil
+	cached.BlobCache = nil
+	return json.Marshal(cached)
+}
 
-	err := api.adoService.CreateConnection(organizationURL, personalAccessToken)
+// scan connects to the collection at org and runs the scan, the scan stops early and returns what it has collected when
+// ctx is cancelled or the criteria's timeout passes, progress reports how far it got and onItem, when it is not nil,
+// is called with every matching file as soon as it is found
+func (api *API) scan(ctx context.Context, org, personalAccessToken string, criteria *SearchCriteria, progress *Progress, onItem func(projectName string, repository Repository, item Item)) (*Results, error) {
+	if criteria.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(criteria.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	adoService, err := api.serviceFactory.NewService(org, personalAccessToken)
 	if err != nil {
 		log.Printf("AzureDevOpsService Failure")
 		return nil, err
 	}
 
+	if api.requests != nil {
+		ctx = withRequestLimit(ctx, api.requests)
+	}
+	if api.rateLimiter != nil {
+		ctx = withRateLimit(ctx, api.rateLimiter, org)
+	}
+
+	var state *incrementalState
+	if criteria.Incremental && api.state != nil {
+		state, err = newIncrementalState(api.state, org, personalAccessToken, criteria, api.rulePacks, api.defaultExclusions, api.fingerprintKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	scanProjects := ScanProjects{
-		adoService: api.adoService,
-		criteria:   criteria,
-		logger: api.logger,
+		ctx:               ctx,
+		adoService:        adoService,
+		criteria:          criteria,
+		logger:            api.logger,
+		progress:          progress,
+		concurrency:       api.concurrency,
+		rulePacks:         api.rulePacks,
+		baseline:          newBaseline(org, api.fingerprintKey, criteria.Baseline),
+		defaultExclusions: api.defaultExclusions,
+		maxArchiveSize:    api.maxArchiveSize,
+		retry:             api.retry,
+		pauses:            api.pauses,
+		org:               org,
+		state:             state,
+		blobs:             api.blobs,
+		onItem:            onItem,
 	}
 
 	results, err := scanProjects.Scan()
@@ -213,13 +355,14 @@ func (api *API) getContentFromAdo(org, personalAccessToken string, criteria *Sea
 		return nil, err
 	}
 
-	result, err := json.Marshal(results)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, err
-	}
+	log.Printf("Scan of %s made %d requests to Azure DevOps", org, atomic.LoadInt64(&scanProjects.progress.RoundTrips))
 
-	return &result, nil
+	if results.Incomplete {
+		msg := fmt.Sprintf("Scan of %s is incomplete, %d operations failed", org, len(*results.Errors))
+		api.logger.LogWarning(msg)
+		log.Println(msg)
+	}
+	return results, nil
 }
 
 func (api *API) healthHander(w http.ResponseWriter, r *http.Request) {
@@ -234,35 +377,111 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// newRedisClientFromEnv connects to the TLS redis configured by REDIS_HOST, REDIS_PORT and REDIS_PASSWORD
+func newRedisClientFromEnv() *redis.Client {
+	var (
+		host     = getEnv("REDIS_HOST", "localhost")
+		port     = getEnv("REDIS_PORT", ":6380")
+		password = getEnv("REDIS_PASSWORD", "")
+	)
+
+	return redis.NewClient(&redis.Options{
+		Addr:      host + port,
+		Password:  password,
+		DB:        0,
+		TLSConfig: &tls.Config{},
+	})
+}
+
 // InitializeServer wires everything up to run the RestApi server
 func InitializeServer() *http.Server {
 	var (
-		api = API{
-			adoService: new(AzureDevOpsService),
-			logger: new(AppInsightsLogger),
+		concurrency = concurrencyFromEnv()
+		transport   = newTransport(getEnvInt("ADO_MAX_IDLE_CONNS_PER_HOST", concurrency.Requests))
+		api         = API{
+			logger:         new(AppInsightsLogger),
+			concurrency:    concurrency,
+			requests:       newLimiter(concurrency.Requests),
+			maxArchiveSize: int64(getEnvInt("MAX_ARCHIVE_BYTES", defaultMaxArchiveSize)),
+			retry:          retryPolicyFromEnv(),
+			pauses:         newOrgPauses(),
 		}
-		host = getEnv("REDIS_HOST", "localhost")
-		port = getEnv("REDIS_PORT", ":6380")
-		password = getEnv("REDIS_PASSWORD", "")
 	)
 
-	client := redis.NewClient(&redis.Options{
-		Addr:        host + port,
-		Password:    password,
-		DB:          0,
-		TLSConfig: 	 &tls.Config{},
-	})
+	cache, err := newCacheFromEnv()
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+	api.state = cache
+
+	api.blobs, err = blobCacheFromEnv()
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+
+	api.hosts, err = parseHostAllowlist(getEnv("ADO_ALLOWED_HOSTS", defaultAllowedHosts))
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+	api.serviceFactory = NewAzureDevOpsServiceFactory(getEnvInt("ADO_CONNECTION_POOL_SIZE", 0), transport, api.hosts)
+
+	api.rateLimiter, err = rateLimiterFromEnv(api.hosts)
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+
+	api.rulePacks, err = loadRulePacks(os.Getenv("RULE_PACKS_DIRECTORY"))
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+
+	// An empty DEFAULT_EXCLUDED_PATHS turns the default exclusions off for every scan
+	excludedPaths, ok := os.LookupEnv("DEFAULT_EXCLUDED_PATHS")
+	if !ok {
+		excludedPaths = defaultExcludedPaths
+	}
+	api.defaultExclusions, err = compileOptional(excludedPaths)
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+
+	jobs, err := newScanJobStore(cache, getEnvInt("MAX_RUNNING_SCANS", defaultMaxRunningScanJobs))
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
+
+	// Jobs are kept in a cache that doesn't evict so the generated key is kept there too
+	api.fingerprintKey, err = fingerprintKeyFromEnv(jobs.jobs)
+	if err != nil {
+		api.logger.LogFatal(err)
+		log.Fatal(err)
+	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", api.postCacheHandler(client)).Methods(http.MethodPost)
+	r.HandleFunc("/", api.postCacheHandler(cache)).Methods(http.MethodPost)
 	r.HandleFunc("/health", api.healthHander).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/scans", api.postScanHandler(jobs)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/scans/{id}", api.getScanHandler(jobs)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/scans/{id}/results", api.getScanResultsHandler(jobs)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/scans/{id}", api.deleteScanHandler(jobs)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/ratelimits", api.getRateLimitsHandler).Methods(http.MethodGet)
 
+	// Streamed responses move the write deadline on with every record through the connection ConnContext keeps
 	srv := &http.Server{
-		Handler: r,
-		Addr: ":8080",
-		ReadTimeout: 60 * time.Second,
+		Handler:      r,
+		Addr:         ":8080",
+		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 120 * time.Second,
+		ConnContext:  withConnection,
 	}
+	srv.RegisterOnShutdown(jobs.runner.shutdown)
 
 	// Configure Logging
 	LogFileLocation := os.Getenv("LOG_FILE_LOCATION")
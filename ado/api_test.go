@@ -3,7 +3,10 @@ package ado
 import (
 	mocks "adoscanner/mocks/ado"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/alicebob/miniredis"
 	"github.com/elliotchance/redismock"
 	"github.com/go-redis/redis"
@@ -13,6 +16,8 @@ import (
 	"github.com/stretchr/testify/mock"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -28,14 +33,23 @@ func newTestRedis() *redismock.ClientMock {
 	return redismock.NewNiceMock(client)
 }
 
+// staticServiceFactory hands every request the same mocked Service
+type staticServiceFactory struct {
+	service Service
+}
+
+func (factory staticServiceFactory) NewService(orgURL, pat string) (Service, error) {
+	return factory.service, nil
+}
+
 func Router(mockConnection *mocks.Service, mockClient redis.Cmdable, mockLogging *mocks.Logging) *mux.Router {
 	api := API{
-		adoService: mockConnection,
-		logger: mockLogging,
+		serviceFactory: staticServiceFactory{service: mockConnection},
+		logger:         mockLogging,
 	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/v1/Results", api.postCacheHandler(mockClient)).Methods("POST")
+	router.HandleFunc("/api/v1/Results", api.postCacheHandler(NewRedisCache(mockClient))).Methods("POST")
 	return router
 }
 
@@ -216,7 +230,6 @@ func TestPostReturnsBadRequestSingleJsonOnly(t *testing.T) {
 
 func TestPostReturnsOKNoCache(t *testing.T) {
 	mockConnection := new(mocks.Service)
-	mockConnection.On("CreateConnection", mock.Anything, mock.Anything).Return(nil)
 	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
 
 	mockLogging := new(mocks.Logging)
@@ -249,7 +262,6 @@ func TestPostReturnsOKNoCache(t *testing.T) {
 
 func TestPostReturnsOKWithInvalidRedisConfiguration(t *testing.T) {
 	mockConnection := new(mocks.Service)
-	mockConnection.On("CreateConnection", mock.Anything, mock.Anything).Return(nil)
 	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
 
 	mockLogging := new(mocks.Logging)
@@ -306,7 +318,211 @@ func TestPostReturnsOKWithCache(t *testing.T) {
 	mockConnection.AssertExpectations(t)
 	mockLogging.AssertNumberOfCalls(t, "LogInfo", 1)
 	mockLogging.AssertExpectations(t)
-	mockRedis.AssertNumberOfCalls(t,"Get", 1)
+	mockRedis.AssertNumberOfCalls(t, "Get", 1)
 	mockRedis.AssertNumberOfCalls(t, "Set", 0)
 	mockRedis.AssertExpectations(t)
-}
\ No newline at end of file
+}
+func TestPostReturnsOKWithoutCachingIncompleteResults(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On("GetRepositories", mock.Anything, "Project0").Return(nil, nil, assert.AnError)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	mockLogging.On("LogWarning", mock.Anything)
+
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"22","ContentPattern":"33"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/Results", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+
+	var results Results
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	assert.True(t, results.Incomplete)
+	assert.Equal(t, OperationGetRepositories, (*results.Errors)[0].Operation)
+	mockLogging.AssertNumberOfCalls(t, "LogWarning", 1)
+	mockRedis.AssertNumberOfCalls(t, "Get", 1)
+	mockRedis.AssertNumberOfCalls(t, "Set", 0)
+}
+
+func TestPostReturnsPartialResultsWhenScanTimesOut(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On("GetRepositories", mock.Anything, "Project0").
+		Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+		Return(nil, nil, context.DeadlineExceeded)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	mockLogging.On("LogWarning", mock.Anything)
+
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"22","ContentPattern":"33","TimeoutSeconds":1}`)
+	req, _ := http.NewRequest("POST", "/api/v1/Results", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+
+	var results Results
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	assert.True(t, results.Incomplete)
+	assert.Contains(t, *results.Errors, ScanError{Operation: OperationScan, Message: context.DeadlineExceeded.Error()})
+	mockRedis.AssertNumberOfCalls(t, "Set", 0)
+}
+
+// orgServiceFactory hands each organization its own mocked Service whose failures name the organization it belongs to
+type orgServiceFactory struct {
+	mutex sync.Mutex
+	pats  map[string]string
+}
+
+func (factory *orgServiceFactory) NewService(orgURL, pat string) (Service, error) {
+	factory.mutex.Lock()
+	factory.pats[orgURL] = pat
+	factory.mutex.Unlock()
+
+	org := strings.TrimPrefix(orgURL, "https://dev.azure.com/")
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On("GetRepositories", mock.Anything, "Project0").Return(nil, nil, errors.New(org+" "+pat))
+	return mockConnection, nil
+}
+
+func TestConcurrentRequestsForDifferentOrgsDoNotShareServices(t *testing.T) {
+	factory := &orgServiceFactory{pats: make(map[string]string)}
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	mockLogging.On("LogWarning", mock.Anything)
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+
+	api := API{
+		serviceFactory: factory,
+		logger:         mockLogging,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/Results", api.postCacheHandler(NewRedisCache(mockRedis))).Methods("POST")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			org := fmt.Sprintf("org%d", i)
+			pat := fmt.Sprintf("pat%d", i)
+
+			jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"22","ContentPattern":"33"}`)
+			req, _ := http.NewRequest("POST", "/api/v1/Results", bytes.NewBuffer(jsonCriteria))
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("Org", org)
+			req.Header.Add("PAT", pat)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, 200, rr.Code)
+
+			var results Results
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+			assert.Equal(t, org+" "+pat, (*results.Errors)[0].Message)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, factory.pats, 20)
+	for orgURL, pat := range factory.pats {
+		assert.Equal(t, strings.Replace(strings.TrimPrefix(orgURL, "https://dev.azure.com/"), "org", "pat", 1), pat)
+	}
+}
+
+func TestPostLooksUpCacheByCallerIdentity(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	criteria := SearchCriteria{ProjectNamePattern: "11", FileNamePattern: "22", ContentPattern: "33"}
+	ownKey, _ := cacheKey("https://dev.azure.com/itsals", "123", &criteria, nil, nil)
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", ownKey).Return(redis.NewStringResult(`{"Projects":[]}`, nil))
+
+	jsonCriteria, _ := json.Marshal(criteria)
+	req, _ := http.NewRequest("POST", "/api/v1/Results", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, `{"Projects":[]}`, rr.Body.String())
+
+	otherKey, _ := cacheKey("https://dev.azure.com/itsals", "456", &criteria, nil, nil)
+	assert.NotEqual(t, ownKey, otherKey)
+	mockRedis.AssertCalled(t, "Get", ownKey)
+}
+
+func TestPostAnswersRepeatedRequestFromMemoryCache(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil).Once()
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	api := API{serviceFactory: staticServiceFactory{service: mockConnection}, logger: mockLogging}
+	handler := api.postCacheHandler(NewMemoryCache(1024))
+
+	criteria, _ := json.Marshal(SearchCriteria{ProjectNamePattern: "11", FileNamePattern: "22", ContentPattern: "33"})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(criteria))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Org", "itsals")
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, `{"Projects":[],"Errors":[],"Incomplete":false}`, rr.Body.String())
+	}
+	mockConnection.AssertExpectations(t)
+	mockLogging.AssertCalled(t, "LogInfo", mock.MatchedBy(func(msg string) bool { return strings.HasPrefix(msg, "Cache Hit") }))
+}
+
+// criteriaCase is a criteria posted to the API and the message it is rejected with, empty when it is valid
+type criteriaCase struct {
+	body    string
+	message string
+}
+
+// assertPostValidates posts each criteria, the invalid ones have to be answered with 400 and their message before
+// anything is scanned and the valid ones have to be scanned
+func assertPostValidates(t *testing.T, api API, cases []criteriaCase) {
+	for _, test := range cases {
+		mockConnection := new(mocks.Service)
+		mockConnection.On(GetProjectsFuncName, mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
+		mockLogging := new(mocks.Logging)
+		mockLogging.On("LogInfo", mock.Anything)
+		api.serviceFactory = staticServiceFactory{service: mockConnection}
+		api.logger = mockLogging
+
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(test.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Org", "itsals")
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		api.postCacheHandler(NewMemoryCache(1<<20)).ServeHTTP(rr, req)
+		if test.message == "" {
+			assert.Equal(t, 200, rr.Code, test.body+": "+rr.Body.String())
+			continue
+		}
+		assert.Equal(t, 400, rr.Code, test.body)
+		assert.Equal(t, test.message+"\n", rr.Body.String(), test.body)
+		mockConnection.AssertNotCalled(t, GetProjectsFuncName, mock.Anything)
+	}
+}
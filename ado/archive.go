@@ -0,0 +1,154 @@
+package ado
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultMaxArchiveSize is the largest repository whose files are fetched in one archive unless MAX_ARCHIVE_BYTES says
+// otherwise
+const defaultMaxArchiveSize = 256 << 20
+
+// useArchive reports whether the matching files of the repository are fetched in one archive, left to the server a
+// repository whose size isn't known is fetched as an archive and the download is still cut off at maxArchiveSize
+func (s *ScanProjects) useArchive(repo git.GitRepository) bool {
+	switch s.criteria.Fetch {
+	case FetchArchive:
+		return true
+	case FetchItems:
+		return false
+	}
+	return s.maxArchiveSize > 0 && (repo.Size == nil || *repo.Size <= uint64(s.maxArchiveSize))
+}
+
+// findContentInArchive downloads the blobs of the matching files in one zip archive and scans its entries, sending the
+// files with matches to item. It returns false, before anything was scanned, when the files have to be fetched one at a
+// time instead, which happens when the archive couldn't be downloaded or was larger than the server allows and the
+// criteria left the choice to the server
+func (s *ScanProjects) findContentInArchive(repository Repository, projectName string, matching []git.GitItem, item chan Item) bool {
+	forced := s.criteria.Fetch == FetchArchive
+	blobIDs := make([]string, 0, len(matching))
+	seen := make(map[string]bool)
+	for _, itemRef := range matching {
+		if itemRef.ObjectId == nil {
+			return false
+		}
+		if !seen[*itemRef.ObjectId] {
+			seen[*itemRef.ObjectId] = true
+			blobIDs = append(blobIDs, *itemRef.ObjectId)
+		}
+	}
+
+	archive, err := s.downloadArchive(projectName, repository.Name, blobIDs, forced)
+	if err != nil {
+		if forced || s.cancelled() {
+			s.errors.add(OperationGetBlobsZip, projectName, repository.Name, "", err)
+			return true
+		}
+		return false
+	}
+	if archive == nil {
+		return false
+	}
+	defer archive.Close()
+
+	reader, err := zip.NewReader(archive, archive.size)
+	if err != nil {
+		s.errors.add(OperationReadArchive, projectName, repository.Name, "", err)
+		return true
+	}
+	entries := make(map[string]*zip.File, len(reader.File))
+	for _, entry := range reader.File {
+		entries[entry.Name] = entry
+	}
+
+	wg := sync.WaitGroup{}
+	for _, itemRef := range matching {
+		entry, ok := entries[*itemRef.ObjectId]
+		if !ok {
+			s.errors.add(OperationReadArchive, projectName, repository.Name, *itemRef.Path, fmt.Errorf("blob %s isn't in the archive", *itemRef.ObjectId))
+			continue
+		}
+		if !s.limits.files.acquire(s.ctx) {
+			break
+		}
+		atomic.AddInt64(&s.progress.FilesTotal, 1)
+		wg.Add(1)
+		go s.findContentInEntry(repository, projectName, *itemRef.Path, entry, item, &wg)
+	}
+	wg.Wait()
+	return true
+}
+
+func (s *ScanProjects) findContentInEntry(repository Repository, projectName, path string, entry *zip.File, item chan Item, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+	defer s.limits.files.release()
+	defer atomic.AddInt64(&s.progress.FilesScanned, 1)
+
+	file, err := entry.Open()
+	if err != nil {
+		s.errors.add(OperationReadArchive, projectName, repository.Name, path, err)
+		return
+	}
+	defer file.Close()
+
+	// Entries are named after the ID of their blob
+	content, err := s.cachingReader(entry.Name, file)
+	if err != nil {
+		s.errors.add(OperationReadArchive, projectName, repository.Name, path, err)
+		return
+	}
+	s.scanItem(projectName, repository, path, content, item)
+}
+
+// spooledArchive is a downloaded archive kept in a temporary file so its entries can be read in any order
+type spooledArchive struct {
+	*os.File
+	size int64
+}
+
+// Close removes the temporary file
+func (a *spooledArchive) Close() error {
+	err := a.File.Close()
+	if removeErr := os.Remove(a.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// downloadArchive spools the zip of the blobs to a temporary file, unless forced it gives up and returns nil once the
+// download is larger than maxArchiveSize
+func (s *ScanProjects) downloadArchive(projectName, repoName string, blobIDs []string, forced bool) (*spooledArchive, error) {
+	content, err := s.adoService.GetBlobsZip(s.ctx, projectName, repoName, blobIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	file, err := ioutil.TempFile("", "adoscanner-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	archive := &spooledArchive{File: file}
+
+	var source io.Reader = content
+	if !forced {
+		source = io.LimitReader(content, s.maxArchiveSize+1)
+	}
+	archive.size, err = io.Copy(file, source)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	if !forced && archive.size > s.maxArchiveSize {
+		archive.Close()
+		return nil, nil
+	}
+	return archive, nil
+}
@@ -0,0 +1,200 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// zipOf returns a zip archive with an entry for each blob ID
+func zipOf(t *testing.T, blobs map[string]string) []byte {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for blobID, content := range blobs {
+		entry, err := archive.Create(blobID)
+		assert.Nil(t, err)
+		_, err = io.WriteString(entry, content)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, archive.Close())
+	return buffer.Bytes()
+}
+
+func archiveTestService(t *testing.T, size uint64) *mocks.Service {
+	name := "Repo0"
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").
+		Return(&[]git.GitRepository{{Name: &name, Size: &size}}, nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(getItemsWithObjectIDs("/File0.txt", "/File1.txt", "/docs/File2.txt"), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return getItemContentTestData()
+		}, nil)
+	return mockConnection
+}
+
+func matchedFiles(results *Results) []string {
+	var files []string
+	for _, project := range *results.Projects {
+		for _, repository := range *project.Repositories {
+			for _, file := range *repository.Files {
+				files = append(files, file.Name)
+			}
+		}
+	}
+	return files
+}
+
+func TestScanFetchesMatchingFilesInOneArchive(t *testing.T) {
+	mockConnection := archiveTestService(t, 4096)
+	mockConnection.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(ioutil.NopCloser(bytes.NewReader(zipOf(t, map[string]string{
+			"0000000000000000000000000000000000000000": "Content To Test",
+			"0000000000000000000000000000000000000001": "nothing here",
+			"0000000000000000000000000000000000000002": "more\nContent",
+		}))), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.maxArchiveSize = 1 << 20
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.ElementsMatch(t, []string{"/File0.txt", "/docs/File2.txt"}, matchedFiles(results))
+	assert.Equal(t, int64(3), scanProjects.progress.FilesScanned)
+	mockConnection.AssertCalled(t, GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", []string{
+		"0000000000000000000000000000000000000000",
+		"0000000000000000000000000000000000000001",
+		"0000000000000000000000000000000000000002",
+	})
+	mockConnection.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestScanFetchesFilesOfLargeRepositoriesOneAtATime(t *testing.T) {
+	mockConnection := archiveTestService(t, 2<<20)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.maxArchiveSize = 1 << 20
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.Len(t, matchedFiles(results), 3)
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, 3)
+	mockConnection.AssertNotCalled(t, GetBlobsZipFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestScanFallsBackWhenTheArchiveIsTooLarge(t *testing.T) {
+	mockConnection := archiveTestService(t, 0)
+	mockConnection.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(ioutil.NopCloser(bytes.NewReader(zipOf(t, map[string]string{
+			"0000000000000000000000000000000000000000": strings.Repeat("Content To Test\n", 100),
+		}))), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.maxArchiveSize = 64
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.Len(t, matchedFiles(results), 3)
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, 3)
+}
+
+func TestScanFallsBackWhenTheArchiveFails(t *testing.T) {
+	mockConnection := archiveTestService(t, 0)
+	mockConnection.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(nil, errors.New("not found"))
+	scanProjects := sProjects(mockConnection)
+	scanProjects.maxArchiveSize = 1 << 20
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.Len(t, matchedFiles(results), 3)
+}
+
+func TestScanWithArchiveFetchReportsFailures(t *testing.T) {
+	mockConnection := archiveTestService(t, 2<<20)
+	mockConnection.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(nil, errors.New("connection reset")).Once()
+	mockConnection.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(ioutil.NopCloser(bytes.NewReader(zipOf(t, map[string]string{
+			"0000000000000000000000000000000000000000": "Content To Test",
+		}))), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Fetch = FetchArchive
+	scanProjects.criteria.Branches = "."
+	mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", branchRefFilter).
+		Return(getRefTestData("refs/heads/main", testMainCommit, "refs/heads/release", testReleaseCommit), nil)
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.True(t, results.Incomplete)
+	assert.Equal(t, []string{"/File0.txt"}, matchedFiles(results))
+	var operations []string
+	for _, scanError := range *results.Errors {
+		operations = append(operations, scanError.Operation+" "+scanError.Path)
+	}
+	assert.ElementsMatch(t, []string{
+		OperationGetBlobsZip + " ",
+		OperationReadArchive + " /File1.txt",
+		OperationReadArchive + " /docs/File2.txt",
+	}, operations)
+	mockConnection.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPostScansRepositoryArchiveOnPremCollection(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	hosts, err := parseHostAllowlist(server.URL)
+	assert.Nil(t, err)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, nil, nil), logger: mockLogging, hosts: hosts, maxArchiveSize: 1 << 20}
+
+	for fetch, expected := range map[string]string{
+		FetchAuto:  "blobs " + onPremConfigBlob,
+		FetchItems: "items /config.yml",
+	} {
+		server.fetches = nil
+		jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"yml","ContentPattern":"password","Fetch":"` + fetch + `"}`)
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(jsonCriteria))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Org", server.URL+server.collection)
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		api.postCacheHandler(NewMemoryCache(1024*1024)).ServeHTTP(rr, req)
+
+		assert.Equal(t, 200, rr.Code, fetch)
+		var results Results
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+		assert.False(t, results.Incomplete, rr.Body.String())
+		assert.Equal(t, []string{"/config.yml"}, matchedFiles(&results), fetch)
+		assert.Equal(t, []string{expected}, server.fetches, fetch)
+	}
+}
+
+func TestPostValidatesFetch(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"Fetch":"clone"}`, `Fetch must be "auto", "archive" or "items"`},
+		{`{"ContentPattern":"password","Fetch":"archive"}`, ""},
+		{`{"ContentPattern":"password","Fetch":"items"}`, ""},
+	})
+}
+
+func TestCacheKeyIgnoresFetch(t *testing.T) {
+	assertCacheKeys(t, []cacheKeyCase{
+		{"fetch", SearchCriteria{ContentPattern: "password", Fetch: FetchArchive}, SearchCriteria{ContentPattern: "password", Fetch: FetchItems}, true},
+	})
+}
@@ -0,0 +1,149 @@
+package ado
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Comments that keep matches out of the results, suppressLineComment suppresses the line it is on and
+// suppressNextLineComment the line after it
+const (
+	suppressLineComment     = "adoscanner:ignore"
+	suppressNextLineComment = "adoscanner:ignore-next-line"
+)
+
+// baseline fingerprints every match found during a scan and tells apart the ones that were accepted in an earlier
+// baseline from the new ones, it is shared by every goroutine of the scan
+type baseline struct {
+	org      string
+	key      []byte
+	mutex    sync.Mutex
+	accepted map[string]bool
+	found    map[string]bool
+}
+
+// newBaseline creates the baseline for a scan of org, accepted are the fingerprints exported by an earlier scan and
+// key, when it is set, keys the fingerprints so they can't be used to guess short secrets
+func newBaseline(org string, key []byte, accepted []string) *baseline {
+	b := &baseline{
+		org:      strings.ToLower(org),
+		key:      key,
+		accepted: make(map[string]bool, len(accepted)),
+		found:    make(map[string]bool),
+	}
+	for _, fingerprint := range accepted {
+		b.accepted[fingerprint] = true
+	}
+	return b
+}
+
+// fingerprintKeyCacheKey is where the generated fingerprint key is kept when FINGERPRINT_KEY isn't set
+const fingerprintKeyCacheKey = "fingerprintkey"
+
+// fingerprintKeyFromEnv returns FINGERPRINT_KEY or, when it isn't set, a random key generated once and kept in cache
+// so fingerprints stay the same across restarts and replicas sharing the cache. The key is read back after it is
+// stored so replicas starting together settle on the same one
+func fingerprintKeyFromEnv(cache Cache) ([]byte, error) {
+	if key := os.Getenv("FINGERPRINT_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	key, err := cache.Get(fingerprintKeyCacheKey)
+	if err != ErrCacheMiss {
+		return key, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := cache.Set(fingerprintKeyCacheKey, key, 0); err != nil {
+		return nil, err
+	}
+	return cache.Get(fingerprintKeyCacheKey)
+}
+
+// keyed reports whether the fingerprints are keyed, without a key a fingerprint is a plain hash of what matched
+func (b *baseline) keyed() bool {
+	return len(b.key) > 0
+}
+
+// fingerprint identifies a match by where it was found, the rule that found it and the text it matched, the line
+// number is left out so a match keeps its fingerprint when lines are added or removed above it
+func (b *baseline) fingerprint(project, repo, path, rule, text string) string {
+	mac := hmac.New(sha256.New, b.key)
+	for _, part := range []string{b.org, project, repo, path, rule, text} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isNew records the fingerprint as found and reports whether it wasn't accepted in the baseline, a match left without
+// a fingerprint is always new and never recorded
+func (b *baseline) isNew(fingerprint string) bool {
+	if fingerprint == "" {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.found[fingerprint] = true
+	return !b.accepted[fingerprint]
+}
+
+// accepts reports whether the fingerprint was accepted in the baseline without recording it as found
+func (b *baseline) accepts(fingerprint string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.accepted[fingerprint]
+}
+
+// export returns the fingerprint of every match found, new or accepted, ready to be sent as the next scan's baseline
+func (b *baseline) export() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return sortedKeys(b.found)
+}
+
+// disappeared returns the accepted fingerprints that were not found again
+func (b *baseline) disappeared() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	gone := make(map[string]bool)
+	for fingerprint := range b.accepted {
+		if !b.found[fingerprint] {
+			gone[fingerprint] = true
+		}
+	}
+	return sortedKeys(gone)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// suppression tracks the suppression comments of a file as it is read a line at a time
+type suppression struct {
+	nextLine bool
+}
+
+// suppressed reports whether the matches on the line are suppressed, either by a comment on the line itself or by one
+// on the line before it
+func (s *suppression) suppressed(line string) bool {
+	suppressed := s.nextLine
+	s.nextLine = strings.Contains(line, suppressNextLineComment)
+	if !s.nextLine && strings.Contains(line, suppressLineComment) {
+		suppressed = true
+	}
+	return suppressed
+}
@@ -0,0 +1,182 @@
+package ado
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// blobCacheKeyPrefix is prepended to the object ID of a blob to make its key, the ID is the hash of the content so a
+// blob can be shared by every repository, version and caller that lists it
+const blobCacheKeyPrefix = "blob:"
+
+// Defaults for the blob cache settings that aren't configured
+const (
+	defaultBlobCacheMaxBytes     = 256 << 20
+	defaultBlobCacheMaxBlobBytes = 1 << 20
+	defaultBlobCacheTTLHours     = 7 * 24
+)
+
+// Encodings of a cached blob, written ahead of its content so blobs cached before compression was turned on or off can
+// still be read
+const (
+	blobEncodingRaw  byte = 'r'
+	blobEncodingGzip byte = 'z'
+)
+
+// blobCache keeps the content of the blobs scans read in a Cache, keyed by object ID, so identical files are only
+// downloaded once. Blobs larger than maxBlobSize aren't kept so one large file can't push out many small ones
+type blobCache struct {
+	cache       Cache
+	compress    bool
+	maxBlobSize int64
+	ttl         time.Duration
+}
+
+// blobCacheFromEnv creates the blob cache selected by BLOB_CACHE_BACKEND, it returns nil when it isn't set. The memory
+// and file backends hold up to BLOB_CACHE_MAX_BYTES while redis is bounded by its own maxmemory policy and the ttl
+func blobCacheFromEnv() (*blobCache, error) {
+	backend := strings.ToLower(os.Getenv("BLOB_CACHE_BACKEND"))
+	maxBytes := int64(getEnvInt("BLOB_CACHE_MAX_BYTES", defaultBlobCacheMaxBytes))
+	var cache Cache
+	switch backend {
+	case "":
+		return nil, nil
+	case CacheBackendRedis:
+		cache = NewRedisCache(newRedisClientFromEnv())
+	case CacheBackendMemory:
+		cache = NewMemoryCache(maxBytes)
+	case CacheBackendFile:
+		var err error
+		cache, err = NewBoundedFileCache(getEnv("BLOB_CACHE_DIRECTORY", filepath.Join(os.TempDir(), "adoscanner-blobs")), maxBytes)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown BLOB_CACHE_BACKEND %q", backend)
+	}
+	compress, _ := strconv.ParseBool(os.Getenv("BLOB_CACHE_COMPRESS"))
+	return &blobCache{
+		cache:       cache,
+		compress:    compress,
+		maxBlobSize: int64(getEnvInt("BLOB_CACHE_MAX_BLOB_BYTES", defaultBlobCacheMaxBlobBytes)),
+		ttl:         time.Duration(getEnvInt("BLOB_CACHE_TTL_HOURS", defaultBlobCacheTTLHours)) * time.Hour,
+	}, nil
+}
+
+// get returns the content of the blob and whether it was cached, a blob that can't be read is treated as missing
+func (c *blobCache) get(objectID string) ([]byte, bool) {
+	value, err := c.cache.Get(blobCacheKeyPrefix + objectID)
+	if err != nil {
+		if err != ErrCacheMiss {
+			log.Printf("unable to read blob %s from the cache: %s", objectID, err)
+		}
+		return nil, false
+	}
+	if len(value) == 0 {
+		return nil, false
+	}
+
+	switch value[0] {
+	case blobEncodingRaw:
+		return value[1:], true
+	case blobEncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(value[1:]))
+		if err == nil {
+			var content []byte
+			content, err = ioutil.ReadAll(reader)
+			if err == nil {
+				return content, true
+			}
+		}
+		log.Printf("unable to decompress blob %s from the cache: %s", objectID, err)
+	}
+	return nil, false
+}
+
+// put caches the content of the blob, failing to only means it is downloaded again
+func (c *blobCache) put(objectID string, content []byte) {
+	var value bytes.Buffer
+	if c.compress {
+		value.WriteByte(blobEncodingGzip)
+		writer := gzip.NewWriter(&value)
+		if _, err := writer.Write(content); err != nil || writer.Close() != nil {
+			return
+		}
+	} else {
+		value.WriteByte(blobEncodingRaw)
+		value.Write(content)
+	}
+	if err := c.cache.Set(blobCacheKeyPrefix+objectID, value.Bytes(), c.ttl); err != nil {
+		log.Printf("unable to write blob %s to the cache: %s", objectID, err)
+	}
+}
+
+// BlobCacheSummary counts the blobs a scan looked up in the blob cache, Hits of them were read from it instead of being
+// downloaded and BytesSaved is the size of their content. HitRate is Hits over all the lookups
+type BlobCacheSummary struct {
+	Hits       int64
+	Misses     int64
+	HitRate    float64
+	BytesSaved int64
+}
+
+// blobCacheStats are the counters behind a BlobCacheSummary, updated atomically by every goroutine of the scan
+type blobCacheStats struct {
+	hits   int64
+	misses int64
+	saved  int64
+}
+
+// summary returns the counters or nil when no blob was looked up
+func (b *blobCacheStats) summary() *BlobCacheSummary {
+	summary := BlobCacheSummary{
+		Hits:       atomic.LoadInt64(&b.hits),
+		Misses:     atomic.LoadInt64(&b.misses),
+		BytesSaved: atomic.LoadInt64(&b.saved),
+	}
+	lookups := summary.Hits + summary.Misses
+	if lookups == 0 {
+		return nil
+	}
+	summary.HitRate = float64(summary.Hits) / float64(lookups)
+	return &summary
+}
+
+// cachedBlob looks the blob up in the scan's blob cache and counts the lookup
+func (s *ScanProjects) cachedBlob(objectID string) ([]byte, bool) {
+	content, ok := s.blobs.get(objectID)
+	if ok {
+		atomic.AddInt64(&s.blobStats.hits, 1)
+		atomic.AddInt64(&s.blobStats.saved, int64(len(content)))
+	} else {
+		atomic.AddInt64(&s.blobStats.misses, 1)
+	}
+	return content, ok
+}
+
+// cachingReader returns a reader of the downloaded blob that caches it on the way, a blob too large to cache is read
+// on from where the check for its size stopped
+func (s *ScanProjects) cachingReader(objectID string, file io.Reader) (io.Reader, error) {
+	if s.blobs == nil || objectID == "" {
+		return file, nil
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(file, s.blobs.maxBlobSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > s.blobs.maxBlobSize {
+		return io.MultiReader(bytes.NewReader(content), file), nil
+	}
+	s.blobs.put(objectID, content)
+	return bytes.NewReader(content), nil
+}
@@ -0,0 +1,196 @@
+package ado
+
+import (
+	mocks "adoscanner/mocks/ado"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBlobCache(compress bool) *blobCache {
+	return &blobCache{cache: NewMemoryCache(1 << 20), compress: compress, maxBlobSize: 1024, ttl: time.Hour}
+}
+
+func TestScanReadsBlobsFromTheBlobCache(t *testing.T) {
+	blobs := newTestBlobCache(false)
+	first := archiveTestService(t, 2<<20)
+	scanProjects := sProjects(first)
+	scanProjects.blobs = blobs
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+	assert.Len(t, matchedFiles(results), 3)
+	first.AssertNumberOfCalls(t, GetItemContentFuncName, 3)
+	assert.Equal(t, &BlobCacheSummary{Misses: 3}, results.BlobCache)
+
+	// Another repository, branch or request listing the same blobs doesn't download them again
+	second := archiveTestService(t, 2<<20)
+	scanProjects = sProjects(second)
+	scanProjects.blobs = blobs
+	results, err = scanProjects.Scan()
+	assert.Nil(t, err)
+	assert.Len(t, matchedFiles(results), 3)
+	second.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, &BlobCacheSummary{Hits: 3, HitRate: 1, BytesSaved: 3 * int64(len("Content To Test\nboo"))}, results.BlobCache)
+	assert.Equal(t, int64(3), scanProjects.progress.FilesScanned)
+}
+
+func TestScanCachesTheBlobsOfAnArchive(t *testing.T) {
+	blobs := newTestBlobCache(true)
+	first := archiveTestService(t, 4096)
+	first.On(GetBlobsZipFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).
+		Return(ioutil.NopCloser(bytes.NewReader(zipOf(t, map[string]string{
+			"0000000000000000000000000000000000000000": "Content To Test",
+			"0000000000000000000000000000000000000001": "nothing here",
+			"0000000000000000000000000000000000000002": "more\nContent",
+		}))), nil)
+	scanProjects := sProjects(first)
+	scanProjects.maxArchiveSize = 1 << 20
+	scanProjects.blobs = blobs
+	_, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	second := archiveTestService(t, 4096)
+	scanProjects = sProjects(second)
+	scanProjects.maxArchiveSize = 1 << 20
+	scanProjects.blobs = blobs
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"/File0.txt", "/docs/File2.txt"}, matchedFiles(results))
+	second.AssertNotCalled(t, GetBlobsZipFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	second.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, int64(3), results.BlobCache.Hits)
+}
+
+// trackingCache counts how many lookups are in flight at once
+type trackingCache struct {
+	Cache
+	lookups *inFlight
+}
+
+func (c trackingCache) Get(key string) ([]byte, error) {
+	c.lookups.track(nil)
+	return c.Cache.Get(key)
+}
+
+func TestScanLooksBlobsUpConcurrently(t *testing.T) {
+	for _, maxArchiveSize := range []int64{0, 1 << 20} {
+		lookups := new(inFlight)
+		blobs := newTestBlobCache(false)
+		for _, objectID := range []string{"0000000000000000000000000000000000000000", "0000000000000000000000000000000000000001", "0000000000000000000000000000000000000002"} {
+			blobs.put(objectID, []byte("Content To Test"))
+		}
+		blobs.cache = trackingCache{Cache: blobs.cache, lookups: lookups}
+
+		mockConnection := archiveTestService(t, 4096)
+		scanProjects := sProjects(mockConnection)
+		scanProjects.maxArchiveSize = maxArchiveSize
+		scanProjects.blobs = blobs
+		results, err := scanProjects.Scan()
+		assert.Nil(t, err)
+		assert.Len(t, matchedFiles(results), 3)
+		assert.Equal(t, int64(3), results.BlobCache.Hits)
+		assert.True(t, lookups.max > 1, "expected concurrent lookups with a maximum archive size of %d", maxArchiveSize)
+		mockConnection.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	}
+}
+
+func TestCachedResultsLeaveTheBlobCacheSummaryOut(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil).Once()
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemsWithObjectIDs("/File0.txt"), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "/File0.txt", mock.Anything).Return(getItemContentTestData(), nil)
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	api := API{serviceFactory: staticServiceFactory{service: mockConnection}, logger: mockLogging, blobs: newTestBlobCache(false)}
+	handler := api.postCacheHandler(NewMemoryCache(1 << 20))
+	criteria, _ := json.Marshal(SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "File", ContentPattern: "Content"})
+	var responses []Results
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewBuffer(criteria))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Org", "itsals")
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var results Results
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+		responses = append(responses, results)
+	}
+
+	assert.Equal(t, &BlobCacheSummary{Misses: 1}, responses[0].BlobCache)
+	// The second request was answered from the cache without looking any blob up
+	assert.Nil(t, responses[1].BlobCache)
+	assert.Equal(t, matchedFiles(&responses[0]), matchedFiles(&responses[1]))
+}
+
+func TestBlobCacheReadsEitherEncoding(t *testing.T) {
+	content := []byte(strings.Repeat("password: hunter2\n", 20))
+	compressed := newTestBlobCache(true)
+	compressed.put("abc", content)
+	stored, err := compressed.cache.Get(blobCacheKeyPrefix + "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, blobEncodingGzip, stored[0])
+	assert.True(t, len(stored) < len(content))
+
+	// Turning compression off doesn't lose what was cached with it on
+	plain := &blobCache{cache: compressed.cache, maxBlobSize: 1024}
+	cached, ok := plain.get("abc")
+	assert.True(t, ok)
+	assert.Equal(t, content, cached)
+
+	_, ok = plain.get("missing")
+	assert.False(t, ok)
+}
+
+func TestBlobsTooLargeToCacheAreStillReadInFull(t *testing.T) {
+	scanProjects := &ScanProjects{blobs: newTestBlobCache(false)}
+	content := strings.Repeat("x", 1500)
+	reader, err := scanProjects.cachingReader("large", strings.NewReader(content))
+	assert.Nil(t, err)
+	read, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(read))
+
+	_, ok := scanProjects.blobs.get("large")
+	assert.False(t, ok)
+}
+
+func TestScanWithoutABlobCacheLeavesTheSummaryOut(t *testing.T) {
+	results, err := sProjects(archiveTestService(t, 2<<20)).Scan()
+	assert.Nil(t, err)
+	assert.Nil(t, results.BlobCache)
+}
+
+func TestBlobCacheFromEnv(t *testing.T) {
+	defer os.Unsetenv("BLOB_CACHE_BACKEND")
+	defer os.Unsetenv("BLOB_CACHE_DIRECTORY")
+	defer os.Unsetenv("BLOB_CACHE_COMPRESS")
+
+	blobs, err := blobCacheFromEnv()
+	assert.Nil(t, err)
+	assert.Nil(t, blobs)
+
+	os.Setenv("BLOB_CACHE_BACKEND", "file")
+	os.Setenv("BLOB_CACHE_DIRECTORY", tempCacheDirectory(t))
+	os.Setenv("BLOB_CACHE_COMPRESS", "true")
+	blobs, err = blobCacheFromEnv()
+	assert.Nil(t, err)
+	assert.IsType(t, &FileCache{}, blobs.cache)
+	assert.Equal(t, int64(defaultBlobCacheMaxBytes), blobs.cache.(*FileCache).maxBytes)
+	assert.True(t, blobs.compress)
+
+	os.Setenv("BLOB_CACHE_BACKEND", "s3")
+	_, err = blobCacheFromEnv()
+	assert.EqualError(t, err, `unknown BLOB_CACHE_BACKEND "s3"`)
+}
@@ -0,0 +1,99 @@
+package ado
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache backends that can be chosen with CACHE_BACKEND
+const (
+	CacheBackendRedis  = "redis"
+	CacheBackendMemory = "memory"
+	CacheBackendFile   = "file"
+)
+
+const defaultMemoryCacheMaxBytes = 64 * 1024 * 1024
+
+// ErrCacheMiss is returned by a Cache when the key does not exist or has expired
+var ErrCacheMiss = errors.New("cache miss")
+
+// ErrCacheValueTooLarge is returned by a bounded Cache for a value it can never hold
+var ErrCacheValueTooLarge = errors.New("value is larger than the cache can hold")
+
+// Cache stores scan results and scan jobs, it lets the scanner run against redis or without any external store
+type Cache interface {
+	// Get returns ErrCacheMiss when the key does not exist or has expired
+	Get(key string) ([]byte, error)
+	// Set stores the value for ttl, a ttl of zero keeps it until it is deleted or evicted. It returns
+	// ErrCacheValueTooLarge when the value is larger than the cache can hold
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete does nothing when the key does not exist
+	Delete(key string) error
+	// TTL returns the time left before the key expires, zero when it never expires and ErrCacheMiss when it does not exist
+	TTL(key string) (time.Duration, error)
+}
+
+// RedisCache implements Cache on top of redis so every replica shares the same results and jobs
+type RedisCache struct {
+	client redis.Cmdable
+}
+
+// NewRedisCache creates a Cache that stores everything in redis
+func NewRedisCache(client redis.Cmdable) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+// Get returns the value stored in redis
+func (cache *RedisCache) Get(key string) ([]byte, error) {
+	value, err := cache.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return value, err
+}
+
+// Set stores the value in redis
+func (cache *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	return cache.client.Set(key, value, ttl).Err()
+}
+
+// Delete removes the key from redis
+func (cache *RedisCache) Delete(key string) error {
+	return cache.client.Del(key).Err()
+}
+
+// TTL returns the time left before redis expires the key
+func (cache *RedisCache) TTL(key string) (time.Duration, error) {
+	ttl, err := cache.client.TTL(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// redis replies -2 for a missing key and -1 for a key without an expiry
+	switch {
+	case ttl == -2*time.Second:
+		return 0, ErrCacheMiss
+	case ttl < 0:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// newCacheFromEnv creates the Cache selected by CACHE_BACKEND, redis is used when it is not set
+func newCacheFromEnv() (Cache, error) {
+	backend := strings.ToLower(getEnv("CACHE_BACKEND", CacheBackendRedis))
+	switch backend {
+	case CacheBackendRedis:
+		return NewRedisCache(newRedisClientFromEnv()), nil
+	case CacheBackendMemory:
+		return NewMemoryCache(int64(getEnvInt("CACHE_MEMORY_MAX_BYTES", defaultMemoryCacheMaxBytes))), nil
+	case CacheBackendFile:
+		return NewFileCache(getEnv("CACHE_DIRECTORY", filepath.Join(os.TempDir(), "adoscanner-cache")))
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", backend)
+	}
+}
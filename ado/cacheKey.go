@@ -0,0 +1,69 @@
+package ado
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cacheKeyVersion is bumped whenever the shape of the cached Results changes so old entries are never read back
+const cacheKeyVersion = "v2"
+
+// cacheKeyInput is everything that decides what a scan returns, it is hashed as JSON so no two different inputs can
+// run together into the same key
+type cacheKeyInput struct {
+	Org               string
+	Identity          string
+	Criteria          SearchCriteria
+	Rules             []string
+	DefaultExclusions string `json:",omitempty"`
+}
+
+// cacheKey builds the key results are cached under, it is partitioned by a fingerprint of the caller's token so
+// results are only ever shared between requests that can see the same projects. The digests of the selected rule packs
+// are included so changing a pack doesn't return results found with its old rules, and so are the server's default
+// exclusions unless the criteria disable them
+func cacheKey(org, personalAccessToken string, criteria *SearchCriteria, packs rulePacks, defaultExclusions *regexp.Regexp) (string, error) {
+	normalized := *criteria
+	// These only change how the scan runs, not what it finds
+	normalized.Concurrency = Concurrency{}
+	normalized.TimeoutSeconds = 0
+	normalized.Fetch = ""
+	normalized.Incremental = false
+	// The baseline is a set, the order it was sent in doesn't matter
+	normalized.Baseline = append([]string(nil), criteria.Baseline...)
+	sort.Strings(normalized.Baseline)
+	normalized.Tags = append([]string(nil), criteria.Tags...)
+	sort.Strings(normalized.Tags)
+	normalized.Commit = strings.ToLower(criteria.Commit)
+	switch {
+	case normalized.Mode == ModeSecrets:
+		// The rule pack is used instead of the content pattern
+		normalized.ContentPattern = ""
+	case criteria.pathsOnly():
+		normalized.Mode = ModePaths
+	default:
+		normalized.Mode = ModeContent
+	}
+
+	keyInput := cacheKeyInput{
+		Org:      strings.ToLower(strings.TrimSpace(org)),
+		Identity: tokenFingerprint(personalAccessToken),
+		Criteria: normalized,
+		Rules:    packs.digests(criteria.RulePacks),
+	}
+	if defaultExclusions != nil && !criteria.DisableDefaultExclusions {
+		keyInput.DefaultExclusions = defaultExclusions.String()
+	}
+	input, err := json.Marshal(keyInput)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(input)
+	return fmt.Sprintf("results:%s:%s", cacheKeyVersion, hex.EncodeToString(sum[:])), nil
+}
@@ -0,0 +1,61 @@
+package ado
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func mustCacheKey(t *testing.T, org, pat string, criteria SearchCriteria) string {
+	key, err := cacheKey(org, pat, &criteria, nil, nil)
+	assert.Nil(t, err)
+	return key
+}
+
+// cacheKeyCase is a pair of criteria and whether they have to share a cache key
+type cacheKeyCase struct {
+	name          string
+	first, second SearchCriteria
+	same          bool
+}
+
+// assertCacheKeys checks the cache keys of each pair of criteria are the same or differ as the case expects
+func assertCacheKeys(t *testing.T, cases []cacheKeyCase) {
+	for _, test := range cases {
+		first, second := mustCacheKey(t, "itsals", "123", test.first), mustCacheKey(t, "itsals", "123", test.second)
+		if test.same {
+			assert.Equal(t, first, second, test.name)
+		} else {
+			assert.NotEqual(t, first, second, test.name)
+		}
+	}
+}
+
+func TestCacheKeyIsVersionedAndHidesItsInputs(t *testing.T) {
+	key := mustCacheKey(t, "itsals", "secret-token", SearchCriteria{ContentPattern: "password"})
+	assert.True(t, strings.HasPrefix(key, "results:"+cacheKeyVersion+":"))
+	assert.NotContains(t, key, "itsals")
+	assert.NotContains(t, key, "secret-token")
+	assert.NotContains(t, key, "password")
+}
+
+func TestCacheKeyIsPartitionedByToken(t *testing.T) {
+	criteria := SearchCriteria{ProjectNamePattern: "Project", ContentPattern: "password"}
+	assert.NotEqual(t, mustCacheKey(t, "itsals", "full-access", criteria), mustCacheKey(t, "itsals", "one-project", criteria))
+	assert.Equal(t, mustCacheKey(t, "itsals", "full-access", criteria), mustCacheKey(t, " ITSALS ", "full-access", criteria))
+}
+
+func TestCacheKeyCannotCollideAcrossFields(t *testing.T) {
+	first := SearchCriteria{ProjectNamePattern: "a", FileNamePattern: "bc"}
+	second := SearchCriteria{ProjectNamePattern: "ab", FileNamePattern: "c"}
+	assert.NotEqual(t, mustCacheKey(t, "itsals", "123", first), mustCacheKey(t, "itsals", "123", second))
+	assert.NotEqual(t, mustCacheKey(t, "itsals", "123", first), mustCacheKey(t, "itsalsa", "123", SearchCriteria{FileNamePattern: "bc"}))
+}
+
+func TestCacheKeyIgnoresHowTheScanRuns(t *testing.T) {
+	assertCacheKeys(t, []cacheKeyCase{
+		{"concurrency and timeout", SearchCriteria{ContentPattern: "password"},
+			SearchCriteria{ContentPattern: "password", Concurrency: Concurrency{Files: 2}, TimeoutSeconds: 30}, true},
+		{"context lines", SearchCriteria{ContentPattern: "password"}, SearchCriteria{ContentPattern: "password", ContextLines: 2}, false},
+	})
+}
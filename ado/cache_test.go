@@ -0,0 +1,312 @@
+package ado
+
+import (
+	"bytes"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testClock lets the in-process caches be moved forward in time the way miniredis.FastForward does for redis
+type testClock struct {
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *testClock) FastForward(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+// cacheUnderTest is a fresh, empty cache along with a way to move its clock forward
+type cacheUnderTest struct {
+	cache       Cache
+	fastForward func(d time.Duration)
+}
+
+// runCacheConformance runs the behaviour every Cache implementation has to share
+func runCacheConformance(t *testing.T, newCache func(t *testing.T) cacheUnderTest) {
+	t.Run("MissingKey", func(t *testing.T) {
+		c := newCache(t).cache
+		_, err := c.Get("missing")
+		assert.Equal(t, ErrCacheMiss, err)
+		_, err = c.TTL("missing")
+		assert.Equal(t, ErrCacheMiss, err)
+	})
+
+	t.Run("SetThenGet", func(t *testing.T) {
+		c := newCache(t).cache
+		assert.Nil(t, c.Set("results:v1:abc", []byte(`{"Projects":[]}`), time.Hour))
+		value, err := c.Get("results:v1:abc")
+		assert.Nil(t, err)
+		assert.Equal(t, `{"Projects":[]}`, string(value))
+	})
+
+	t.Run("SetOverwrites", func(t *testing.T) {
+		c := newCache(t).cache
+		assert.Nil(t, c.Set("key", []byte("first"), time.Hour))
+		assert.Nil(t, c.Set("key", []byte("second"), time.Hour))
+		value, err := c.Get("key")
+		assert.Nil(t, err)
+		assert.Equal(t, "second", string(value))
+	})
+
+	t.Run("EmptyValue", func(t *testing.T) {
+		c := newCache(t).cache
+		assert.Nil(t, c.Set("key", []byte{}, time.Hour))
+		value, err := c.Get("key")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(value))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		c := newCache(t).cache
+		assert.Nil(t, c.Set("key", []byte("value"), time.Hour))
+		assert.Nil(t, c.Delete("key"))
+		_, err := c.Get("key")
+		assert.Equal(t, ErrCacheMiss, err)
+		assert.Nil(t, c.Delete("key"))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		c := newCache(t).cache
+		assert.Nil(t, c.Set("expiring", []byte("value"), time.Hour))
+		ttl, err := c.TTL("expiring")
+		assert.Nil(t, err)
+		assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, "ttl was %s", ttl)
+
+		assert.Nil(t, c.Set("forever", []byte("value"), 0))
+		ttl, err = c.TTL("forever")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Duration(0), ttl)
+	})
+
+	t.Run("Expires", func(t *testing.T) {
+		under := newCache(t)
+		assert.Nil(t, under.cache.Set("expiring", []byte("value"), time.Minute))
+		assert.Nil(t, under.cache.Set("forever", []byte("value"), 0))
+		under.fastForward(time.Minute + time.Second)
+
+		_, err := under.cache.Get("expiring")
+		assert.Equal(t, ErrCacheMiss, err)
+		_, err = under.cache.TTL("expiring")
+		assert.Equal(t, ErrCacheMiss, err)
+		value, err := under.cache.Get("forever")
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value))
+	})
+
+	t.Run("ValueIsNotShared", func(t *testing.T) {
+		c := newCache(t).cache
+		value := []byte("value")
+		assert.Nil(t, c.Set("key", value, time.Hour))
+		value[0] = 'X'
+		stored, err := c.Get("key")
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(stored))
+	})
+}
+
+func TestRedisCacheConformance(t *testing.T) {
+	runCacheConformance(t, func(t *testing.T) cacheUnderTest {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(mr.Close)
+		return cacheUnderTest{
+			cache:       NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+			fastForward: mr.FastForward,
+		}
+	})
+}
+
+func TestMemoryCacheConformance(t *testing.T) {
+	runCacheConformance(t, func(t *testing.T) cacheUnderTest {
+		clock := &testClock{now: time.Now()}
+		cache := NewMemoryCache(1024)
+		cache.now = clock.Now
+		return cacheUnderTest{cache: cache, fastForward: clock.FastForward}
+	})
+}
+
+func TestFileCacheConformance(t *testing.T) {
+	runCacheConformance(t, func(t *testing.T) cacheUnderTest {
+		directory := tempCacheDirectory(t)
+		clock := &testClock{now: time.Now()}
+		cache, err := NewFileCache(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.now = clock.Now
+		return cacheUnderTest{cache: cache, fastForward: clock.FastForward}
+	})
+}
+
+func TestBoundedFileCacheConformance(t *testing.T) {
+	runCacheConformance(t, func(t *testing.T) cacheUnderTest {
+		clock := &testClock{now: time.Now()}
+		cache, err := NewBoundedFileCache(tempCacheDirectory(t), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.now = clock.Now
+		return cacheUnderTest{cache: cache, fastForward: clock.FastForward}
+	})
+}
+
+func tempCacheDirectory(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "adoscanner-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(directory) })
+	return directory
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewMemoryCache(10)
+	assert.Nil(t, cache.Set("a", []byte("aaaa"), 0))
+	assert.Nil(t, cache.Set("b", []byte("bbbb"), 0))
+	_, err := cache.Get("a")
+	assert.Nil(t, err)
+
+	assert.Nil(t, cache.Set("c", []byte("cccc"), 0))
+
+	_, err = cache.Get("b")
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = cache.Get("a")
+	assert.Nil(t, err)
+	_, err = cache.Get("c")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), cache.size)
+}
+
+func TestMemoryCacheRejectsValuesLargerThanTheCache(t *testing.T) {
+	cache := NewMemoryCache(4)
+	assert.Nil(t, cache.Set("a", []byte("aaaa"), 0))
+	assert.Equal(t, ErrCacheValueTooLarge, cache.Set("b", []byte("bbbbb"), 0))
+
+	_, err := cache.Get("b")
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = cache.Get("a")
+	assert.Nil(t, err)
+}
+
+func TestUnboundedMemoryCacheDropsExpiredEntries(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	cache := NewMemoryCache(0)
+	cache.now = clock.Now
+	assert.Nil(t, cache.Set("expiring", bytes.Repeat([]byte("x"), 1<<20), time.Minute))
+	assert.Nil(t, cache.Set("forever", []byte("kept"), 0))
+
+	clock.FastForward(2 * memoryCacheSweepInterval)
+	assert.Nil(t, cache.Set("another", []byte("value"), 0))
+	assert.Equal(t, int64(len("kept")+len("value")), cache.size)
+}
+
+func TestBoundedFileCacheRejectsValuesLargerThanTheCache(t *testing.T) {
+	cache, err := NewBoundedFileCache(tempCacheDirectory(t), 16)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Set("a", []byte("aaaa"), 0))
+	assert.Equal(t, ErrCacheValueTooLarge, cache.Set("a", bytes.Repeat([]byte("a"), 9), 0))
+	_, err = cache.Get("a")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestBoundedFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	// Every file holds its 8 byte header and a 4 byte value
+	cache, err := NewBoundedFileCache(tempCacheDirectory(t), 30)
+	assert.Nil(t, err)
+	cache.now = clock.Now
+	assert.Nil(t, cache.Set("a", []byte("aaaa"), 0))
+	clock.FastForward(time.Second)
+	assert.Nil(t, cache.Set("b", []byte("bbbb"), 0))
+	clock.FastForward(time.Second)
+	_, err = cache.Get("a")
+	assert.Nil(t, err)
+	clock.FastForward(time.Second)
+
+	assert.Nil(t, cache.Set("c", []byte("cccc"), 0))
+
+	_, err = cache.Get("b")
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = cache.Get("a")
+	assert.Nil(t, err)
+	_, err = cache.Get("c")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(24), cache.size)
+
+	// Replacing a value only counts the difference
+	assert.Nil(t, cache.Set("c", []byte("cc"), 0))
+	assert.Equal(t, int64(22), cache.size)
+	assert.Nil(t, cache.Delete("c"))
+	assert.Equal(t, int64(12), cache.size)
+}
+
+func TestFileCacheSweepsExpiredFilesOnSet(t *testing.T) {
+	directory := tempCacheDirectory(t)
+	clock := &testClock{now: time.Now()}
+	cache, err := NewFileCache(directory)
+	assert.Nil(t, err)
+	cache.now = clock.Now
+
+	assert.Nil(t, cache.Set("once", []byte("value"), time.Minute))
+	assert.Nil(t, cache.Set("forever", []byte("value"), 0))
+	clock.FastForward(2 * time.Minute)
+	assert.Nil(t, cache.Set("again", []byte("value"), time.Minute))
+	files, err := ioutil.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+
+	clock.FastForward(fileCacheSweepInterval)
+	assert.Nil(t, cache.Set("later", []byte("value"), 0))
+	files, err = ioutil.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	_, err = os.Stat(cache.path("forever"))
+	assert.Nil(t, err)
+}
+
+func TestFileCacheKeepsKeysInsideItsDirectory(t *testing.T) {
+	directory := tempCacheDirectory(t)
+	cache, err := NewFileCache(directory)
+	assert.Nil(t, err)
+
+	assert.Nil(t, cache.Set("../../escape", []byte("value"), 0))
+	files, err := ioutil.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestNewCacheFromEnv(t *testing.T) {
+	defer os.Unsetenv("CACHE_BACKEND")
+	defer os.Unsetenv("CACHE_DIRECTORY")
+
+	os.Setenv("CACHE_BACKEND", "memory")
+	cache, err := newCacheFromEnv()
+	assert.Nil(t, err)
+	assert.IsType(t, &MemoryCache{}, cache)
+
+	os.Setenv("CACHE_BACKEND", "file")
+	os.Setenv("CACHE_DIRECTORY", tempCacheDirectory(t))
+	cache, err = newCacheFromEnv()
+	assert.Nil(t, err)
+	assert.IsType(t, &FileCache{}, cache)
+
+	os.Unsetenv("CACHE_BACKEND")
+	cache, err = newCacheFromEnv()
+	assert.Nil(t, err)
+	assert.IsType(t, &RedisCache{}, cache)
+
+	os.Setenv("CACHE_BACKEND", "memcached")
+	_, err = newCacheFromEnv()
+	assert.EqualError(t, err, `unknown CACHE_BACKEND "memcached"`)
+}
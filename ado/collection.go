@@ -0,0 +1,107 @@
+package ado
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// defaultAllowedHosts are the Azure DevOps Services hosts a collection URL may point at when ADO_ALLOWED_HOSTS is not set
+const defaultAllowedHosts = "dev.azure.com,*.visualstudio.com"
+
+// errCollectionNotAllowed is returned for an Org header that isn't an organization name or an allowed collection URL
+var errCollectionNotAllowed = errors.New("Org header must be an organization name or the URL of an allowed collection")
+
+var organizationName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// allowedHost is one ADO_ALLOWED_HOSTS entry, "*.example.com" matches any subdomain, a port restricts it to that port
+// and an "http://" prefix is the only way to allow a collection that isn't served over https
+type allowedHost struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// hostAllowlist keeps the scanner from being pointed at arbitrary hosts, every collection URL has to match an entry
+type hostAllowlist []allowedHost
+
+// parseHostAllowlist reads a comma separated list of hosts such as "dev.azure.com,*.visualstudio.com,tfs.example.com:8443"
+func parseHostAllowlist(value string) (hostAllowlist, error) {
+	var allowlist hostAllowlist
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		scheme := "https"
+		if strings.Contains(entry, "://") {
+			parsed, err := url.Parse(entry)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid ADO_ALLOWED_HOSTS entry %q", entry)
+			}
+			scheme = parsed.Scheme
+			entry = parsed.Host
+		}
+
+		host, port := entry, ""
+		if index := strings.LastIndex(entry, ":"); index >= 0 {
+			host, port = entry[:index], entry[index+1:]
+		}
+		if host == "" || strings.ContainsAny(host, "/@?#") {
+			return nil, fmt.Errorf("invalid ADO_ALLOWED_HOSTS entry %q", entry)
+		}
+		allowlist = append(allowlist, allowedHost{scheme: scheme, host: host, port: port})
+	}
+	return allowlist, nil
+}
+
+func (allowlist hostAllowlist) allows(collection *url.URL) bool {
+	host := strings.ToLower(collection.Hostname())
+	for _, allowed := range allowlist {
+		if allowed.scheme != collection.Scheme {
+			continue
+		}
+		if allowed.port != "" && allowed.port != collection.Port() {
+			continue
+		}
+		if allowed.port == "" && collection.Port() != "" {
+			continue
+		}
+		if strings.HasPrefix(allowed.host, "*.") {
+			if strings.HasSuffix(host, allowed.host[1:]) && len(host) > len(allowed.host)-1 {
+				return true
+			}
+			continue
+		}
+		if host == allowed.host {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionURL turns the Org header into the base URL of the collection to scan, an organization name is scanned on
+// dev.azure.com while a full URL, such as an Azure DevOps Server collection or a legacy *.visualstudio.com
+// organization, is only accepted when its host is in the allowlist
+func (allowlist hostAllowlist) collectionURL(org string) (string, error) {
+	if organizationName.MatchString(org) {
+		return fmt.Sprintf("https://dev.azure.com/%s", org), nil
+	}
+
+	collection, err := url.Parse(org)
+	if err != nil || collection.Host == "" || collection.User != nil || collection.RawQuery != "" || collection.Fragment != "" || collection.Opaque != "" {
+		return "", errCollectionNotAllowed
+	}
+	collection.Scheme = strings.ToLower(collection.Scheme)
+	if !allowlist.allows(collection) {
+		return "", errCollectionNotAllowed
+	}
+
+	collection.Host = strings.ToLower(collection.Host)
+	collection.Path = strings.TrimRight(collection.Path, "/")
+	collection.RawPath = ""
+	return collection.String(), nil
+}
@@ -0,0 +1,146 @@
+package ado
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// defaultConcurrency is used when neither the server configuration nor the request sets a limit
+var defaultConcurrency = Concurrency{
+	Projects:     4,
+	Repositories: 8,
+	Files:        16,
+	Requests:     32,
+}
+
+// concurrencyFromEnv reads the server wide concurrency limits, anything missing or invalid falls back to the default
+func concurrencyFromEnv() Concurrency {
+	return Concurrency{
+		Projects:     getEnvInt("SCAN_PROJECT_CONCURRENCY", defaultConcurrency.Projects),
+		Repositories: getEnvInt("SCAN_REPOSITORY_CONCURRENCY", defaultConcurrency.Repositories),
+		Files:        getEnvInt("SCAN_FILE_CONCURRENCY", defaultConcurrency.Files),
+		Requests:     getEnvInt("ADO_MAX_REQUESTS", defaultConcurrency.Requests),
+	}
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// within returns the requested limits capped by the configured ones, unset values use the configured limit
+func (c Concurrency) within(limits Concurrency) Concurrency {
+	return Concurrency{
+		Projects:     capLimit(c.Projects, limits.Projects),
+		Repositories: capLimit(c.Repositories, limits.Repositories),
+		Files:        capLimit(c.Files, limits.Files),
+		Requests:     capLimit(c.Requests, limits.Requests),
+	}
+}
+
+func capLimit(requested, limit int) int {
+	if requested <= 0 || requested > limit {
+		return limit
+	}
+	return requested
+}
+
+// limiter is a counting semaphore that bounds how many goroutines do a piece of work at once
+type limiter chan struct{}
+
+func newLimiter(size int) limiter {
+	return make(limiter, size)
+}
+
+// acquire blocks until a slot is free and returns false without taking one if ctx is done first
+func (l limiter) acquire(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l limiter) release() {
+	<-l
+}
+
+// scanLimits holds a limiter for each level of the project, repository and file fan out
+type scanLimits struct {
+	projects     limiter
+	repositories limiter
+	files        limiter
+}
+
+func newScanLimits(concurrency Concurrency) scanLimits {
+	return scanLimits{
+		projects:     newLimiter(concurrency.Projects),
+		repositories: newLimiter(concurrency.Repositories),
+		files:        newLimiter(concurrency.Files),
+	}
+}
+
+type requestLimitsKey struct{}
+
+// withRequestLimit returns a context whose requests to Azure DevOps each hold a slot of requests, on top of the limits
+// ctx already carries, until their response has been read to the end or closed. The limits are taken in the order they
+// were added so requests waiting on them never hold a slot another one is waiting for
+func withRequestLimit(ctx context.Context, requests limiter) context.Context {
+	outer := requestLimits(ctx)
+	return context.WithValue(ctx, requestLimitsKey{}, append(outer[:len(outer):len(outer)], requests))
+}
+
+func requestLimits(ctx context.Context) []limiter {
+	limits, _ := ctx.Value(requestLimitsKey{}).([]limiter)
+	return limits
+}
+
+// acquireAll takes a slot of every limiter in turn, giving back the ones it took when ctx is done first
+func acquireAll(ctx context.Context, limiters []limiter) bool {
+	for i, l := range limiters {
+		if !l.acquire(ctx) {
+			releaseAll(limiters[:i])
+			return false
+		}
+	}
+	return true
+}
+
+func releaseAll(limiters []limiter) {
+	for _, l := range limiters {
+		l.release()
+	}
+}
+
+// limitedBody gives the request slots of a response back the first time its body is read to the end or closed
+type limitedBody struct {
+	io.ReadCloser
+	limits []limiter
+	once   sync.Once
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+func (b *limitedBody) release() {
+	releaseAll(b.limits)
+}
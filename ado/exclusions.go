@@ -0,0 +1,93 @@
+package ado
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultExcludedPaths matches the vendored and generated directories and the lockfiles that are left out of every scan
+// that doesn't set DisableDefaultExclusions, the server can replace it with DEFAULT_EXCLUDED_PATHS
+const defaultExcludedPaths = `(^|/)(node_modules|bower_components|vendor|third_party|packages|dist|bin|obj)/` +
+	`|(^|/)(package-lock\.json|npm-shrinkwrap\.json|yarn\.lock|pnpm-lock\.yaml|go\.sum|Gemfile\.lock|Cargo\.lock|composer\.lock|Pipfile\.lock|poetry\.lock|packages\.lock\.json)$` +
+	`|\.min\.(js|css)$`
+
+// exclusions are the compiled Exclude patterns of a scan, a nil pattern excludes nothing
+type exclusions struct {
+	projects     *regexp.Regexp
+	repositories *regexp.Regexp
+	paths        *regexp.Regexp
+	defaults     *regexp.Regexp
+	content      *regexp.Regexp
+}
+
+// newExclusions compiles the criteria's Exclude patterns, defaults are the server's default path exclusions which the
+// criteria can turn off
+func newExclusions(criteria *SearchCriteria, defaults *regexp.Regexp) (exclusions, error) {
+	var e exclusions
+	var err error
+	for _, pattern := range []struct {
+		compiled **regexp.Regexp
+		value    string
+	}{
+		{&e.projects, criteria.ExcludeProjectNamePattern},
+		{&e.repositories, criteria.ExcludeRepositoryNamePattern},
+		{&e.paths, criteria.ExcludeFileNamePattern},
+		{&e.content, criteria.ExcludeContentPattern},
+	} {
+		if *pattern.compiled, err = compileOptional(pattern.value); err != nil {
+			return exclusions{}, err
+		}
+	}
+	if !criteria.DisableDefaultExclusions {
+		e.defaults = defaults
+	}
+	return e, nil
+}
+
+// compileOptional compiles pattern, an empty pattern compiles to nil
+func compileOptional(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func matches(pattern *regexp.Regexp, value string) bool {
+	return pattern != nil && pattern.MatchString(value)
+}
+
+func (e exclusions) project(name string) bool {
+	return matches(e.projects, name)
+}
+
+func (e exclusions) repository(name string) bool {
+	return matches(e.repositories, name)
+}
+
+// path reports whether the file is excluded by the criteria or by the default exclusions
+func (e exclusions) path(path string) bool {
+	return matches(e.paths, path) || matches(e.defaults, path)
+}
+
+// line reports whether the matches on the line are excluded
+func (e exclusions) line(line string) bool {
+	return matches(e.content, line)
+}
+
+// validateExclusions checks every Exclude pattern compiles
+func (c *SearchCriteria) validateExclusions() error {
+	for _, pattern := range []struct {
+		name  string
+		value string
+	}{
+		{"ExcludeProjectNamePattern", c.ExcludeProjectNamePattern},
+		{"ExcludeRepositoryNamePattern", c.ExcludeRepositoryNamePattern},
+		{"ExcludeFileNamePattern", c.ExcludeFileNamePattern},
+		{"ExcludeContentPattern", c.ExcludeContentPattern},
+	} {
+		if _, err := compileOptional(pattern.value); err != nil {
+			return fmt.Errorf("%s isn't a valid pattern: %w", pattern.name, err)
+		}
+	}
+	return nil
+}
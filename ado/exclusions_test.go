@@ -0,0 +1,115 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"regexp"
+	"testing"
+)
+
+func TestDefaultExcludedPaths(t *testing.T) {
+	excluded := regexp.MustCompile(defaultExcludedPaths)
+	for _, path := range []string{
+		"/node_modules/left-pad/index.js",
+		"/src/web/node_modules/x/config.json",
+		"/vendor/github.com/pkg/errors/errors.go",
+		"/package-lock.json",
+		"/api/go.sum",
+		"/yarn.lock",
+		"/src/App/bin/Debug/appsettings.json",
+		"/static/app.min.js",
+	} {
+		assert.True(t, excluded.MatchString(path), path)
+	}
+	for _, path := range []string{
+		"/src/vendors.go",
+		"/package.json",
+		"/go.mod",
+		"/docs/binary.md",
+		"/static/app.js",
+	} {
+		assert.False(t, excluded.MatchString(path), path)
+	}
+}
+
+func TestScanWithExclusions(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(3, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, mock.Anything).Return(getRepositoryTestData(2), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(getItemsWithPaths("/File.txt", "/node_modules/File.js", "/docs/File.md"), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(getItemContentTestData(), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.defaultExclusions = regexp.MustCompile(defaultExcludedPaths)
+	scanProjects.criteria.ExcludeProjectNamePattern = "^Project[12]$"
+	scanProjects.criteria.ExcludeRepositoryNamePattern = "^Repo1$"
+	scanProjects.criteria.ExcludeFileNamePattern = `\.md$`
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.Len(t, *results.Projects, 1)
+	project := (*results.Projects)[0]
+	assert.Equal(t, "Project0", project.Name)
+	assert.Len(t, *project.Repositories, 1)
+	repository := (*project.Repositories)[0]
+	assert.Equal(t, "Repo0", repository.Name)
+	assert.Len(t, *repository.Files, 1)
+	assert.Equal(t, "/File.txt", (*repository.Files)[0].Name)
+	mockConnection.AssertNotCalled(t, GetRepositoriesFuncName, mock.Anything, "Project1")
+	mockConnection.AssertNotCalled(t, GetItemsFuncName, mock.Anything, "Project0", "Repo1", mock.Anything)
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, 1)
+}
+
+func TestScanWithDefaultExclusionsDisabled(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(getItemsWithPaths("/File.txt", "/node_modules/File.js"), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return getItemContentTestData()
+		}, nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.defaultExclusions = regexp.MustCompile(defaultExcludedPaths)
+	scanProjects.criteria.DisableDefaultExclusions = true
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.Len(t, *(*(*results.Projects)[0].Repositories)[0].Files, 2)
+}
+
+func TestScanWithExcludedContent(t *testing.T) {
+	results := scanFileWithBaseline(t, "Content To Test\nContent = \"example\"\nContent", SearchCriteria{ExcludeContentPattern: "example"})
+	assert.Equal(t, []int{1, 3}, matchedLineNumbers(results))
+}
+
+func TestPostValidatesExclusions(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"ExcludeProjectNamePattern":"("}`, "ExcludeProjectNamePattern isn't a valid pattern: error parsing regexp: missing closing ): `(`"},
+		{`{"ExcludeRepositoryNamePattern":"["}`, "ExcludeRepositoryNamePattern isn't a valid pattern: error parsing regexp: missing closing ]: `[`"},
+		{`{"ExcludeFileNamePattern":"*"}`, "ExcludeFileNamePattern isn't a valid pattern: error parsing regexp: missing argument to repetition operator: `*`"},
+		{`{"ExcludeContentPattern":"a{2,1}"}`, "ExcludeContentPattern isn't a valid pattern: error parsing regexp: invalid repeat count: `{2,1}`"},
+		{`{"ContentPattern":"password","ExcludeFileNamePattern":"^/test/","ExcludeContentPattern":"example"}`, ""},
+	})
+}
+
+func TestCacheKeyChangesWithTheDefaultExclusions(t *testing.T) {
+	criteria := &SearchCriteria{ContentPattern: "password"}
+	defaults := regexp.MustCompile(defaultExcludedPaths)
+	without, _ := cacheKey("itsals", "123", criteria, nil, nil)
+	with, _ := cacheKey("itsals", "123", criteria, nil, defaults)
+	other, _ := cacheKey("itsals", "123", criteria, nil, regexp.MustCompile(`(^|/)vendor/`))
+	assert.NotEqual(t, without, with)
+	assert.NotEqual(t, with, other)
+
+	criteria.DisableDefaultExclusions = true
+	disabled, _ := cacheKey("itsals", "123", criteria, nil, defaults)
+	disabledElsewhere, _ := cacheKey("itsals", "123", criteria, nil, regexp.MustCompile(`(^|/)vendor/`))
+	assert.Equal(t, disabled, disabledElsewhere)
+}
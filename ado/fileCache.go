@@ -0,0 +1,248 @@
+package ado
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileCacheHeaderSize is the expiry, in unix nanoseconds, written ahead of every value with zero meaning no expiry
+const fileCacheHeaderSize = 8
+
+// fileCacheSweepInterval is how often Set looks through the directory for expired files, keys that are never read
+// again would otherwise stay on disk for good
+var fileCacheSweepInterval = 10 * time.Minute
+
+// FileCache implements Cache with one file per key in a directory, it survives restarts without needing redis. A
+// bounded FileCache removes the least recently used files once they add up to more than maxBytes, size is what this
+// process knows the files to add up to, with -1 meaning they haven't been counted yet. swept is when expired files
+// were last removed
+type FileCache struct {
+	directory string
+	now       func() time.Time
+	maxBytes  int64
+	mutex     sync.Mutex
+	size      int64
+	swept     time.Time
+}
+
+// NewFileCache creates a FileCache in directory, creating the directory when it does not exist
+func NewFileCache(directory string) (*FileCache, error) {
+	return NewBoundedFileCache(directory, 0)
+}
+
+// NewBoundedFileCache creates a FileCache in directory that holds up to maxBytes of files, zero leaves it unbounded
+func NewBoundedFileCache(directory string, maxBytes int64) (*FileCache, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCache{directory: directory, now: time.Now, maxBytes: maxBytes, size: -1, swept: time.Now()}, nil
+}
+
+// path hashes the key so any key maps to a safe file name
+func (cache *FileCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.directory, hex.EncodeToString(sum[:]))
+}
+
+// Get returns the value stored in the key's file, a bounded cache marks the file as recently used
+func (cache *FileCache) Get(key string) ([]byte, error) {
+	_, value, err := cache.read(key)
+	if err == nil && cache.maxBytes > 0 {
+		now := cache.now()
+		_ = os.Chtimes(cache.path(key), now, now)
+	}
+	return value, err
+}
+
+// Set writes the value to a temporary file and renames it over the key's file so readers never see a partial value, a
+// bounded cache rejects a value larger than all of it after removing what the key held
+func (cache *FileCache) Set(key string, value []byte, ttl time.Duration) error {
+	cache.sweep()
+
+	content := make([]byte, fileCacheHeaderSize+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(content, uint64(cache.now().Add(ttl).UnixNano()))
+	}
+	copy(content[fileCacheHeaderSize:], value)
+	if cache.maxBytes > 0 && int64(len(content)) > cache.maxBytes {
+		if err := cache.Delete(key); err != nil {
+			return err
+		}
+		return ErrCacheValueTooLarge
+	}
+	replaced := cache.fileSize(key)
+
+	file, err := ioutil.TempFile(cache.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), cache.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if cache.maxBytes > 0 {
+		now := cache.now()
+		_ = os.Chtimes(cache.path(key), now, now)
+		return cache.grow(int64(len(content)) - replaced)
+	}
+	return nil
+}
+
+// Delete removes the key's file
+func (cache *FileCache) Delete(key string) error {
+	removed := cache.fileSize(key)
+	err := os.Remove(cache.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil && cache.maxBytes > 0 {
+		return cache.grow(-removed)
+	}
+	return err
+}
+
+// fileSize returns the size of the key's file or zero when there is none, it is only looked up for a bounded cache
+func (cache *FileCache) fileSize(key string) int64 {
+	if cache.maxBytes == 0 {
+		return 0
+	}
+	info, err := os.Stat(cache.path(key))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// grow adds delta to the size of the files and removes the least recently used ones, by modification time, while they
+// add up to more than maxBytes. The files are counted afresh the first time and whenever some have to be removed, as
+// other processes sharing the directory change it too
+func (cache *FileCache) grow(delta int64) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size >= 0 {
+		cache.size += delta
+		if cache.size <= cache.maxBytes {
+			return nil
+		}
+	}
+
+	files, err := ioutil.ReadDir(cache.directory)
+	if err != nil {
+		return err
+	}
+	cache.size = 0
+	var stored []os.FileInfo
+	for _, file := range files {
+		if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".tmp-") {
+			stored = append(stored, file)
+			cache.size += file.Size()
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ModTime().Before(stored[j].ModTime()) })
+	for _, file := range stored {
+		if cache.size <= cache.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(cache.directory, file.Name())); err == nil || os.IsNotExist(err) {
+			cache.size -= file.Size()
+		}
+	}
+	return nil
+}
+
+// sweep removes the expired files once fileCacheSweepInterval has passed since it last did, a bounded cache counts its
+// files afresh afterwards
+func (cache *FileCache) sweep() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := cache.now()
+	if now.Sub(cache.swept) < fileCacheSweepInterval {
+		return
+	}
+	cache.swept = now
+
+	files, err := ioutil.ReadDir(cache.directory)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".tmp-") {
+			continue
+		}
+		path := filepath.Join(cache.directory, file.Name())
+		if expires, ok := readExpiry(path); ok && !now.Before(expires) {
+			_ = os.Remove(path)
+			cache.size = -1
+		}
+	}
+}
+
+// readExpiry reads the expiry from the header of the file, it reports false for a file that never expires or can't be
+// read
+func readExpiry(path string) (time.Time, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer file.Close()
+
+	header := make([]byte, fileCacheHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return time.Time{}, false
+	}
+	nanos := binary.BigEndian.Uint64(header)
+	if nanos == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(nanos)), true
+}
+
+// TTL returns the time left before the key expires
+func (cache *FileCache) TTL(key string) (time.Duration, error) {
+	expires, _, err := cache.read(key)
+	if err != nil {
+		return 0, err
+	}
+	if expires.IsZero() {
+		return 0, nil
+	}
+	return expires.Sub(cache.now()), nil
+}
+
+// read returns the expiry and value of the key, an expired file is removed and reported as a miss
+func (cache *FileCache) read(key string) (time.Time, []byte, error) {
+	content, err := ioutil.ReadFile(cache.path(key))
+	if os.IsNotExist(err) || (err == nil && len(content) < fileCacheHeaderSize) {
+		return time.Time{}, nil, ErrCacheMiss
+	}
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	var expires time.Time
+	if nanos := binary.BigEndian.Uint64(content); nanos != 0 {
+		expires = time.Unix(0, int64(nanos))
+		if !cache.now().Before(expires) {
+			_ = cache.Delete(key)
+			return time.Time{}, nil, ErrCacheMiss
+		}
+	}
+	return expires, content[fileCacheHeaderSize:], nil
+}
@@ -0,0 +1,301 @@
+package ado
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// changedFile is a file changed by a commit, sourcePath is where a renamed file was moved from
+type changedFile struct {
+	path       string
+	sourcePath string
+	changeType string
+}
+
+// added reports whether the file is new in the commit, an edited file only has the lines the commit added scanned
+func (c changedFile) added() bool {
+	return strings.Contains(c.changeType, "add") && !strings.Contains(c.changeType, "delete")
+}
+
+func (c changedFile) edited() bool {
+	return strings.Contains(c.changeType, "edit") && !strings.Contains(c.changeType, "delete")
+}
+
+// changedFiles decodes the blobs a commit added or edited, the client leaves each change undecoded so they are read
+// back through JSON
+func changedFiles(changes *git.GitCommitChanges) ([]changedFile, error) {
+	if changes == nil || changes.Changes == nil {
+		return nil, nil
+	}
+	value, err := json.Marshal(changes.Changes)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []struct {
+		ChangeType       string `json:"changeType"`
+		SourceServerItem string `json:"sourceServerItem"`
+		Item             struct {
+			Path          string `json:"path"`
+			GitObjectType string `json:"gitObjectType"`
+		} `json:"item"`
+	}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return nil, err
+	}
+
+	var files []changedFile
+	for _, change := range decoded {
+		file := changedFile{path: change.Item.Path, sourcePath: change.SourceServerItem, changeType: change.ChangeType}
+		if change.Item.GitObjectType == string(git.GitObjectTypeValues.Blob) && (file.added() || file.edited()) {
+			if file.sourcePath == "" {
+				file.sourcePath = file.path
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// historyQuery is the commits query for the walk of the version, a nil descriptor walks the default branch
+func (h *History) historyQuery(version *git.GitVersionDescriptor) git.GitQueryCommitsCriteria {
+	query := git.GitQueryCommitsCriteria{ItemVersion: version}
+	if h.Since != nil {
+		since := h.Since.UTC().Format(time.RFC3339)
+		query.FromDate = &since
+	}
+	if h.Until != nil {
+		until := h.Until.UTC().Format(time.RFC3339)
+		query.ToDate = &until
+	}
+	if h.MaxCommits > 0 {
+		query.Top = &h.MaxCommits
+	}
+	return query
+}
+
+// findHistory walks the commits of the version and returns an item for every file a commit added matching lines to,
+// the commits are walked one at a time and the files each one changed are scanned concurrently
+func (s *ScanProjects) findHistory(projectName string, repository Repository, version scanVersion) []Item {
+	commits, err := s.adoService.GetCommits(s.ctx, projectName, repository.Name, s.criteria.History.historyQuery(version.descriptor))
+	if err != nil {
+		if !emptyRepository(err) && !s.skipMissingCommit(projectName, repository.Name, err) {
+			s.errors.add(OperationGetCommits, projectName, repository.Name, "", err)
+		}
+		return nil
+	}
+
+	head := &headFiles{scan: s, projectName: projectName, repoName: repository.Name, version: version.descriptor}
+	var items []Item
+	for _, commit := range *commits {
+		if s.cancelled() {
+			break
+		}
+		if commit.Parents != nil && len(*commit.Parents) > 1 {
+			continue
+		}
+		items = append(items, s.findContentInCommit(projectName, repository, commit, head)...)
+	}
+	return items
+}
+
+func (s *ScanProjects) findContentInCommit(projectName string, repository Repository, commit git.GitCommitRef, head *headFiles) []Item {
+	changes, err := s.adoService.GetChanges(s.ctx, projectName, repository.Name, *commit.CommitId)
+	if err == nil {
+		var files []changedFile
+		files, err = changedFiles(changes)
+		if err == nil {
+			return s.findContentInChanges(projectName, repository, commit, files, head)
+		}
+	}
+	s.errors.add(OperationGetChanges, projectName, repository.Name, "", err)
+	return nil
+}
+
+func (s *ScanProjects) findContentInChanges(projectName string, repository Repository, commit git.GitCommitRef, files []changedFile, head *headFiles) []Item {
+	ch := make(chan Item, len(files))
+	wg := sync.WaitGroup{}
+	items := make([]Item, 0, len(files))
+
+	for _, file := range files {
+		if s.patterns.files.MatchString(file.path) && !s.exclusions.path(file.path) {
+			if !s.limits.files.acquire(s.ctx) {
+				break
+			}
+			atomic.AddInt64(&s.progress.FilesTotal, 1)
+			wg.Add(1)
+			go s.findContentInChange(projectName, repository, commit, file, head, ch, &wg)
+		}
+	}
+	wg.Wait()
+	close(ch)
+
+	for item := range ch {
+		items = append(items, item)
+	}
+	return items
+}
+
+// findContentInChange scans the lines the commit added to the file, an edited file is compared with its content in
+// the commit's parent to tell which lines those are
+func (s *ScanProjects) findContentInChange(projectName string, repository Repository, commit git.GitCommitRef, file changedFile, head *headFiles, item chan Item, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+	defer s.limits.files.release()
+	defer atomic.AddInt64(&s.progress.FilesScanned, 1)
+
+	content, err := s.readItemContent(projectName, repository.Name, file.path, commitVersion("", *commit.CommitId).descriptor)
+	if err != nil {
+		s.errors.add(OperationGetItemContent, projectName, repository.Name, file.path, err)
+		return
+	}
+
+	history := &historyFile{head: head}
+	if !file.added() && commit.Parents != nil && len(*commit.Parents) == 1 {
+		parent, err := s.readItemContent(projectName, repository.Name, file.sourcePath, commitVersion("", (*commit.Parents)[0]).descriptor)
+		if err != nil {
+			s.errors.add(OperationGetItemContent, projectName, repository.Name, file.sourcePath, err)
+			return
+		}
+		history.addedLines = addedLines(parent, content)
+	}
+
+	lines, operation, err := s.processFile(projectName, repository.Name, file.path, bytes.NewReader(content), history)
+	if err != nil {
+		s.errors.add(operation, projectName, repository.Name, file.path, err)
+	}
+
+	if len(lines) > 0 {
+		found := Item{
+			Name:   file.path,
+			Commit: newCommit(commit),
+			Lines:  &lines,
+		}
+		if s.onItem != nil {
+			s.onItem(projectName, repository, found)
+		}
+		item <- found
+	}
+}
+
+func (s *ScanProjects) readItemContent(projectName, repoName, path string, version *git.GitVersionDescriptor) ([]byte, error) {
+	file, err := s.adoService.GetItemContent(s.ctx, projectName, repoName, path, version)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func newCommit(commit git.GitCommitRef) *Commit {
+	found := &Commit{ID: *commit.CommitId}
+	if author := commit.Author; author != nil {
+		if author.Name != nil {
+			found.Author = *author.Name
+		}
+		if author.Email != nil {
+			found.Email = *author.Email
+		}
+		if author.Date != nil {
+			found.Date = author.Date.Time
+		}
+	}
+	return found
+}
+
+// addedLines returns the numbers of the lines in content that aren't in parent, lines are compared as a multiset so a
+// line that only moved isn't counted as added
+func addedLines(parent, content []byte) map[int]bool {
+	remaining := make(map[string]int)
+	for _, line := range splitLines(parent) {
+		remaining[line]++
+	}
+	added := make(map[int]bool)
+	for i, line := range splitLines(content) {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		added[i+1] = true
+	}
+	return added
+}
+
+// splitLines splits content the same way processFile reads it so line numbers agree
+func splitLines(content []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// historyFile narrows processFile to the lines a commit added, a nil addedLines means the commit added the whole file,
+// and checks whether what they matched is still at head
+type historyFile struct {
+	addedLines map[int]bool
+	head       *headFiles
+}
+
+func (h *historyFile) added(lineNumber int) bool {
+	return h.addedLines == nil || h.addedLines[lineNumber]
+}
+
+// headFiles reads the files at the scanned version of a repository the first time a match in their history is checked
+// against them, every commit of the walk shares it
+type headFiles struct {
+	scan        *ScanProjects
+	projectName string
+	repoName    string
+	version     *git.GitVersionDescriptor
+	mutex       sync.Mutex
+	files       map[string]*headFile
+}
+
+// headFile is a file at the scanned version, known is false when it couldn't be read and found is false when the file
+// is no longer there
+type headFile struct {
+	once    sync.Once
+	known   bool
+	found   bool
+	content string
+}
+
+// contains reports whether text is in the file at path at the scanned version, or nil when that couldn't be told
+func (h *headFiles) contains(path, text string) *bool {
+	h.mutex.Lock()
+	if h.files == nil {
+		h.files = make(map[string]*headFile)
+	}
+	file, ok := h.files[path]
+	if !ok {
+		file = new(headFile)
+		h.files[path] = file
+	}
+	h.mutex.Unlock()
+
+	file.once.Do(func() {
+		content, err := h.scan.readItemContent(h.projectName, h.repoName, path, h.version)
+		switch {
+		case err == nil:
+			file.known, file.found, file.content = true, true, string(content)
+		case statusCode(err) == http.StatusNotFound:
+			file.known = true
+		default:
+			h.scan.errors.add(OperationGetItemContent, h.projectName, h.repoName, path, err)
+		}
+	})
+	if !file.known {
+		return nil
+	}
+	atHead := file.found && strings.Contains(file.content, text)
+	return &atHead
+}
@@ -0,0 +1,243 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testFirstCommit  = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testSecondCommit = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	testMergeCommit  = "cccccccccccccccccccccccccccccccccccccccc"
+)
+
+func testCommit(id, author string, date time.Time, parents ...string) git.GitCommitRef {
+	email := strings.ToLower(author) + "@example.com"
+	return git.GitCommitRef{
+		CommitId: &id,
+		Parents:  &parents,
+		Author:   &git.GitUserDate{Name: &author, Email: &email, Date: &azuredevops.Time{Time: date}},
+	}
+}
+
+func testChanges(changes ...map[string]interface{}) *git.GitCommitChanges {
+	values := make([]interface{}, 0, len(changes))
+	for _, change := range changes {
+		values = append(values, change)
+	}
+	return &git.GitCommitChanges{Changes: &values}
+}
+
+func testChange(changeType, path string) map[string]interface{} {
+	return map[string]interface{}{
+		"changeType": changeType,
+		"item":       map[string]interface{}{"path": path, "gitObjectType": "blob"},
+	}
+}
+
+// historyConnection serves a repository where the first commit added a password, the second replaced it and a merge
+// came after them, contents are keyed by path and commit with "head" for the default branch
+func historyConnection(contents map[string]string) *mocks.Service {
+	first := time.Date(2020, 3, 1, 9, 0, 0, 0, time.UTC)
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetCommitsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(&[]git.GitCommitRef{
+		testCommit(testMergeCommit, "Carol", first.Add(48*time.Hour), testSecondCommit, "dddddddddddddddddddddddddddddddddddddddd"),
+		testCommit(testSecondCommit, "Bob", first.Add(24*time.Hour), testFirstCommit),
+		testCommit(testFirstCommit, "Alice", first),
+	}, nil)
+	mockConnection.On(GetChangesFuncName, mock.Anything, "Project0", "Repo0", testFirstCommit).
+		Return(testChanges(testChange("add", "/config.yml"), testChange("add", "/README.md")), nil)
+	mockConnection.On(GetChangesFuncName, mock.Anything, "Project0", "Repo0", testSecondCommit).
+		Return(testChanges(testChange("edit", "/config.yml")), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", mock.Anything, mock.Anything).
+		Return(func(_ context.Context, _, _, path string, version *git.GitVersionDescriptor) io.ReadCloser {
+			key := path + "@head"
+			if version != nil {
+				key = path + "@" + *version.Version
+			}
+			return ioutil.NopCloser(strings.NewReader(contents[key]))
+		}, func(_ context.Context, _, _, path string, version *git.GitVersionDescriptor) error {
+			key := path + "@head"
+			if version != nil {
+				key = path + "@" + *version.Version
+			}
+			if _, ok := contents[key]; !ok {
+				status, message := http.StatusNotFound, "TF401174: The item could not be found"
+				return &azuredevops.WrappedError{StatusCode: &status, Message: &message}
+			}
+			return nil
+		})
+	return mockConnection
+}
+
+func scanHistory(t *testing.T, mockConnection Service, history *History) *Results {
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.FileNamePattern = "yml"
+	scanProjects.criteria.ContentPattern = `password: \w+`
+	scanProjects.criteria.History = history
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+	return results
+}
+
+func TestScanHistoryReportsAddedLinesWithTheirCommit(t *testing.T) {
+	mockConnection := historyConnection(map[string]string{
+		"/config.yml@" + testFirstCommit:  "name: app\npassword: hunter2\n",
+		"/config.yml@" + testSecondCommit: "name: app\npassword: rotated\n",
+		"/config.yml@head":                "name: app\npassword: rotated\n",
+	})
+	results := scanHistory(t, mockConnection, &History{})
+
+	assert.False(t, results.Incomplete, results.Errors)
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "/config.yml", files[0].Name)
+		assert.Equal(t, &Commit{ID: testSecondCommit, Author: "Bob", Email: "bob@example.com", Date: time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC)}, files[0].Commit)
+		assert.Equal(t, "password: rotated", (*files[0].Lines)[0].Text)
+		assert.True(t, *(*(*files[0].Lines)[0].Ranges)[0].AtHead)
+
+		assert.Equal(t, testFirstCommit, files[1].Commit.ID)
+		assert.Equal(t, "Alice", files[1].Commit.Author)
+		assert.Equal(t, 2, (*files[1].Lines)[0].Number)
+		assert.Equal(t, "password: hunter2", (*files[1].Lines)[0].Text)
+		assert.False(t, *(*(*files[1].Lines)[0].Ranges)[0].AtHead)
+	}
+	mockConnection.AssertNotCalled(t, GetChangesFuncName, mock.Anything, mock.Anything, mock.Anything, testMergeCommit)
+	mockConnection.AssertNotCalled(t, GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	// the head of the file is only read once for every match found in its history
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, 4)
+}
+
+func TestScanHistoryOnlyReportsTheLinesACommitAdded(t *testing.T) {
+	mockConnection := historyConnection(map[string]string{
+		"/config.yml@" + testFirstCommit:  "password: hunter2\n",
+		"/config.yml@" + testSecondCommit: "name: app\npassword: hunter2\n",
+	})
+	results := scanHistory(t, mockConnection, &History{})
+
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, testFirstCommit, files[0].Commit.ID)
+		assert.Equal(t, 1, (*files[0].Lines)[0].Number)
+	}
+}
+
+func TestScanHistoryReportsMatchesRemovedWithTheirFile(t *testing.T) {
+	mockConnection := historyConnection(map[string]string{
+		"/config.yml@" + testFirstCommit:  "password: hunter2\n",
+		"/config.yml@" + testSecondCommit: "password: hunter2\nname: app\n",
+	})
+	results := scanHistory(t, mockConnection, &History{})
+
+	assert.False(t, results.Incomplete, results.Errors)
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	if assert.Len(t, files, 1) {
+		assert.False(t, *(*(*files[0].Lines)[0].Ranges)[0].AtHead)
+	}
+}
+
+func TestScanHistoryReportsCommitsThatCantBeListed(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(2), nil, nil)
+	mockConnection.On(GetCommitsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(nil, errors.New("connection reset"))
+	mockConnection.On(GetCommitsFuncName, mock.Anything, "Project0", "Repo1", mock.Anything).Return(nil, errors.New("Cannot find any branches for the Repo1 repository."))
+	results := scanHistory(t, mockConnection, &History{})
+
+	assert.True(t, results.Incomplete)
+	assert.Equal(t, []ScanError{{Project: "Project0", Repository: "Repo0", Operation: OperationGetCommits, Message: "connection reset"}}, *results.Errors)
+}
+
+func TestHistoryQuery(t *testing.T) {
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	until := time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC)
+	version := commitVersion("", testMainCommit).descriptor
+	query := (&History{Since: &since, Until: &until, MaxCommits: 50}).historyQuery(version)
+
+	assert.Equal(t, "2019-12-31T23:00:00Z", *query.FromDate)
+	assert.Equal(t, "2020-06-30T00:00:00Z", *query.ToDate)
+	assert.Equal(t, 50, *query.Top)
+	assert.Equal(t, version, query.ItemVersion)
+
+	query = new(History).historyQuery(nil)
+	assert.Equal(t, git.GitQueryCommitsCriteria{}, query)
+}
+
+func TestChangedFiles(t *testing.T) {
+	tree := testChange("add", "/src")
+	tree["item"].(map[string]interface{})["gitObjectType"] = "tree"
+	renamed := testChange("edit, rename", "/new.yml")
+	renamed["sourceServerItem"] = "/old.yml"
+
+	files, err := changedFiles(testChanges(
+		testChange("add", "/added.yml"),
+		testChange("edit", "/edited.yml"),
+		testChange("delete", "/deleted.yml"),
+		testChange("rename", "/moved.yml"),
+		renamed,
+		tree,
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, []changedFile{
+		{path: "/added.yml", sourcePath: "/added.yml", changeType: "add"},
+		{path: "/edited.yml", sourcePath: "/edited.yml", changeType: "edit"},
+		{path: "/new.yml", sourcePath: "/old.yml", changeType: "edit, rename"},
+	}, files)
+}
+
+func TestAddedLines(t *testing.T) {
+	parent := []byte("a\nb\nb\nc\n")
+	assert.Equal(t, map[int]bool{}, addedLines(parent, []byte("c\nb\na\n")))
+	assert.Equal(t, map[int]bool{2: true, 5: true}, addedLines(parent, []byte("a\nx\nb\nb\nb\nc")))
+	assert.Equal(t, map[int]bool{1: true, 2: true}, addedLines(nil, []byte("a\r\nb\r\n")))
+}
+
+func TestPostValidatesHistory(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"History":{"MaxCommits":-1}}`, "History.MaxCommits can't be negative"},
+		{`{"History":{"Since":"2020-06-01T00:00:00Z","Until":"2020-01-01T00:00:00Z"}}`, "History.Since must be before History.Until"},
+		{`{"ContentPattern":"password","History":{"MaxCommits":10,"Since":"2020-01-01T00:00:00Z","Until":"2020-06-01T00:00:00Z"}}`, ""},
+	})
+}
+
+func TestGetCommitsAndChangesArePaged(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	server.commits = 2*commitPageSize + 10
+	server.changes = changePageSize + 1
+	service, err := NewAzureDevOpsService(server.URL+server.collection, "123", nil, nil)
+	assert.Nil(t, err)
+
+	top := commitPageSize + 50
+	commits, err := service.GetCommits(context.Background(), "Project0", "Repo", git.GitQueryCommitsCriteria{Top: &top})
+	assert.Nil(t, err)
+	assert.Len(t, *commits, commitPageSize+50)
+
+	commits, err = service.GetCommits(context.Background(), "Project0", "Repo", git.GitQueryCommitsCriteria{})
+	assert.Nil(t, err)
+	assert.Len(t, *commits, 2*commitPageSize+10)
+
+	changes, err := service.GetChanges(context.Background(), "Project0", "Repo", *(*commits)[0].CommitId)
+	assert.Nil(t, err)
+	files, err := changedFiles(changes)
+	assert.Nil(t, err)
+	assert.Len(t, files, changePageSize+1)
+
+	assert.Equal(t, []string{
+		"commits 0+100", "commits 100+50",
+		"commits 0+100", "commits 100+100", "commits 200+100",
+		"changes 0+1000", "changes 1000+1000",
+	}, server.pages)
+}
@@ -0,0 +1,319 @@
+package ado
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// incrementalStateVersion is bumped whenever the shape of the stored state changes so old state is never read back
+const incrementalStateVersion = "v1"
+
+// incrementalStateTTL is how long the state of a repository is kept after the last scan that stored it, long enough
+// for a nightly scan to miss a few nights
+const incrementalStateTTL = 7 * 24 * time.Hour
+
+// errIncompleteDiff is returned when the diff between two commits can't be relied on to list every file that changed
+var errIncompleteDiff = errors.New("the diff doesn't list every changed file")
+
+// repositoryState is what an incremental scan remembers of a version of a repository, the commit it was scanned at and
+// every match found in each file before the baseline was applied. Files without matches are left out
+type repositoryState struct {
+	Commit string
+	Files  map[string][]Line
+}
+
+// incrementalState keeps the repositoryState of every version an incremental scan reads in the Cache, under keys
+// partitioned like cached results so state is only shared between scans that would find the same matches. While a
+// version is scanned the matches of each file are recorded so the state can be stored once the version is done
+type incrementalState struct {
+	cache  Cache
+	prefix string
+
+	mutex     sync.Mutex
+	recording map[string]map[string][]Line
+}
+
+// newIncrementalState creates the state of an incremental scan, it fails when the criteria can't be turned into a key.
+// The baseline and the versions to scan are left out of the key as the baseline is applied to the stored matches every
+// time they are merged and each version is stored under a key of its own. The fingerprint key is included as the stored
+// fingerprints were made with it
+func newIncrementalState(cache Cache, org, personalAccessToken string, criteria *SearchCriteria, packs rulePacks, defaultExclusions *regexp.Regexp, fingerprintKey []byte) (*incrementalState, error) {
+	normalized := *criteria
+	normalized.Baseline = nil
+	normalized.ExportBaseline = false
+	normalized.Branches = ""
+	normalized.Tags = nil
+	normalized.Commit = ""
+	key, err := cacheKey(org, personalAccessToken, &normalized, packs, defaultExclusions)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(key + "\x00" + string(fingerprintKey)))
+	return &incrementalState{
+		cache:     cache,
+		prefix:    fmt.Sprintf("incremental:%s:%s", incrementalStateVersion, hex.EncodeToString(sum[:])),
+		recording: make(map[string]map[string][]Line),
+	}, nil
+}
+
+// key returns the key the state of the version of the repository is stored under
+func (state *incrementalState) key(projectName string, repository Repository) string {
+	sum := sha256.Sum256([]byte(projectName + "\x00" + repository.Name + "\x00" + repository.Ref))
+	return state.prefix + ":" + hex.EncodeToString(sum[:])
+}
+
+// load returns the stored state of the version of the repository or nil when there is none, state that can't be read
+// is treated as missing so the version is scanned in full
+func (state *incrementalState) load(key string) *repositoryState {
+	value, err := state.cache.Get(key)
+	if err != nil {
+		if err != ErrCacheMiss {
+			log.Printf("unable to read the state of an incremental scan: %s", err)
+		}
+		return nil
+	}
+	stored := new(repositoryState)
+	if err := json.Unmarshal(value, stored); err != nil {
+		log.Printf("unable to decode the state of an incremental scan: %s", err)
+		return nil
+	}
+	return stored
+}
+
+// save stores the state of the version of the repository, failing to only costs the next scan a full read
+func (state *incrementalState) save(key string, stored repositoryState) {
+	value, err := json.Marshal(stored)
+	if err == nil {
+		err = state.cache.Set(key, value, incrementalStateTTL)
+	}
+	if err != nil {
+		log.Printf("unable to store the state of an incremental scan: %s", err)
+	}
+}
+
+// startRecording collects the matches record is called with for the version of the repository until stopRecording
+func (state *incrementalState) startRecording(key string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.recording[key] = make(map[string][]Line)
+}
+
+// stopRecording returns the matches recorded for the version of the repository, by path
+func (state *incrementalState) stopRecording(key string) map[string][]Line {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	files := state.recording[key]
+	delete(state.recording, key)
+	return files
+}
+
+// record keeps the matches found in the file when its version of the repository is being recorded
+func (state *incrementalState) record(projectName string, repository Repository, path string, lines []Line) {
+	key := state.key(projectName, repository)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if files, ok := state.recording[key]; ok && len(lines) > 0 {
+		files[path] = lines
+	}
+}
+
+// findItemsIncrementally scans the version of the repository reading only the files that changed since the commit its
+// stored state was scanned at, the matches of the other files are taken from the state. Without usable state, or when
+// the diff can't be listed, every file is read and the state stored for the next scan. State is only stored for
+// versions scanned without failures so a file that couldn't be read is never remembered as having no matches
+func (s *ScanProjects) findItemsIncrementally(projectName string, repository Repository, version scanVersion, archive bool) []Item {
+	commit := version.commit
+	if commit == "" {
+		resolved, err := s.headCommit(projectName, repository.Name, version.ref)
+		if err != nil {
+			return s.findItems(projectName, repository, version, archive)
+		}
+		commit = resolved
+	}
+	// Every file is read from the commit the state is stored for even when the ref moves during the scan
+	pinned := commitVersion(version.ref, commit)
+
+	key := s.state.key(projectName, repository)
+	failures := s.errors.countFor(projectName, repository.Name)
+	stored := s.state.load(key)
+	s.state.startRecording(key)
+
+	var items []Item
+	var kept map[string][]Line
+	switch {
+	case stored == nil:
+		items = s.findItems(projectName, repository, pinned, archive)
+	case stored.Commit == commit:
+		kept = stored.Files
+	default:
+		changed, removed, err := s.changedSince(projectName, repository.Name, stored.Commit, commit)
+		if err != nil {
+			log.Printf("Scanning every file of %s/%s as the changes since %s can't be listed: %s", projectName, repository.Name, stored.Commit, err)
+			items = s.findItems(projectName, repository, pinned, archive)
+			break
+		}
+		kept = make(map[string][]Line, len(stored.Files))
+		for path, lines := range stored.Files {
+			if !removed[path] {
+				kept[path] = lines
+			}
+		}
+		if len(changed) > 0 {
+			items = s.findContentInFile(repository, &projectName, pinned.descriptor, &changed, archive)
+		}
+	}
+
+	files := s.state.stopRecording(key)
+	paths := make([]string, 0, len(kept))
+	for path := range kept {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		files[path] = kept[path]
+		if found, ok := s.foundItem(projectName, repository, path, kept[path]); ok {
+			items = append(items, found)
+		}
+	}
+
+	if !s.cancelled() && s.errors.countFor(projectName, repository.Name) == failures {
+		s.state.save(key, repositoryState{Commit: commit, Files: files})
+	}
+	return items
+}
+
+// headCommit resolves the branch ref to the commit it points to
+func (s *ScanProjects) headCommit(projectName, repoName, ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("the repository has no default branch")
+	}
+	refs, err := s.adoService.GetRefs(s.ctx, projectName, repoName, strings.TrimPrefix(ref, "refs/"))
+	if err != nil {
+		return "", err
+	}
+	for _, found := range *refs {
+		if found.Name != nil && *found.Name == ref {
+			return refCommit(found), nil
+		}
+	}
+	return "", fmt.Errorf("%s wasn't found", ref)
+}
+
+// changedSince lists the blobs added or edited between the commits, to be scanned again, and the paths whose stored
+// matches no longer apply, which are the changed paths along with the deleted ones and those renamed away from
+func (s *ScanProjects) changedSince(projectName, repoName, baseCommit, targetCommit string) ([]git.GitItem, map[string]bool, error) {
+	diffs, err := s.adoService.GetCommitDiffs(s.ctx, projectName, repoName, baseCommit, targetCommit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if diffs.AllChangesIncluded != nil && !*diffs.AllChangesIncluded {
+		return nil, nil, errIncompleteDiff
+	}
+	changes, err := diffChanges(diffs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changed []git.GitItem
+	removed := make(map[string]bool)
+	for _, change := range changes {
+		removed[change.path] = true
+		if change.sourcePath != "" {
+			removed[change.sourcePath] = true
+		}
+		if !change.blob {
+			// A folder that was deleted or moved may not list the files in it
+			if change.deleted() || change.renamed() {
+				return nil, nil, errIncompleteDiff
+			}
+			continue
+		}
+		if !change.deleted() {
+			path, objectID := change.path, change.objectID
+			item := git.GitItem{Path: &path, GitObjectType: &git.GitObjectTypeValues.Blob}
+			if objectID != "" {
+				item.ObjectId = &objectID
+			}
+			changed = append(changed, item)
+		}
+	}
+	return changed, removed, nil
+}
+
+// diffChange is a path that differs between two commits, sourcePath is where a renamed path was moved from
+type diffChange struct {
+	path       string
+	sourcePath string
+	changeType string
+	objectID   string
+	blob       bool
+}
+
+func (c diffChange) deleted() bool {
+	return strings.Contains(c.changeType, "delete")
+}
+
+func (c diffChange) renamed() bool {
+	return strings.Contains(c.changeType, "rename")
+}
+
+// diffChanges decodes the changes of the diff, the client leaves each change undecoded so they are read back through
+// JSON
+func diffChanges(diffs *git.GitCommitDiffs) ([]diffChange, error) {
+	if diffs == nil || diffs.Changes == nil {
+		return nil, nil
+	}
+	value, err := json.Marshal(diffs.Changes)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []struct {
+		ChangeType       string `json:"changeType"`
+		SourceServerItem string `json:"sourceServerItem"`
+		Item             struct {
+			Path          string `json:"path"`
+			ObjectID      string `json:"objectId"`
+			GitObjectType string `json:"gitObjectType"`
+		} `json:"item"`
+	}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return nil, err
+	}
+
+	changes := make([]diffChange, 0, len(decoded))
+	for _, change := range decoded {
+		changes = append(changes, diffChange{
+			path:       change.Item.Path,
+			sourcePath: change.SourceServerItem,
+			changeType: change.ChangeType,
+			objectID:   change.Item.ObjectID,
+			blob:       change.Item.GitObjectType == string(git.GitObjectTypeValues.Blob),
+		})
+	}
+	return changes, nil
+}
+
+// validateIncremental checks incremental scans are only asked for where they can read fewer files, a history walk
+// already reads only what each commit changed and a paths scan reads no files at all
+func (c *SearchCriteria) validateIncremental() error {
+	switch {
+	case !c.Incremental:
+		return nil
+	case c.History != nil:
+		return fmt.Errorf("Incremental can't be used with History")
+	case c.pathsOnly():
+		return fmt.Errorf("Incremental can't be used in %q mode", ModePaths)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package ado
+
+import (
+	mocks "adoscanner/mocks/ado"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testFirstTree = map[string]string{
+	"/File0": "password=a\nunchanged",
+	"/File1": "nothing to see",
+	"/File2": "password=b",
+	"/File3": "password=c\npassword=d adoscanner:ignore",
+}
+
+// testSecondTree is testFirstTree after File1 was edited, File2 deleted, File3 moved to File4 and File5 and Other.txt
+// added, testDiff is the diff between them
+var testSecondTree = map[string]string{
+	"/File0":     "password=a\nunchanged",
+	"/File1":     "password=e\nnow with a match",
+	"/File4":     "password=c\npassword=d adoscanner:ignore",
+	"/File5":     "before\npassword=f",
+	"/Other.txt": "password=g",
+}
+
+var testDiff = []interface{}{
+	diffEntry("edit", "/File1", ""),
+	diffEntry("delete", "/File2", ""),
+	diffEntry("rename", "/File4", "/File3"),
+	diffEntry("add", "/File5", ""),
+	diffEntry("add", "/Other.txt", ""),
+	map[string]interface{}{"changeType": "edit", "item": map[string]interface{}{"path": "/", "gitObjectType": "tree"}},
+}
+
+func diffEntry(changeType, path, sourcePath string) map[string]interface{} {
+	change := map[string]interface{}{
+		"changeType": changeType,
+		"item":       map[string]interface{}{"path": path, "gitObjectType": "blob", "objectId": "blob" + path},
+	}
+	if sourcePath != "" {
+		change["sourceServerItem"] = sourcePath
+	}
+	return change
+}
+
+// mockDefaultBranch serves Repo0 of Project0 with its default branch at commit
+func mockDefaultBranch(mockConnection *mocks.Service, commit string) {
+	defaultBranch := "refs/heads/main"
+	repoName := "Repo0"
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").
+		Return(&[]git.GitRepository{{Name: &repoName, DefaultBranch: &defaultBranch}}, nil, nil)
+	mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", "heads/main").
+		Return(&[]git.GitRef{{Name: &defaultBranch, ObjectId: &commit}}, nil)
+}
+
+// incrementalTestService serves the tree as the default branch of Repo0, at commit
+func incrementalTestService(commit string, tree map[string]string) *mocks.Service {
+	mockConnection := new(mocks.Service)
+	mockDefaultBranch(mockConnection, commit)
+
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemsWithPaths(paths...), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", mock.Anything, mock.Anything).
+		Return(func(_ context.Context, _, _, path string, _ *git.GitVersionDescriptor) io.ReadCloser {
+			return ioutil.NopCloser(strings.NewReader(tree[path]))
+		}, nil)
+	return mockConnection
+}
+
+func incrementalCriteria(baseline ...string) *SearchCriteria {
+	return &SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "File", ContentPattern: "password=\\w",
+		ContextLines: 1, Baseline: baseline, ExportBaseline: true, Fetch: FetchItems, Incremental: true}
+}
+
+func scanIncrementally(t *testing.T, state Cache, service Service, criteria *SearchCriteria) *Results {
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogWarning", mock.Anything)
+	api := API{serviceFactory: staticServiceFactory{service: service}, logger: mockLogging, state: state}
+	results, err := api.scan(context.Background(), "https://dev.azure.com/itsals", "123", criteria, new(Progress), nil)
+	assert.Nil(t, err)
+	return results
+}
+
+// sortedJSON marshals the results with the files of every repository in order, the order they are found in isn't
+func sortedJSON(t *testing.T, results *Results) string {
+	for _, project := range *results.Projects {
+		for _, repository := range *project.Repositories {
+			files := *repository.Files
+			sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		}
+	}
+	value, err := json.Marshal(results)
+	assert.Nil(t, err)
+	return string(value)
+}
+
+func contentRequests(mockConnection *mocks.Service) []string {
+	var paths []string
+	for _, call := range mockConnection.Calls {
+		if call.Method == GetItemContentFuncName {
+			paths = append(paths, call.Arguments.String(3))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestIncrementalScanOnlyReadsChangedFiles(t *testing.T) {
+	state := NewMemoryCache(1 << 20)
+	first := scanIncrementally(t, state, incrementalTestService(testFirstCommit, testFirstTree), incrementalCriteria())
+	assert.ElementsMatch(t, []string{"/File0", "/File2", "/File3"}, matchedFiles(first))
+
+	// The match in File0 is accepted so the merged results have to go through the baseline too
+	var accepted string
+	for _, file := range *(*(*first.Projects)[0].Repositories)[0].Files {
+		if file.Name == "/File0" {
+			accepted = (*(*file.Lines)[0].Ranges)[0].Fingerprint
+		}
+	}
+	criteria := incrementalCriteria(accepted)
+
+	second := incrementalTestService(testSecondCommit, testSecondTree)
+	second.On(GetCommitDiffsFuncName, mock.Anything, "Project0", "Repo0", testFirstCommit, testSecondCommit).
+		Return(&git.GitCommitDiffs{Changes: &testDiff}, nil)
+	incremental := scanIncrementally(t, state, second, criteria)
+	second.AssertNotCalled(t, GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, []string{"/File1", "/File4", "/File5"}, contentRequests(second))
+
+	fullCriteria := incrementalCriteria(accepted)
+	fullCriteria.Incremental = false
+	full := scanIncrementally(t, nil, incrementalTestService(testSecondCommit, testSecondTree), fullCriteria)
+	assert.ElementsMatch(t, []string{"/File1", "/File4", "/File5"}, matchedFiles(full))
+	assert.Equal(t, sortedJSON(t, full), sortedJSON(t, incremental))
+
+	// Scanning the same commit again reads nothing
+	unchanged := incrementalTestService(testSecondCommit, testSecondTree)
+	again := scanIncrementally(t, state, unchanged, criteria)
+	assert.Empty(t, contentRequests(unchanged))
+	unchanged.AssertNotCalled(t, GetCommitDiffsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, sortedJSON(t, full), sortedJSON(t, again))
+}
+
+func TestIncrementalScanReadsEveryFileWhenTheDiffFails(t *testing.T) {
+	state := NewMemoryCache(1 << 20)
+	scanIncrementally(t, state, incrementalTestService(testFirstCommit, testFirstTree), incrementalCriteria())
+
+	second := incrementalTestService(testSecondCommit, testSecondTree)
+	second.On(GetCommitDiffsFuncName, mock.Anything, "Project0", "Repo0", testFirstCommit, testSecondCommit).
+		Return(nil, statusError(http.StatusNotFound))
+	results := scanIncrementally(t, state, second, incrementalCriteria())
+	assert.False(t, results.Incomplete)
+	assert.Equal(t, []string{"/File0", "/File1", "/File4", "/File5"}, contentRequests(second))
+	assert.Len(t, matchedFiles(results), 4)
+
+	// A folder that was moved can't be followed from the diff either
+	moved := incrementalTestService(testSecondCommit, testSecondTree)
+	moved.On(GetCommitDiffsFuncName, mock.Anything, "Project0", "Repo0", testFirstCommit, testSecondCommit).
+		Return(&git.GitCommitDiffs{Changes: &[]interface{}{
+			map[string]interface{}{"changeType": "rename", "item": map[string]interface{}{"path": "/src", "gitObjectType": "tree"}},
+		}}, nil)
+	_, removed, err := (&ScanProjects{ctx: context.Background(), adoService: moved}).changedSince("Project0", "Repo0", testFirstCommit, testSecondCommit)
+	assert.Equal(t, errIncompleteDiff, err)
+	assert.Nil(t, removed)
+}
+
+func TestIncrementalScanDoesNotRememberFailedScans(t *testing.T) {
+	state := NewMemoryCache(1 << 20)
+	failing := new(mocks.Service)
+	mockDefaultBranch(failing, testFirstCommit)
+	failing.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemsWithPaths("/File0", "/File2"), nil)
+	failing.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "/File0", mock.Anything).
+		Return(ioutil.NopCloser(strings.NewReader(testFirstTree["/File0"])), nil)
+	failing.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "/File2", mock.Anything).
+		Return(nil, errors.New("connection reset"))
+	results := scanIncrementally(t, state, failing, incrementalCriteria())
+	assert.True(t, results.Incomplete)
+
+	// The file that couldn't be read wasn't remembered as having no matches
+	retried := incrementalTestService(testFirstCommit, testFirstTree)
+	results = scanIncrementally(t, state, retried, incrementalCriteria())
+	retried.AssertCalled(t, GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything)
+	assert.ElementsMatch(t, []string{"/File0", "/File2", "/File3"}, matchedFiles(results))
+}
+
+func TestIncrementalScanWithoutStateScansEverything(t *testing.T) {
+	mockConnection := incrementalTestService(testFirstCommit, testFirstTree)
+	results := scanIncrementally(t, nil, mockConnection, incrementalCriteria())
+	mockConnection.AssertNotCalled(t, GetRefsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Len(t, matchedFiles(results), 3)
+}
+
+func TestPostValidatesIncremental(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"ContentPattern":"password","Incremental":true,"History":{}}`, "Incremental can't be used with History"},
+		{`{"FileNamePattern":"yml","Incremental":true}`, `Incremental can't be used in "paths" mode`},
+		{`{"ContentPattern":"password","Incremental":true}`, ""},
+	})
+}
+
+func TestCacheKeyIgnoresIncremental(t *testing.T) {
+	assertCacheKeys(t, []cacheKeyCase{
+		{"incremental", SearchCriteria{ContentPattern: "password"}, SearchCriteria{ContentPattern: "password", Incremental: true}, true},
+	})
+}
@@ -0,0 +1,148 @@
+package ado
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryCacheSweepInterval is how often a MemoryCache drops the expired entries nobody has looked up since
+const memoryCacheSweepInterval = time.Minute
+
+// MemoryCache implements Cache in process, it evicts the least recently used entries once the values it holds add up
+// to more than maxBytes. A maxBytes of zero or less never evicts anything
+type MemoryCache struct {
+	maxBytes  int64
+	size      int64
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	recent    *list.List
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (entry *memoryCacheEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+// NewMemoryCache creates a MemoryCache that holds up to maxBytes of values, zero leaves it unbounded
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		recent:   list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get returns a copy of the stored value
+func (cache *MemoryCache) Get(key string) ([]byte, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := cache.lookup(key)
+	if entry == nil {
+		return nil, ErrCacheMiss
+	}
+	value := make([]byte, len(entry.value))
+	copy(value, entry.value)
+	return value, nil
+}
+
+// Set stores a copy of the value, a value larger than the whole cache replaces nothing and is rejected
+func (cache *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	if cache.maxBytes > 0 && int64(len(value)) > cache.maxBytes {
+		return ErrCacheValueTooLarge
+	}
+	cache.sweep()
+
+	entry := &memoryCacheEntry{key: key, value: make([]byte, len(value))}
+	copy(entry.value, value)
+	if ttl > 0 {
+		entry.expires = cache.now().Add(ttl)
+	}
+	cache.entries[key] = cache.recent.PushFront(entry)
+	cache.size += int64(len(value))
+
+	for cache.maxBytes > 0 && cache.size > cache.maxBytes {
+		cache.remove(cache.recent.Back())
+	}
+	return nil
+}
+
+// sweep drops every expired entry once per memoryCacheSweepInterval so an unbounded cache doesn't keep them forever,
+// the caller must hold the mutex
+func (cache *MemoryCache) sweep() {
+	now := cache.now()
+	if now.Before(cache.nextSweep) {
+		return
+	}
+	cache.nextSweep = now.Add(memoryCacheSweepInterval)
+	for element := cache.recent.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*memoryCacheEntry).expired(now) {
+			cache.remove(element)
+		}
+		element = next
+	}
+}
+
+// Delete removes the key from the cache
+func (cache *MemoryCache) Delete(key string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	return nil
+}
+
+// TTL returns the time left before the key expires
+func (cache *MemoryCache) TTL(key string) (time.Duration, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := cache.lookup(key)
+	if entry == nil {
+		return 0, ErrCacheMiss
+	}
+	if entry.expires.IsZero() {
+		return 0, nil
+	}
+	return entry.expires.Sub(cache.now()), nil
+}
+
+// lookup returns nil for a missing key and drops the entry when it has expired, the caller must hold the mutex
+func (cache *MemoryCache) lookup(key string) *memoryCacheEntry {
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if entry.expired(cache.now()) {
+		cache.remove(element)
+		return nil
+	}
+	cache.recent.MoveToFront(element)
+	return entry
+}
+
+func (cache *MemoryCache) remove(element *list.Element) {
+	entry := element.Value.(*memoryCacheEntry)
+	cache.recent.Remove(element)
+	delete(cache.entries, entry.key)
+	cache.size -= int64(len(entry.value))
+}
@@ -1,8 +1,57 @@
 package ado
 
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Modes a scan can run in, ModeContent, the default, searches for ContentPattern while ModeSecrets runs the built in
+// secret detection rules instead and masks what they find. ModePaths only lists the files whose path matches without
+// downloading them, it is also used when there is no ContentPattern, rule pack or History to search with
+const (
+	ModeContent = "content"
+	ModeSecrets = "secrets"
+	ModePaths   = "paths"
+)
+
+// Fetch strategies for the content of the matching files, FetchAuto, the default, downloads them in one archive per
+// repository unless the repository is larger than the server allows, FetchArchive always does and FetchItems requests
+// each file on its own
+const (
+	FetchAuto    = "auto"
+	FetchArchive = "archive"
+	FetchItems   = "items"
+)
+
 // Results is the keeper of all the projects scanned to be used to create the JSON blob that gets returned
 type Results struct {
 	Projects *[]Project
+	Errors   *[]ScanError
+	// Incomplete is set whenever Errors isn't empty as part of what was scanned may be missing
+	Incomplete bool
+	// Skipped lists the repositories that weren't searched and why
+	Skipped *[]SkippedRepository `json:",omitempty"`
+	// Retries is what retrying throttled and failed calls took
+	Retries *RetrySummary `json:",omitempty"`
+	// BlobCache is how many of the files read were found in the blob cache
+	BlobCache *BlobCacheSummary `json:",omitempty"`
+	// Baseline is the fingerprint of every match, when the criteria asked to export one
+	Baseline *[]string `json:",omitempty"`
+	// Disappeared lists the fingerprints of the criteria's baseline that weren't found again, it is left out of
+	// incomplete results as they can't tell
+	Disappeared *[]string `json:",omitempty"`
+}
+
+// ScanError describes something that failed during the scan, the rest of the scan carries on
+type ScanError struct {
+	Project    string
+	Repository string
+	Path       string
+	Operation  string
+	Message    string
+	// StatusCode is the HTTP status from Azure DevOps or zero when there was no response
+	StatusCode int
 }
 
 // Project contains the name of the project and all repositories that contained information that matched the criteria
@@ -14,18 +63,223 @@ type Project struct {
 // Repository contains the name of the repo and all the items that contained information that matched the criteria
 type Repository struct {
 	Name string
-	Files *[]Item
+	// Ref is the branch or tag that was scanned and Commit the commit it was resolved to, a repository scanned at
+	// several versions is reported once for each version with matches
+	Ref    string `json:",omitempty"`
+	Commit string `json:",omitempty"`
+	Files  *[]Item
 }
 
 // Item contains the name of the item and all the lines that matched the search criteria
 type Item struct {
 	Name string
-	Lines *[]string
+	// ObjectID is only set by a scan that only lists paths, instead of Lines
+	ObjectID string `json:",omitempty"`
+	// Commit is the commit that added the lines of an item found in the history of a repository
+	Commit *Commit `json:",omitempty"`
+	Lines  *[]Line `json:",omitempty"`
+}
+
+// Commit identifies the commit a match found in the history of a repository was added in
+type Commit struct {
+	ID     string
+	Author string
+	Email  string
+	Date   time.Time
+}
+
+// Line contains a line that matched the search criteria, where it was found and the lines surrounding it
+type Line struct {
+	Number int
+	Text   string
+	Ranges *[]Range
+	Before *[]string
+	After  *[]string
+}
+
+// Range is the byte offset of a single match within a line, Start is inclusive and End is exclusive
+type Range struct {
+	Start int
+	End   int
+	// RuleID, Severity and Description are set for matches found by a rule
+	RuleID      string `json:",omitempty"`
+	Severity    string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	// Fingerprint is what a baseline accepts the match by
+	Fingerprint string `json:",omitempty"`
+	// AtHead tells whether a match found in history is still in the file at the scanned version, it is left out
+	// when the file couldn't be read
+	AtHead *bool `json:",omitempty"`
 }
 
 // SearchCriteria is the payload that gets sent in the post to search for the Project, File, and Contents
 type SearchCriteria struct {
 	ProjectNamePattern string
-	FileNamePattern string
-	ContentPattern string
+	// RepositoryNamePattern and the Repositories filters pick the repositories that are searched
+	RepositoryNamePattern string
+	Repositories          RepositoryFilters
+	FileNamePattern       string
+	ContentPattern        string
+	// The Exclude patterns leave out whatever their inclusion counterparts would have matched, ExcludeContentPattern
+	// skips any line it matches
+	ExcludeProjectNamePattern    string
+	ExcludeRepositoryNamePattern string
+	ExcludeFileNamePattern       string
+	ExcludeContentPattern        string
+	// DisableDefaultExclusions scans the vendored and generated files the server leaves out by default
+	DisableDefaultExclusions bool
+	// Fetch is one of the Fetch strategies
+	Fetch string
+	// Mode is one of the Modes
+	Mode string
+	// Branches is a pattern for the branch names to scan, Tags the names of the tags to scan and Commit the full SHA
+	// of a single commit to scan, with none of them set each repository's default branch is scanned
+	Branches string
+	Tags     []string
+	Commit   string
+	// History searches the lines added by each commit instead of the files at the scanned version
+	History   *History
+	RulePacks []string
+	// Baseline is the fingerprints of the accepted matches, ExportBaseline returns the fingerprint of every match
+	Baseline       []string
+	ExportBaseline bool
+	ContextLines   int
+	Concurrency    Concurrency
+	TimeoutSeconds int
+	// Incremental remembers the commit each repository was scanned at and its matches so the next scan with the same
+	// criteria only reads the files changed since
+	Incremental bool
+}
+
+// validate checks the parts of the criteria that can't be checked by decoding them, packs are the rule packs the
+// server has loaded
+func (c *SearchCriteria) validate(packs rulePacks) error {
+	switch c.Mode {
+	case "", ModeContent, ModeSecrets:
+	case ModePaths:
+		if err := c.validatePaths(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Mode must be %q, %q or %q", ModeContent, ModeSecrets, ModePaths)
+	}
+	switch c.Fetch {
+	case "", FetchAuto, FetchArchive, FetchItems:
+	default:
+		return fmt.Errorf("Fetch must be %q, %q or %q", FetchAuto, FetchArchive, FetchItems)
+	}
+	if _, err := newPatterns(c); err != nil {
+		return err
+	}
+	if err := c.Repositories.validate(); err != nil {
+		return err
+	}
+	if err := c.validateExclusions(); err != nil {
+		return err
+	}
+	if err := c.validateVersions(); err != nil {
+		return err
+	}
+	if err := c.History.validate(); err != nil {
+		return err
+	}
+	if err := c.validateIncremental(); err != nil {
+		return err
+	}
+
+	if len(c.RulePacks) == 0 {
+		return nil
+	}
+	if c.Mode == ModeSecrets {
+		return fmt.Errorf("RulePacks can't be used in %q mode", ModeSecrets)
+	}
+	if c.ContentPattern != "" {
+		return fmt.Errorf("ContentPattern can't be used with RulePacks")
+	}
+	for _, name := range c.RulePacks {
+		if _, ok := packs[name]; !ok {
+			return fmt.Errorf("unknown rule pack %q", name)
+		}
+	}
+	return nil
+}
+
+// validatePaths checks nothing is set that would search the content of the files a paths scan lists
+func (c *SearchCriteria) validatePaths() error {
+	switch {
+	case c.ContentPattern != "":
+		return fmt.Errorf("ContentPattern can't be used in %q mode", ModePaths)
+	case len(c.RulePacks) > 0:
+		return fmt.Errorf("RulePacks can't be used in %q mode", ModePaths)
+	case c.History != nil:
+		return fmt.Errorf("History can't be used in %q mode", ModePaths)
+	}
+	return nil
+}
+
+// pathsOnly reports whether the scan lists the matching paths without reading the files, which it does in ModePaths
+// and when the criteria have nothing to search the files for
+func (c *SearchCriteria) pathsOnly() bool {
+	if c.Mode == ModePaths {
+		return true
+	}
+	return c.Mode != ModeSecrets && c.ContentPattern == "" && len(c.RulePacks) == 0 && c.History == nil
+}
+
+// History walks the commits reachable from the scanned version, newest first, Since and Until limit the walk to commits
+// made in that period and MaxCommits, when it is set, stops it after that many commits. Merge commits are skipped as
+// the lines they bring in were added by the commits being merged
+type History struct {
+	Since      *time.Time
+	Until      *time.Time
+	MaxCommits int
+}
+
+// validate checks the period is the right way around, a nil History is valid as it turns history off
+func (h *History) validate() error {
+	if h == nil {
+		return nil
+	}
+	if h.MaxCommits < 0 {
+		return fmt.Errorf("History.MaxCommits can't be negative")
+	}
+	if h.Since != nil && h.Until != nil && h.Until.Before(*h.Since) {
+		return fmt.Errorf("History.Since must be before History.Until")
+	}
+	return nil
+}
+
+// Concurrency limits how many projects, repositories and files are scanned at once and how many Azure DevOps
+// requests can be in flight, values left at zero or above the server's configuration use the server's configuration
+type Concurrency struct {
+	Projects     int
+	Repositories int
+	Files        int
+	Requests     int
+}
+
+// Progress counts how much of a scan has been completed, the counters are updated atomically while the scan runs
+type Progress struct {
+	ProjectsScanned     int64
+	ProjectsTotal       int64
+	RepositoriesScanned int64
+	RepositoriesTotal   int64
+	FilesScanned        int64
+	FilesTotal          int64
+	// RoundTrips is the number of HTTP requests made to Azure DevOps, including the ones the client makes to look up
+	// where an API is served
+	RoundTrips int64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the scan is still updating them
+func (p *Progress) Snapshot() Progress {
+	return Progress{
+		ProjectsScanned:     atomic.LoadInt64(&p.ProjectsScanned),
+		ProjectsTotal:       atomic.LoadInt64(&p.ProjectsTotal),
+		RepositoriesScanned: atomic.LoadInt64(&p.RepositoriesScanned),
+		RepositoriesTotal:   atomic.LoadInt64(&p.RepositoriesTotal),
+		FilesScanned:        atomic.LoadInt64(&p.FilesScanned),
+		FilesTotal:          atomic.LoadInt64(&p.FilesTotal),
+		RoundTrips:          atomic.LoadInt64(&p.RoundTrips),
+	}
 }
@@ -0,0 +1,66 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func getItemsWithObjectIDs(paths ...string) *[]git.GitItem {
+	items := getItemsWithPaths(paths...)
+	for i := range *items {
+		objectID := fmt.Sprintf("%040d", i)
+		(*items)[i].ObjectId = &objectID
+	}
+	return items
+}
+
+func TestScanPathsOnlyListsMatchingPaths(t *testing.T) {
+	for _, criteria := range []SearchCriteria{
+		{ProjectNamePattern: "Project", FileNamePattern: "Dockerfile$", Mode: ModePaths},
+		{ProjectNamePattern: "Project", FileNamePattern: "Dockerfile$"},
+	} {
+		mockConnection := new(mocks.Service)
+		mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+		mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+		mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+			Return(getItemsWithObjectIDs("/Dockerfile", "/README.md", "/src/api/Dockerfile"), nil)
+		scanProjects := sProjects(mockConnection)
+		scanProjects.criteria = &criteria
+		var streamed []string
+		scanProjects.onItem = func(projectName string, repository Repository, item Item) {
+			streamed = append(streamed, item.Name)
+		}
+		results, err := scanProjects.Scan()
+		assert.Nil(t, err)
+
+		files := *(*(*results.Projects)[0].Repositories)[0].Files
+		assert.Equal(t, []Item{
+			{Name: "/Dockerfile", ObjectID: "0000000000000000000000000000000000000000"},
+			{Name: "/src/api/Dockerfile", ObjectID: "0000000000000000000000000000000000000002"},
+		}, files)
+		assert.Equal(t, []string{"/Dockerfile", "/src/api/Dockerfile"}, streamed)
+		assert.Equal(t, int64(2), scanProjects.progress.FilesScanned)
+		mockConnection.AssertNotCalled(t, GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	}
+}
+
+func TestPostValidatesPathsMode(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"Mode":"paths","ContentPattern":"password"}`, `ContentPattern can't be used in "paths" mode`},
+		{`{"Mode":"paths","RulePacks":["cloud"]}`, `RulePacks can't be used in "paths" mode`},
+		{`{"Mode":"paths","History":{}}`, `History can't be used in "paths" mode`},
+		{`{"Mode":"paths","FileNamePattern":"Dockerfile"}`, ""},
+	})
+}
+
+func TestCacheKeyTreatsAnEmptyContentPatternAsPathsMode(t *testing.T) {
+	assertCacheKeys(t, []cacheKeyCase{
+		{"empty content pattern", SearchCriteria{FileNamePattern: "Dockerfile"}, SearchCriteria{FileNamePattern: "Dockerfile", Mode: ModePaths}, true},
+		{"paths or content", SearchCriteria{FileNamePattern: "Dockerfile", Mode: ModePaths},
+			SearchCriteria{FileNamePattern: "Dockerfile", ContentPattern: "FROM"}, false},
+	})
+}
@@ -0,0 +1,44 @@
+package ado
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// patterns are the criteria's inclusion patterns compiled once for the whole scan, an empty pattern matches everything
+// except for repositories where it leaves the name unchecked. prefilter is only set when the content pattern requires
+// literals a file can be screened for
+type patterns struct {
+	projects     *regexp.Regexp
+	repositories *regexp.Regexp
+	files        *regexp.Regexp
+	content      *regexp.Regexp
+	prefilter    *prefilter
+}
+
+// newPatterns compiles the criteria's patterns, the error names the pattern that didn't compile
+func newPatterns(criteria *SearchCriteria) (patterns, error) {
+	var p patterns
+	var err error
+	for _, pattern := range []struct {
+		name     string
+		compiled **regexp.Regexp
+		value    string
+	}{
+		{"ProjectNamePattern", &p.projects, criteria.ProjectNamePattern},
+		{"FileNamePattern", &p.files, criteria.FileNamePattern},
+		{"ContentPattern", &p.content, criteria.ContentPattern},
+	} {
+		if *pattern.compiled, err = regexp.Compile(pattern.value); err != nil {
+			return patterns{}, fmt.Errorf("%s isn't a valid pattern: %w", pattern.name, err)
+		}
+	}
+	if p.repositories, err = compileOptional(criteria.RepositoryNamePattern); err != nil {
+		return patterns{}, fmt.Errorf("RepositoryNamePattern isn't a valid pattern: %w", err)
+	}
+
+	if criteria.Mode != ModeSecrets && len(criteria.RulePacks) == 0 && criteria.ContentPattern != "" {
+		p.prefilter = newPrefilterFor(criteria.ContentPattern)
+	}
+	return p, nil
+}
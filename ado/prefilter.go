@@ -0,0 +1,299 @@
+package ado
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"unicode"
+)
+
+const (
+	// minPrefilterLiteral is the shortest literal worth screening for, shorter ones are in nearly every file
+	minPrefilterLiteral = 3
+	// maxPrefilterBytes bounds the size of the automaton built for a pattern with many alternatives
+	maxPrefilterBytes = 4096
+	// maxJoinedLiterals bounds how many literals joining the alternatives of a concatenation can produce
+	maxJoinedLiterals = 64
+)
+
+// prefilter finds whether a file contains any of the literals every match of the content pattern has to contain, a
+// file without them can't have a matching line so it is skipped without running the pattern. A single literal is
+// searched for directly and several are searched for at once with an Aho-Corasick automaton
+type prefilter struct {
+	literal []byte
+	// fold compares ASCII letters case insensitively, the literals are lowercased. foldEscapes are the non-ASCII runes
+	// that also match a letter of the literals, such as the Kelvin sign for k, a file with any of them is let through
+	fold        bool
+	foldEscapes [][]byte
+	next        [][256]int32
+	output      []bool
+}
+
+// newPrefilterFor returns the prefilter for pattern or nil when pattern doesn't require literals long enough to screen
+// files for, pattern must already be known to compile
+func newPrefilterFor(pattern string) *prefilter {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	set, ok := requiredLiterals(re.Simplify())
+	if !ok || shortest(set.literals) < minPrefilterLiteral {
+		return nil
+	}
+	size := 0
+	for _, literal := range set.literals {
+		size += len(literal)
+	}
+	if size > maxPrefilterBytes {
+		return nil
+	}
+	return newPrefilter(set.literals, set.fold)
+}
+
+// literalSet holds literals one of which is in any text a pattern matches, fold is set when they have to be compared
+// case insensitively and exact when the pattern matches nothing but the literals themselves, exact sets next to each
+// other in a concatenation are joined into longer literals
+type literalSet struct {
+	literals []string
+	fold     bool
+	exact    bool
+}
+
+// emptyLiteral is the exact set of a pattern that only matches the empty string, such as an anchor
+var emptyLiteral = literalSet{literals: []string{""}, exact: true}
+
+// requiredLiterals returns the literals re requires, ok is false when it doesn't require any
+func requiredLiterals(re *syntax.Regexp) (set literalSet, ok bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return literalSet{literals: []string{string(re.Rune)}, exact: true}, true
+		}
+		if asciiOnly(re.Rune) {
+			return literalSet{literals: []string{string(re.Rune)}, fold: true, exact: true}, true
+		}
+		run := longestASCIIRun(re.Rune)
+		return literalSet{literals: []string{run}, fold: true}, run != ""
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return emptyLiteral, true
+	case syntax.OpCapture:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpQuest:
+		sub, ok := requiredLiterals(re.Sub[0])
+		if !ok || !sub.exact {
+			return literalSet{}, false
+		}
+		return unionLiterals(emptyLiteral, sub), true
+	case syntax.OpPlus:
+		sub, ok := requiredLiterals(re.Sub[0])
+		sub.exact = false
+		return sub, ok
+	case syntax.OpAlternate:
+		set = literalSet{exact: true}
+		for _, sub := range re.Sub {
+			subSet, ok := requiredLiterals(sub)
+			if !ok {
+				return literalSet{}, false
+			}
+			set = unionLiterals(set, subSet)
+		}
+		return set, true
+	case syntax.OpConcat:
+		return concatLiterals(re.Sub)
+	default:
+		return literalSet{}, false
+	}
+}
+
+// concatLiterals joins the exact sets of consecutive parts of a concatenation and returns the set, joined or not, with
+// the longest shortest literal as that one screens out the most
+func concatLiterals(subs []*syntax.Regexp) (literalSet, bool) {
+	var best literalSet
+	bestLength := -1
+	consider := func(set literalSet) {
+		if length := shortest(set.literals); length > bestLength {
+			best, bestLength = set, length
+			best.exact = false
+		}
+	}
+
+	current, exact := emptyLiteral, true
+	for _, sub := range subs {
+		set, ok := requiredLiterals(sub)
+		if ok && set.exact {
+			if joined, ok := joinLiterals(current, set); ok {
+				current = joined
+				continue
+			}
+		}
+		exact = false
+		consider(current)
+		current = emptyLiteral
+		if ok {
+			consider(set)
+			if set.exact {
+				current = set
+			}
+		}
+	}
+	if exact {
+		return current, true
+	}
+	consider(current)
+	return best, bestLength >= 0
+}
+
+// joinLiterals returns every literal of a followed by one of b, ok is false when there would be too many of them
+func joinLiterals(a, b literalSet) (literalSet, bool) {
+	if len(a.literals)*len(b.literals) > maxJoinedLiterals {
+		return literalSet{}, false
+	}
+	joined := literalSet{fold: a.fold || b.fold, exact: true}
+	for _, prefix := range a.literals {
+		for _, suffix := range b.literals {
+			joined.literals = append(joined.literals, prefix+suffix)
+		}
+	}
+	return joined, true
+}
+
+func unionLiterals(a, b literalSet) literalSet {
+	literals := append(append([]string(nil), a.literals...), b.literals...)
+	return literalSet{literals: literals, fold: a.fold || b.fold, exact: a.exact && b.exact}
+}
+
+// asciiOnly reports whether the runes can be compared case insensitively by lowercasing bytes
+func asciiOnly(runes []rune) bool {
+	for _, r := range runes {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// longestASCIIRun returns the longest part of a case insensitive literal that can be compared by lowercasing bytes
+func longestASCIIRun(runes []rune) string {
+	var longest, current []rune
+	for _, r := range runes {
+		if r > unicode.MaxASCII {
+			current = nil
+			continue
+		}
+		current = append(current, r)
+		if len(current) > len(longest) {
+			longest = append([]rune(nil), current...)
+		}
+	}
+	return string(longest)
+}
+
+// foldEscapes returns the non-ASCII runes that match a letter of the literals case insensitively
+func foldEscapes(literals []string) [][]byte {
+	seen := make(map[rune]bool)
+	var escapes [][]byte
+	for _, literal := range literals {
+		for _, r := range literal {
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				if f > unicode.MaxASCII && !seen[f] {
+					seen[f] = true
+					escapes = append(escapes, []byte(string(f)))
+				}
+			}
+		}
+	}
+	return escapes
+}
+
+func shortest(literals []string) int {
+	length := -1
+	for _, literal := range literals {
+		if length == -1 || len(literal) < length {
+			length = len(literal)
+		}
+	}
+	return length
+}
+
+func newPrefilter(literals []string, fold bool) *prefilter {
+	p := &prefilter{fold: fold}
+	if fold {
+		p.foldEscapes = foldEscapes(literals)
+	}
+	if len(literals) == 1 && !fold {
+		p.literal = []byte(literals[0])
+		return p
+	}
+
+	// Build the trie of the literals, then turn it into an automaton with a transition for every byte from every state
+	p.next = make([][256]int32, 1)
+	p.output = make([]bool, 1)
+	children := []map[byte]int32{{}}
+	for _, literal := range literals {
+		state := int32(0)
+		for i := 0; i < len(literal); i++ {
+			b := p.normalize(literal[i])
+			child, ok := children[state][b]
+			if !ok {
+				child = int32(len(children))
+				children[state][b] = child
+				children = append(children, map[byte]int32{})
+				p.next = append(p.next, [256]int32{})
+				p.output = append(p.output, false)
+			}
+			state = child
+		}
+		p.output[state] = true
+	}
+
+	fail := make([]int32, len(children))
+	queue := make([]int32, 0, len(children))
+	for b := 0; b < 256; b++ {
+		if child, ok := children[0][byte(b)]; ok {
+			p.next[0][b] = child
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		p.output[state] = p.output[state] || p.output[fail[state]]
+		for b := 0; b < 256; b++ {
+			if child, ok := children[state][byte(b)]; ok {
+				fail[child] = p.next[fail[state]][b]
+				p.next[state][b] = child
+				queue = append(queue, child)
+			} else {
+				p.next[state][b] = p.next[fail[state]][b]
+			}
+		}
+	}
+	return p
+}
+
+func (p *prefilter) normalize(b byte) byte {
+	if p.fold && 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// matches reports whether content contains any of the literals
+func (p *prefilter) matches(content []byte) bool {
+	if p.literal != nil {
+		return bytes.Contains(content, p.literal)
+	}
+	for _, escape := range p.foldEscapes {
+		if bytes.Contains(content, escape) {
+			return true
+		}
+	}
+	state := int32(0)
+	for _, b := range content {
+		state = p.next[state][p.normalize(b)]
+		if p.output[state] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package ado
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitKeyPrefix is put in front of the collection URL to make the redis key of its bucket
+const rateLimitKeyPrefix = "ratelimit:"
+
+// RateLimit is a token bucket, Rate tokens a second are added to it up to Burst and every request to Azure DevOps
+// takes one
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// BucketLevel is how many tokens are left in the bucket of an organization, a bucket that hasn't been used is full
+type BucketLevel struct {
+	Organization string
+	Rate         float64
+	Burst        int
+	Tokens       float64
+}
+
+// takeTokenScript refills the bucket in KEYS[1] for the time since it was last updated and takes a token from it. It
+// returns zero when a token was taken, otherwise how many milliseconds to wait for one. The caller's clock is used as
+// redis doesn't allow scripts that read its clock to write, a clock behind the bucket's last update adds nothing. The
+// bucket expires once it would be full again, ARGV[4] milliseconds after it was used
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) * rate / 1000)
+	updated = now
+end
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(updated))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return wait
+`)
+
+// rateLimiter hands out tokens from a bucket per organization kept in redis, so every replica draws from the same
+// buckets. limits holds the organizations whose limit differs from defaultLimit, keyed by collection URL
+type rateLimiter struct {
+	client       redis.Cmdable
+	defaultLimit RateLimit
+	limits       map[string]RateLimit
+	now          func() time.Time
+	sleep        func(ctx context.Context, d time.Duration) bool
+}
+
+func newRateLimiter(client redis.Cmdable, defaultLimit RateLimit, limits map[string]RateLimit) *rateLimiter {
+	return &rateLimiter{client: client, defaultLimit: defaultLimit, limits: limits, now: time.Now, sleep: sleepContext}
+}
+
+// rateLimiterFromEnv creates the rate limiter configured by ADO_RATE_LIMIT, the default limit, and ADO_RATE_LIMITS,
+// a comma separated list of organization=limit. A limit is the rate a second, optionally followed by a colon and the
+// burst. It returns nil when neither is set as rate limiting is off
+func rateLimiterFromEnv(hosts hostAllowlist) (*rateLimiter, error) {
+	defaultValue, limitsValue := getEnv("ADO_RATE_LIMIT", ""), getEnv("ADO_RATE_LIMITS", "")
+	if defaultValue == "" && limitsValue == "" {
+		return nil, nil
+	}
+
+	var defaultLimit RateLimit
+	if defaultValue != "" {
+		var err error
+		if defaultLimit, err = parseRateLimit(defaultValue); err != nil {
+			return nil, fmt.Errorf("invalid ADO_RATE_LIMIT: %w", err)
+		}
+	}
+	limits, err := parseRateLimits(limitsValue, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimiter(newRedisClientFromEnv(), defaultLimit, limits), nil
+}
+
+// parseRateLimit parses a rate with an optional burst such as 20:40, the burst is the rate rounded up when it is left
+// out
+func parseRateLimit(value string) (RateLimit, error) {
+	rateValue, burstValue := value, ""
+	if index := strings.Index(value, ":"); index >= 0 {
+		rateValue, burstValue = value[:index], value[index+1:]
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateValue), 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return RateLimit{}, fmt.Errorf("%q isn't a positive rate", value)
+	}
+	limit := RateLimit{Rate: rate, Burst: int(math.Ceil(rate))}
+	if burstValue != "" {
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burstValue)); err != nil || limit.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("%q isn't a positive burst", value)
+		}
+	}
+	return limit, nil
+}
+
+// parseRateLimits parses the organization=limit entries of ADO_RATE_LIMITS, organizations are given like the Org header
+// and keyed by their collection URL
+func parseRateLimits(value string, hosts hostAllowlist) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		index := strings.LastIndex(entry, "=")
+		if index < 0 {
+			return nil, fmt.Errorf("invalid ADO_RATE_LIMITS entry %q", entry)
+		}
+		collection, err := hosts.collectionURL(strings.TrimSpace(entry[:index]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ADO_RATE_LIMITS entry %q: %w", entry, err)
+		}
+		if limits[collection], err = parseRateLimit(entry[index+1:]); err != nil {
+			return nil, fmt.Errorf("invalid ADO_RATE_LIMITS entry %q: %w", entry, err)
+		}
+	}
+	return limits, nil
+}
+
+// limit returns the limit of the organization, ok is false when it isn't limited
+func (l *rateLimiter) limit(org string) (limit RateLimit, ok bool) {
+	if limit, ok := l.limits[org]; ok {
+		return limit, true
+	}
+	return l.defaultLimit, l.defaultLimit.Rate > 0
+}
+
+// take waits for a token from the organization's bucket and returns ctx's error if it is done first. A failing redis
+// lets the call through, the limiter is there to be polite to Azure DevOps and shouldn't stop scans on its own
+func (l *rateLimiter) take(ctx context.Context, org string) error {
+	limit, ok := l.limit(org)
+	if !ok {
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		now := l.now().UnixNano() / int64(time.Millisecond)
+		expiry := int64(math.Ceil(float64(limit.Burst)*1000/limit.Rate)) + 1000
+		wait, err := takeTokenScript.Run(l.client, []string{rateLimitKeyPrefix + org}, limit.Rate, limit.Burst, now, expiry).Int64()
+		if err != nil {
+			log.Printf("Rate limiting %s failed: %s", org, err)
+			return nil
+		}
+		if wait <= 0 {
+			return nil
+		}
+		if !l.sleep(ctx, time.Duration(wait)*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+}
+
+type rateLimitKey struct{}
+
+// orgRateLimit is the bucket the requests of a context take their tokens from
+type orgRateLimit struct {
+	limiter *rateLimiter
+	org     string
+}
+
+// withRateLimit returns a context whose requests to Azure DevOps each take a token from the organization's bucket, so
+// the requests of paged calls and resource area lookups are limited like the others
+func withRateLimit(ctx context.Context, limiter *rateLimiter, org string) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, orgRateLimit{limiter: limiter, org: org})
+}
+
+// takeRateLimitToken waits for a token from the bucket ctx carries, requests without one go straight through
+func takeRateLimitToken(ctx context.Context) error {
+	if limit, ok := ctx.Value(rateLimitKey{}).(orgRateLimit); ok {
+		return limit.limiter.take(ctx, limit.org)
+	}
+	return nil
+}
+
+// levels returns the buckets of the organizations with a limit of their own and of the extra ones, sorted by
+// organization. Buckets are never discovered from redis as it holds every organization any caller has scanned
+func (l *rateLimiter) levels(extra ...string) ([]BucketLevel, error) {
+	organizations := make(map[string]bool)
+	for org := range l.limits {
+		organizations[org] = true
+	}
+	for _, org := range extra {
+		organizations[org] = true
+	}
+
+	now := float64(l.now().UnixNano() / int64(time.Millisecond))
+	levels := make([]BucketLevel, 0, len(organizations))
+	for org := range organizations {
+		limit, ok := l.limit(org)
+		if !ok {
+			continue
+		}
+		level := BucketLevel{Organization: org, Rate: limit.Rate, Burst: limit.Burst, Tokens: float64(limit.Burst)}
+		bucket, err := l.client.HMGet(rateLimitKeyPrefix+org, "tokens", "updated").Result()
+		if err != nil {
+			return nil, err
+		}
+		tokens, tokensErr := strconv.ParseFloat(fmt.Sprint(bucket[0]), 64)
+		updated, updatedErr := strconv.ParseFloat(fmt.Sprint(bucket[1]), 64)
+		if tokensErr == nil && updatedErr == nil {
+			level.Tokens = math.Min(float64(limit.Burst), tokens+math.Max(0, now-updated)*limit.Rate/1000)
+		}
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Organization < levels[j].Organization })
+	return levels, nil
+}
+
+// getRateLimitsHandler reports the bucket levels of the organizations ADO_RATE_LIMITS sets a limit for and of the
+// caller's own, it is not found when rate limiting is off. The caller's token is checked by listing the first page of
+// the organization's projects, a request that takes a token like any other, and refused when Azure DevOps rejects it
+func (api *API) getRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	org, personalAccessToken, ok := api.decodeCaller(w, r)
+	if !ok {
+		return
+	}
+	if api.rateLimiter == nil {
+		http.Error(w, "Rate limiting is not configured", http.StatusNotFound)
+		return
+	}
+	service, err := api.serviceFactory.NewService(org, personalAccessToken)
+	if err == nil {
+		_, err = service.GetProjects(withRateLimit(r.Context(), api.rateLimiter, org))
+	}
+	if status := statusCode(err); status == http.StatusUnauthorized || status == http.StatusForbidden {
+		http.Error(w, "PAT is not authorized for the organization", status)
+		return
+	}
+	if err != nil {
+		api.writeScanError(w, err)
+		return
+	}
+	levels, err := api.rateLimiter.levels(org)
+	if err == nil {
+		var value []byte
+		if value, err = json.Marshal(levels); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			api.processResponse(w, value)
+			return
+		}
+	}
+	api.logger.LogError(err)
+	log.Println(err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
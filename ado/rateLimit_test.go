@@ -0,0 +1,227 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRateLimitOrg = "https://dev.azure.com/itsals"
+
+// sleepingClock is shared by the rate limiters of a test, sleeping moves it on instead of waiting
+type sleepingClock struct {
+	testClock
+	sleeps []time.Duration
+}
+
+func newSleepingClock() *sleepingClock {
+	return &sleepingClock{testClock: testClock{now: time.Unix(1600000000, 0)}}
+}
+
+func (clock *sleepingClock) sleep(_ context.Context, d time.Duration) bool {
+	clock.sleeps = append(clock.sleeps, d)
+	clock.FastForward(d)
+	return true
+}
+
+func newTestRateLimiter(server *miniredis.Miniredis, clock *sleepingClock, defaultLimit RateLimit, limits map[string]RateLimit) *rateLimiter {
+	limiter := newRateLimiter(redis.NewClient(&redis.Options{Addr: server.Addr()}), defaultLimit, limits)
+	limiter.now = clock.Now
+	limiter.sleep = clock.sleep
+	return limiter
+}
+
+func runMiniredis(t *testing.T) *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRateLimiterTakesTokensUpToTheBurst(t *testing.T) {
+	clock := newSleepingClock()
+	limiter := newTestRateLimiter(runMiniredis(t), clock, RateLimit{Rate: 2, Burst: 3}, nil)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	}
+	assert.Empty(t, clock.sleeps)
+
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.sleeps)
+
+	// The bucket refills at the rate while it isn't used
+	clock.FastForward(time.Second)
+	clock.sleeps = nil
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Empty(t, clock.sleeps)
+}
+
+func TestRateLimiterIsSharedByReplicas(t *testing.T) {
+	server := runMiniredis(t)
+	clock := newSleepingClock()
+	first := newTestRateLimiter(server, clock, RateLimit{Rate: 1, Burst: 2}, nil)
+	second := newTestRateLimiter(server, clock, RateLimit{Rate: 1, Burst: 2}, nil)
+
+	assert.Nil(t, first.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, first.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, second.take(context.Background(), testRateLimitOrg))
+	assert.Equal(t, []time.Duration{time.Second}, clock.sleeps)
+}
+
+func TestRateLimiterLimitsOrganizationsSeparately(t *testing.T) {
+	server := runMiniredis(t)
+	clock := newSleepingClock()
+	other := "https://dev.azure.com/other"
+	limiter := newTestRateLimiter(server, clock, RateLimit{}, map[string]RateLimit{testRateLimitOrg: {Rate: 1, Burst: 1}})
+
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, limiter.take(context.Background(), other))
+	}
+	assert.Empty(t, clock.sleeps)
+	assert.False(t, server.Exists(rateLimitKeyPrefix+other))
+}
+
+func TestRateLimiterStopsWhenCancelled(t *testing.T) {
+	clock := newSleepingClock()
+	limiter := newTestRateLimiter(runMiniredis(t), clock, RateLimit{Rate: 1, Burst: 1}, nil)
+	limiter.sleep = sleepContext
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, limiter.take(ctx, testRateLimitOrg))
+}
+
+func TestRateLimiterLetsCallsThroughWithoutRedis(t *testing.T) {
+	server := runMiniredis(t)
+	clock := newSleepingClock()
+	limiter := newTestRateLimiter(server, clock, RateLimit{Rate: 1, Burst: 1}, nil)
+	server.Close()
+
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Empty(t, clock.sleeps)
+}
+
+func TestParseRateLimits(t *testing.T) {
+	hosts, err := parseHostAllowlist(defaultAllowedHosts + ",tfs.example.com")
+	assert.Nil(t, err)
+
+	limits, err := parseRateLimits("itsals=5:10, https://tfs.example.com/tfs/DefaultCollection/=0.5", hosts)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]RateLimit{
+		"https://dev.azure.com/itsals":                  {Rate: 5, Burst: 10},
+		"https://tfs.example.com/tfs/DefaultCollection": {Rate: 0.5, Burst: 1},
+	}, limits)
+
+	for value, message := range map[string]string{
+		"itsals":                `invalid ADO_RATE_LIMITS entry "itsals"`,
+		"itsals=0":              `invalid ADO_RATE_LIMITS entry "itsals=0": "0" isn't a positive rate`,
+		"itsals=5:0":            `invalid ADO_RATE_LIMITS entry "itsals=5:0": "5:0" isn't a positive burst`,
+		"https://evil.test/x=5": `invalid ADO_RATE_LIMITS entry "https://evil.test/x=5": ` + errCollectionNotAllowed.Error(),
+	} {
+		_, err := parseRateLimits(value, hosts)
+		assert.EqualError(t, err, message, value)
+	}
+}
+
+func TestGetRateLimitsReportsBucketLevels(t *testing.T) {
+	clock := newSleepingClock()
+	limited := "https://dev.azure.com/limited"
+	limiter := newTestRateLimiter(runMiniredis(t), clock, RateLimit{Rate: 2, Burst: 4}, map[string]RateLimit{limited: {Rate: 1, Burst: 1}})
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	assert.Nil(t, limiter.take(context.Background(), testRateLimitOrg))
+	// Another caller's organization isn't reported
+	assert.Nil(t, limiter.take(context.Background(), "https://dev.azure.com/other"))
+	clock.FastForward(250 * time.Millisecond)
+
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	api := API{logger: new(mocks.Logging), rateLimiter: limiter, serviceFactory: staticServiceFactory{service: mockConnection}}
+	req, _ := http.NewRequest("GET", "/api/v1/ratelimits", nil)
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	api.getRateLimitsHandler(rr, req)
+
+	assert.Equal(t, 200, rr.Code)
+	var levels []BucketLevel
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &levels))
+	assert.Equal(t, []BucketLevel{
+		{Organization: testRateLimitOrg, Rate: 2, Burst: 4, Tokens: 1.5},
+		{Organization: limited, Rate: 1, Burst: 1, Tokens: 1},
+	}, levels)
+	mockConnection.AssertNumberOfCalls(t, GetProjectsFuncName, 1)
+}
+
+func TestGetRateLimitsRefusesATokenAzureDevOpsRejects(t *testing.T) {
+	limiter := newTestRateLimiter(runMiniredis(t), newSleepingClock(), RateLimit{Rate: 2, Burst: 4}, nil)
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		mockConnection := new(mocks.Service)
+		mockConnection.On(GetProjectsFuncName, mock.Anything).Return(nil, statusError(status))
+		api := API{logger: new(mocks.Logging), rateLimiter: limiter, serviceFactory: staticServiceFactory{service: mockConnection}}
+		req, _ := http.NewRequest("GET", "/api/v1/ratelimits", nil)
+		req.Header.Add("Org", "itsals")
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		api.getRateLimitsHandler(rr, req)
+
+		assert.Equal(t, status, rr.Code)
+		assert.Equal(t, "PAT is not authorized for the organization\n", rr.Body.String())
+	}
+}
+
+func TestGetRateLimitsRequiresTheCaller(t *testing.T) {
+	limiter := newTestRateLimiter(runMiniredis(t), newSleepingClock(), RateLimit{Rate: 2, Burst: 4}, nil)
+	api := API{logger: new(mocks.Logging), rateLimiter: limiter}
+	req, _ := http.NewRequest("GET", "/api/v1/ratelimits", nil)
+	req.Header.Add("Org", "itsals")
+	rr := httptest.NewRecorder()
+	api.getRateLimitsHandler(rr, req)
+	assert.Equal(t, 400, rr.Code)
+	assert.Equal(t, "PAT header is required\n", rr.Body.String())
+}
+
+func TestGetRateLimitsWhenRateLimitingIsOff(t *testing.T) {
+	api := API{logger: new(mocks.Logging)}
+	req, _ := http.NewRequest("GET", "/api/v1/ratelimits", nil)
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	api.getRateLimitsHandler(rr, req)
+	assert.Equal(t, 404, rr.Code)
+}
+
+func TestScanTakesATokenForEveryRequest(t *testing.T) {
+	server := newOnPremServer(t, projectPageSize+1)
+	server.resourceAreas = true
+	org := server.URL + server.collection
+
+	clock := newSleepingClock()
+	limiter := newTestRateLimiter(runMiniredis(t), clock, RateLimit{Rate: 0.001, Burst: 1000}, nil)
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, nil, nil), rateLimiter: limiter}
+	// miniredis doesn't run scripts atomically like redis does, so the calls are made one at a time
+	criteria := &SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "yml", ContentPattern: "password",
+		Concurrency: Concurrency{Projects: 1, Repositories: 1, Files: 1, Requests: 1}}
+	_, err := api.scan(context.Background(), org, "123", criteria, new(Progress), nil)
+	assert.Nil(t, err)
+
+	// The pages of projects and the resource area lookups take tokens too
+	levels, err := limiter.levels(org)
+	assert.Nil(t, err)
+	assert.Equal(t, []BucketLevel{{Organization: org, Rate: 0.001, Burst: 1000, Tokens: float64(1000 - atomic.LoadInt64(&server.roundTrips))}}, levels)
+	assert.True(t, atomic.LoadInt64(&server.resourceAreaLookups) > 0)
+}
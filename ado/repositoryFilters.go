@@ -0,0 +1,98 @@
+package ado
+
+import (
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"sort"
+	"sync"
+)
+
+// Reasons a repository was skipped, used to fill in SkippedRepository.Reason
+const (
+	SkipReasonName            = "name"
+	SkipReasonExcluded        = "excluded"
+	SkipReasonDisabled        = "disabled"
+	SkipReasonFork            = "fork"
+	SkipReasonTooSmall        = "too-small"
+	SkipReasonTooLarge        = "too-large"
+	SkipReasonNoDefaultBranch = "no-default-branch"
+	SkipReasonNoCommit        = "no-commit"
+)
+
+// RepositoryFilters skip repositories by their metadata, MinSize and MaxSize are the compressed size of the repository
+// in bytes and are ignored when zero
+type RepositoryFilters struct {
+	SkipDisabled         bool
+	SkipForks            bool
+	MinSize              uint64
+	MaxSize              uint64
+	RequireDefaultBranch bool
+}
+
+// validate checks the size range is the right way around
+func (f RepositoryFilters) validate() error {
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return fmt.Errorf("Repositories.MinSize can't be more than Repositories.MaxSize")
+	}
+	return nil
+}
+
+// SkippedRepository is a repository that wasn't searched and why, Reason is one of the SkipReason constants
+type SkippedRepository struct {
+	Project    string
+	Repository string
+	Reason     string
+}
+
+// skipReason returns why the repository is left out of the scan or an empty string when it is scanned
+func (s *ScanProjects) skipReason(repo git.GitRepository, disabled bool) string {
+	filters := s.criteria.Repositories
+	var size uint64
+	if repo.Size != nil {
+		size = *repo.Size
+	}
+	switch {
+	case s.patterns.repositories != nil && !s.patterns.repositories.MatchString(*repo.Name):
+		return SkipReasonName
+	case s.exclusions.repository(*repo.Name):
+		return SkipReasonExcluded
+	case filters.SkipDisabled && disabled:
+		return SkipReasonDisabled
+	case filters.SkipForks && repo.IsFork != nil && *repo.IsFork:
+		return SkipReasonFork
+	case filters.MinSize > 0 && size < filters.MinSize:
+		return SkipReasonTooSmall
+	case filters.MaxSize > 0 && size > filters.MaxSize:
+		return SkipReasonTooLarge
+	case filters.RequireDefaultBranch && (repo.DefaultBranch == nil || *repo.DefaultBranch == ""):
+		return SkipReasonNoDefaultBranch
+	default:
+		return ""
+	}
+}
+
+// skippedRepositories collects the repositories every goroutine of a scan skipped
+type skippedRepositories struct {
+	mutex   sync.Mutex
+	skipped []SkippedRepository
+}
+
+func (r *skippedRepositories) add(project, repository, reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.skipped = append(r.skipped, SkippedRepository{Project: project, Repository: repository, Reason: reason})
+}
+
+// list returns the skipped repositories ordered by project and repository so results don't depend on scheduling
+func (r *skippedRepositories) list() []SkippedRepository {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	skipped := append([]SkippedRepository(nil), r.skipped...)
+	sort.Slice(skipped, func(i, j int) bool {
+		if skipped[i].Project != skipped[j].Project {
+			return skipped[i].Project < skipped[j].Project
+		}
+		return skipped[i].Repository < skipped[j].Repository
+	})
+	return skipped
+}
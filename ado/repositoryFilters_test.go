@@ -0,0 +1,106 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"testing"
+)
+
+func testRepository(name string, size uint64, fork bool, defaultBranch string) git.GitRepository {
+	repository := git.GitRepository{Name: &name, Size: &size, IsFork: &fork}
+	if defaultBranch != "" {
+		repository.DefaultBranch = &defaultBranch
+	}
+	return repository
+}
+
+func TestScanSkipsFilteredRepositories(t *testing.T) {
+	repositories := []git.GitRepository{
+		testRepository("Service", 2048, false, "refs/heads/main"),
+		testRepository("Tools", 2048, false, "refs/heads/main"),
+		testRepository("ServiceArchive", 2048, false, "refs/heads/main"),
+		testRepository("ServiceFork", 2048, true, "refs/heads/main"),
+		testRepository("ServiceTiny", 10, false, "refs/heads/main"),
+		testRepository("ServiceHuge", 1<<30, false, "refs/heads/main"),
+		testRepository("ServiceEmpty", 2048, false, ""),
+		testRepository("ServiceLegacy", 2048, false, "refs/heads/main"),
+	}
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").
+		Return(&repositories, map[string]bool{"ServiceArchive": true}, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return getItemContentTestData()
+		}, nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.RepositoryNamePattern = "^Service"
+	scanProjects.criteria.ExcludeRepositoryNamePattern = "Legacy"
+	scanProjects.criteria.Repositories = RepositoryFilters{
+		SkipDisabled:         true,
+		SkipForks:            true,
+		MinSize:              1024,
+		MaxSize:              1 << 20,
+		RequireDefaultBranch: true,
+	}
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.Len(t, *(*results.Projects)[0].Repositories, 1)
+	assert.Equal(t, "Service", (*(*results.Projects)[0].Repositories)[0].Name)
+	assert.Equal(t, []SkippedRepository{
+		{Project: "Project0", Repository: "ServiceArchive", Reason: SkipReasonDisabled},
+		{Project: "Project0", Repository: "ServiceEmpty", Reason: SkipReasonNoDefaultBranch},
+		{Project: "Project0", Repository: "ServiceFork", Reason: SkipReasonFork},
+		{Project: "Project0", Repository: "ServiceHuge", Reason: SkipReasonTooLarge},
+		{Project: "Project0", Repository: "ServiceLegacy", Reason: SkipReasonExcluded},
+		{Project: "Project0", Repository: "ServiceTiny", Reason: SkipReasonTooSmall},
+		{Project: "Project0", Repository: "Tools", Reason: SkipReasonName},
+	}, *results.Skipped)
+	mockConnection.AssertNumberOfCalls(t, GetItemsFuncName, 1)
+}
+
+func TestScanWithoutRepositoryFiltersSkipsNothing(t *testing.T) {
+	repositories := []git.GitRepository{
+		testRepository("Repo0", 0, true, ""),
+		testRepository("Repo1", 2048, false, "refs/heads/main"),
+	}
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(&repositories, map[string]bool{"Repo1": true}, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return getItemContentTestData()
+		}, nil)
+	results, err := sProjects(mockConnection).Scan()
+	assert.Nil(t, err)
+
+	assert.Len(t, *(*results.Projects)[0].Repositories, 2)
+	assert.Nil(t, results.Skipped)
+}
+
+func TestPostValidatesRepositoryFilters(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"RepositoryNamePattern":"("}`, "RepositoryNamePattern isn't a valid pattern: error parsing regexp: missing closing ): `(`"},
+		{`{"Repositories":{"MinSize":2048,"MaxSize":1024}}`, "Repositories.MinSize can't be more than Repositories.MaxSize"},
+		{`{"RepositoryNamePattern":"^api-","Repositories":{"MinSize":1024,"MaxSize":2048}}`, ""},
+	})
+}
+
+func TestGetRepositoriesReportsDisabledRepositories(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	server.disabled = []string{"Archive"}
+	service, err := NewAzureDevOpsService(server.URL+server.collection, "123", nil, nil)
+	assert.Nil(t, err)
+
+	repositories, disabled, err := service.GetRepositories(context.Background(), "Project0")
+	assert.Nil(t, err)
+	assert.Len(t, *repositories, 2)
+	assert.Equal(t, map[string]bool{"Archive": true}, disabled)
+}
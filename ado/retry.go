@@ -0,0 +1,393 @@
+package ado
+
+import (
+	"context"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/core"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// retryPolicy bounds how hard a scan retries failed Azure DevOps calls, attempts is the most times one call is made and
+// budget the most time the whole scan spends backing off or paused for throttling. Backoff starts at baseDelay and
+// doubles up to maxDelay
+type retryPolicy struct {
+	attempts  int
+	budget    time.Duration
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// defaultRetryPolicy is used when the server configuration doesn't set one
+var defaultRetryPolicy = retryPolicy{
+	attempts:  5,
+	budget:    2 * time.Minute,
+	baseDelay: time.Second,
+	maxDelay:  30 * time.Second,
+}
+
+// retryPolicyFromEnv reads the server wide retry policy, anything missing or invalid falls back to the default
+func retryPolicyFromEnv() retryPolicy {
+	policy := defaultRetryPolicy
+	policy.attempts = getEnvInt("ADO_RETRY_ATTEMPTS", policy.attempts)
+	policy.budget = time.Duration(getEnvInt("ADO_RETRY_BUDGET_SECONDS", int(policy.budget/time.Second))) * time.Second
+	return policy
+}
+
+// RetrySummary counts the Azure DevOps calls a scan retried, Throttled of them because Azure DevOps asked it to slow
+// down. DelaySeconds is the time calls spent waiting, for a retry or for throttling to pass, and GaveUp counts the
+// calls that still failed once their attempts or the scan's retry budget ran out
+type RetrySummary struct {
+	Retries      int64
+	Throttled    int64
+	GaveUp       int64
+	DelaySeconds float64
+}
+
+// retryStats are the counters behind a RetrySummary, updated atomically by every goroutine of the scan
+type retryStats struct {
+	retries   int64
+	throttled int64
+	gaveUp    int64
+	delay     int64
+}
+
+// summary returns the counters or nil when no call waited or was retried
+func (r *retryStats) summary() *RetrySummary {
+	summary := RetrySummary{
+		Retries:      atomic.LoadInt64(&r.retries),
+		Throttled:    atomic.LoadInt64(&r.throttled),
+		GaveUp:       atomic.LoadInt64(&r.gaveUp),
+		DelaySeconds: time.Duration(atomic.LoadInt64(&r.delay)).Seconds(),
+	}
+	if summary == (RetrySummary{}) {
+		return nil
+	}
+	return &summary
+}
+
+// orgPauses holds when the calls to each organization may go on after Azure DevOps asked them to stop, keyed by
+// collection URL. It is shared by every scan of the server as Azure DevOps throttles an organization's calls together,
+// whichever scan made them
+type orgPauses struct {
+	mutex sync.Mutex
+	until map[string]time.Time
+}
+
+func newOrgPauses() *orgPauses {
+	return &orgPauses{until: make(map[string]time.Time)}
+}
+
+// extend pauses the organization's calls until until, unless they already are for longer. spend is given the time the
+// pause adds from now on and the pause is left alone when it returns false. Pauses that are over are dropped so
+// organizations that were throttled once aren't kept around
+func (p *orgPauses) extend(org string, now, until time.Time, spend func(added time.Duration) bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	current := p.until[org]
+	if !until.After(current) {
+		return true
+	}
+	added := until.Sub(current)
+	if current.Before(now) {
+		added = until.Sub(now)
+	}
+	if !spend(added) {
+		return false
+	}
+	for other, otherUntil := range p.until {
+		if !otherUntil.After(now) {
+			delete(p.until, other)
+		}
+	}
+	p.until[org] = until
+	return true
+}
+
+// remaining returns how long the organization's calls are still paused for
+func (p *orgPauses) remaining(org string, now time.Time) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.until[org].Sub(now)
+}
+
+// retryingService wraps a Service so calls that fail with throttling or transient errors are made again. A Retry-After,
+// X-RateLimit-Reset or X-RateLimit-Delay from Azure DevOps pauses every call to the organization until then, from this
+// scan and the others sharing pauses, as the limit is shared by all of them. Otherwise a failed call backs off
+// exponentially with jitter. Content streams are only retried until they are returned, a failure while reading them is
+// left to the caller
+type retryingService struct {
+	Service
+	policy retryPolicy
+	stats  *retryStats
+	pauses *orgPauses
+	org    string
+	sleep  func(ctx context.Context, d time.Duration) bool
+	now    func() time.Time
+	random func(n int64) int64
+
+	mutex sync.Mutex
+	spent time.Duration
+}
+
+// newRetryingService retries the calls of service to org, pausing them with the other scans sharing pauses. The scan
+// pauses on its own when pauses is nil
+func newRetryingService(service Service, policy retryPolicy, stats *retryStats, pauses *orgPauses, org string) *retryingService {
+	if pauses == nil {
+		pauses = newOrgPauses()
+	}
+	return &retryingService{
+		Service: service,
+		policy:  policy,
+		stats:   stats,
+		pauses:  pauses,
+		org:     org,
+		sleep:   sleepContext,
+		now:     time.Now,
+		random:  rand.Int63n,
+	}
+}
+
+// sleepContext waits for d and returns false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// do makes call until it succeeds, fails with an error that isn't worth retrying or runs out of attempts or budget
+func (r *retryingService) do(ctx context.Context, call func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		// Up to a tenth more spreads out the calls a pause held back
+		if pause := r.pauseRemaining(); pause > 0 && !r.wait(ctx, pause+time.Duration(r.random(int64(pause/10)+1))) {
+			return ctx.Err()
+		}
+
+		observed := new(observedResponse)
+		err := call(withResponseObserver(ctx, observed))
+		status, header := observed.last()
+		throttle := r.throttleDelay(status, header)
+		paused := throttle > 0 && r.pause(throttle)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if status < http.StatusBadRequest {
+			status = statusCode(err)
+		}
+		if !retryable(status, err) {
+			return err
+		}
+
+		throttled := throttle > 0 || status == http.StatusTooManyRequests
+		var delay time.Duration
+		if throttle == 0 {
+			delay = r.backoff(attempt)
+		}
+		if attempt >= r.policy.attempts || (throttle > 0 && !paused) || !r.spend(delay) {
+			atomic.AddInt64(&r.stats.gaveUp, 1)
+			return err
+		}
+		atomic.AddInt64(&r.stats.retries, 1)
+		if throttled {
+			atomic.AddInt64(&r.stats.throttled, 1)
+		}
+		if delay > 0 && !r.wait(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// retryable reports whether a call that failed with status, zero when there was no response, or err may succeed
+// when it is made again
+func retryable(status int, err error) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	if status != 0 {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// throttleDelay returns how long Azure DevOps asked for the calls to stop, from Retry-After or, for a throttled
+// response without one, from X-RateLimit-Reset. Retry-After is honoured on any response as Azure DevOps also sends it
+// with requests it delayed. Otherwise X-RateLimit-Delay, the seconds Azure DevOps held the request back for, holds
+// the calls back as long so they slow down before they are throttled. A time that has already passed, as clocks drift
+// apart, asks for no delay so the call is retried after the usual backoff
+func (r *retryingService) throttleDelay(status int, header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return r.until(at)
+		}
+	}
+	if status == http.StatusTooManyRequests || header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return r.until(time.Unix(reset, 0))
+		}
+	}
+	if seconds, err := strconv.ParseFloat(header.Get("X-RateLimit-Delay"), 64); err == nil && seconds > 0 && seconds < math.MaxInt64/float64(time.Second) {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return 0
+}
+
+// until returns how long is left before at, zero once it has passed
+func (r *retryingService) until(at time.Time) time.Duration {
+	if left := at.Sub(r.now()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// backoff returns the delay before the attempt after attempt, half of it random so calls that failed together don't
+// come back together
+func (r *retryingService) backoff(attempt int) time.Duration {
+	delay := r.policy.maxDelay
+	if shift := uint(attempt - 1); shift < 32 && r.policy.baseDelay<<shift < r.policy.maxDelay {
+		delay = r.policy.baseDelay << shift
+	}
+	return delay/2 + time.Duration(r.random(int64(delay/2)+1))
+}
+
+// spend takes delay from the retry budget and returns false, taking nothing, when there isn't enough of it left
+func (r *retryingService) spend(delay time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.spent+delay > r.policy.budget {
+		return false
+	}
+	r.spent += delay
+	return true
+}
+
+// pause holds every call to the organization back for d, an earlier pause that lasts longer is kept. Only the time a
+// pause adds is taken from the retry budget, however many calls wait for it, and false is returned without pausing
+// when there isn't enough budget left
+func (r *retryingService) pause(d time.Duration) bool {
+	now := r.now()
+	return r.pauses.extend(r.org, now, now.Add(d), r.spend)
+}
+
+func (r *retryingService) pauseRemaining() time.Duration {
+	return r.pauses.remaining(r.org, r.now())
+}
+
+// wait sleeps for d and counts it in the delay, it returns false if ctx is done first
+func (r *retryingService) wait(ctx context.Context, d time.Duration) bool {
+	atomic.AddInt64(&r.stats.delay, int64(d))
+	return r.sleep(ctx, d)
+}
+
+// GetProjects retries the wrapped Service's GetProjects
+func (r *retryingService) GetProjects(ctx context.Context) (response *core.GetProjectsResponseValue, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		response, err = r.Service.GetProjects(ctx)
+		return err
+	})
+	return response, err
+}
+
+// GetAdditionalProjects retries the wrapped Service's GetAdditionalProjects
+func (r *retryingService) GetAdditionalProjects(ctx context.Context, continuationToken string) (response *core.GetProjectsResponseValue, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		response, err = r.Service.GetAdditionalProjects(ctx, continuationToken)
+		return err
+	})
+	return response, err
+}
+
+// GetRepositories retries the wrapped Service's GetRepositories
+func (r *retryingService) GetRepositories(ctx context.Context, projectName string) (repos *[]git.GitRepository, disabled map[string]bool, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		repos, disabled, err = r.Service.GetRepositories(ctx, projectName)
+		return err
+	})
+	return repos, disabled, err
+}
+
+// GetRefs retries the wrapped Service's GetRefs
+func (r *retryingService) GetRefs(ctx context.Context, projectName string, repoName string, filter string) (refs *[]git.GitRef, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		refs, err = r.Service.GetRefs(ctx, projectName, repoName, filter)
+		return err
+	})
+	return refs, err
+}
+
+// GetItems retries the wrapped Service's GetItems
+func (r *retryingService) GetItems(ctx context.Context, projectName string, repoName string, version *git.GitVersionDescriptor) (items *[]git.GitItem, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		items, err = r.Service.GetItems(ctx, projectName, repoName, version)
+		return err
+	})
+	return items, err
+}
+
+// GetItemContent retries the wrapped Service's GetItemContent until the content is returned
+func (r *retryingService) GetItemContent(ctx context.Context, projectName string, repoName string, path string, version *git.GitVersionDescriptor) (content io.ReadCloser, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		content, err = r.Service.GetItemContent(ctx, projectName, repoName, path, version)
+		return err
+	})
+	return content, err
+}
+
+// GetBlobsZip retries the wrapped Service's GetBlobsZip until the archive is returned
+func (r *retryingService) GetBlobsZip(ctx context.Context, projectName string, repoName string, blobIDs []string) (content io.ReadCloser, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		content, err = r.Service.GetBlobsZip(ctx, projectName, repoName, blobIDs)
+		return err
+	})
+	return content, err
+}
+
+// GetCommits retries the wrapped Service's GetCommits
+func (r *retryingService) GetCommits(ctx context.Context, projectName string, repoName string, searchCriteria git.GitQueryCommitsCriteria) (commits *[]git.GitCommitRef, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		commits, err = r.Service.GetCommits(ctx, projectName, repoName, searchCriteria)
+		return err
+	})
+	return commits, err
+}
+
+// GetChanges retries the wrapped Service's GetChanges
+func (r *retryingService) GetChanges(ctx context.Context, projectName string, repoName string, commitID string) (changes *git.GitCommitChanges, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		changes, err = r.Service.GetChanges(ctx, projectName, repoName, commitID)
+		return err
+	})
+	return changes, err
+}
+
+// GetCommitDiffs retries the wrapped Service's GetCommitDiffs
+func (r *retryingService) GetCommitDiffs(ctx context.Context, projectName string, repoName string, baseCommit string, targetCommit string) (diffs *git.GitCommitDiffs, err error) {
+	err = r.do(ctx, func(ctx context.Context) (err error) {
+		diffs, err = r.Service.GetCommitDiffs(ctx, projectName, repoName, baseCommit, targetCommit)
+		return err
+	})
+	return diffs, err
+}
@@ -0,0 +1,240 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = retryPolicy{attempts: 3, budget: time.Minute, baseDelay: time.Second, maxDelay: 4 * time.Second}
+
+func statusError(status int) error {
+	message := http.StatusText(status)
+	return &azuredevops.WrappedError{StatusCode: &status, Message: &message}
+}
+
+// testRetryingService retries without sleeping or jitter on a clock of its own, the delays it would have slept for are
+// recorded and move the clock on
+func testRetryingService(service Service, policy retryPolicy) (*retryingService, *[]time.Duration) {
+	var delays []time.Duration
+	clock := time.Unix(1600000000, 0)
+	retrying := newRetryingService(service, policy, new(retryStats), nil, "")
+	retrying.now = func() time.Time { return clock }
+	retrying.sleep = func(_ context.Context, d time.Duration) bool {
+		delays = append(delays, d)
+		clock = clock.Add(d)
+		return true
+	}
+	retrying.random = func(int64) int64 { return 0 }
+	return retrying, &delays
+}
+
+func TestRetryingServiceRetriesTransientFailures(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(nil, nil, statusError(http.StatusServiceUnavailable)).Twice()
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	retrying, delays := testRetryingService(mockConnection, testRetryPolicy)
+
+	repos, _, err := retrying.GetRepositories(context.Background(), "Project0")
+	assert.Nil(t, err)
+	assert.Len(t, *repos, 1)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, *delays)
+	assert.Equal(t, &RetrySummary{Retries: 2, DelaySeconds: 1.5}, retrying.stats.summary())
+}
+
+func TestRetryingServiceLeavesOtherFailuresAlone(t *testing.T) {
+	for _, err := range []error{statusError(http.StatusNotFound), statusError(http.StatusUnauthorized), errors.New("TF401019")} {
+		mockConnection := new(mocks.Service)
+		mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", "heads/").Return(nil, err)
+		retrying, _ := testRetryingService(mockConnection, testRetryPolicy)
+
+		_, returned := retrying.GetRefs(context.Background(), "Project0", "Repo0", "heads/")
+		assert.Equal(t, err, returned)
+		mockConnection.AssertNumberOfCalls(t, GetRefsFuncName, 1)
+		assert.Nil(t, retrying.stats.summary())
+	}
+}
+
+func TestRetryingServiceGivesUp(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(nil, statusError(http.StatusBadGateway))
+	retrying, delays := testRetryingService(mockConnection, testRetryPolicy)
+
+	_, err := retrying.GetItems(context.Background(), "Project0", "Repo0", nil)
+	assert.Equal(t, statusError(http.StatusBadGateway), err)
+	mockConnection.AssertNumberOfCalls(t, GetItemsFuncName, testRetryPolicy.attempts)
+	assert.Len(t, *delays, testRetryPolicy.attempts-1)
+	assert.Equal(t, int64(1), retrying.stats.gaveUp)
+
+	// A backoff the budget can't cover isn't waited for
+	mockConnection = new(mocks.Service)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(nil, statusError(http.StatusBadGateway))
+	retrying, delays = testRetryingService(mockConnection, retryPolicy{attempts: 10, budget: 2 * time.Second, baseDelay: time.Second, maxDelay: time.Minute})
+	_, err = retrying.GetItems(context.Background(), "Project0", "Repo0", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, *delays)
+}
+
+func TestRetryingServiceStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetChangesFuncName, mock.Anything, "Project0", "Repo0", testMainCommit).
+		Return(nil, statusError(http.StatusServiceUnavailable)).Run(func(mock.Arguments) { cancel() })
+	retrying, _ := testRetryingService(mockConnection, testRetryPolicy)
+
+	_, err := retrying.GetChanges(ctx, "Project0", "Repo0", testMainCommit)
+	assert.NotNil(t, err)
+	mockConnection.AssertNumberOfCalls(t, GetChangesFuncName, 1)
+}
+
+func TestThrottleDelay(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	retrying := newRetryingService(nil, testRetryPolicy, new(retryStats), nil, "")
+	retrying.now = func() time.Time { return now }
+
+	for _, test := range []struct {
+		status   int
+		header   http.Header
+		expected time.Duration
+	}{
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{http.StatusOK, http.Header{"Retry-After": {"3"}}, 3 * time.Second},
+		{http.StatusServiceUnavailable, http.Header{"Retry-After": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}}, time.Minute},
+		{http.StatusTooManyRequests, http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()+20, 10)}}, 20 * time.Second},
+		{http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()+5, 10)}}, 5 * time.Second},
+		{http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"150"}, "X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()+5, 10)}}, 0},
+		{http.StatusServiceUnavailable, http.Header{}, 0},
+		{http.StatusServiceUnavailable, http.Header{"Retry-After": {now.Add(-time.Minute).UTC().Format(http.TimeFormat)}}, 0},
+		{http.StatusTooManyRequests, http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()-20, 10)}}, 0},
+		{http.StatusOK, http.Header{"X-Ratelimit-Delay": {"1.5"}}, 1500 * time.Millisecond},
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"7"}, "X-Ratelimit-Delay": {"1.5"}}, 7 * time.Second},
+		{http.StatusOK, http.Header{"X-Ratelimit-Delay": {"0"}}, 0},
+		{http.StatusOK, http.Header{"X-Ratelimit-Delay": {"soon"}}, 0},
+	} {
+		assert.Equal(t, test.expected, retrying.throttleDelay(test.status, test.header), test.header)
+	}
+}
+
+func TestRetryingServiceBacksOffWhenTheRateLimitResetHasPassed(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Run(func(args mock.Arguments) {
+		observed := args.Get(0).(context.Context).Value(responseObserverKey{}).(*observedResponse)
+		observed.record(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"X-Ratelimit-Reset": {"1599999990"}}})
+	}).Return(nil, statusError(http.StatusTooManyRequests)).Twice()
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	retrying, delays := testRetryingService(mockConnection, testRetryPolicy)
+
+	_, err := retrying.GetProjects(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, *delays)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&retrying.stats.throttled))
+}
+
+func TestPausesShareTheBudget(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	retrying := newRetryingService(nil, retryPolicy{attempts: 5, budget: 10 * time.Second}, new(retryStats), nil, "")
+	retrying.now = func() time.Time { return now }
+
+	assert.True(t, retrying.pause(6*time.Second))
+	// Calls throttled during the pause don't take from the budget again
+	assert.True(t, retrying.pause(5*time.Second))
+	assert.Equal(t, 6*time.Second, retrying.spent)
+	// Extending the pause only takes the time it adds
+	assert.True(t, retrying.pause(9*time.Second))
+	assert.Equal(t, 9*time.Second, retrying.spent)
+	assert.False(t, retrying.pause(12*time.Second))
+	assert.Equal(t, 9*time.Second, retrying.pauseRemaining())
+}
+
+func TestPausesAreSharedByTheScansOfAnOrganization(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	pauses := newOrgPauses()
+	scans := make([]*retryingService, 3)
+	for i, org := range []string{"https://dev.azure.com/itsals", "https://dev.azure.com/itsals", "https://dev.azure.com/other"} {
+		scans[i] = newRetryingService(nil, testRetryPolicy, new(retryStats), pauses, org)
+		scans[i].now = func() time.Time { return now }
+	}
+
+	assert.True(t, scans[0].pause(5*time.Second))
+	assert.Equal(t, 5*time.Second, scans[1].pauseRemaining())
+	assert.True(t, scans[2].pauseRemaining() <= 0)
+	// Only the scan that paused pays for it
+	assert.Equal(t, 5*time.Second, scans[0].spent)
+	assert.Equal(t, time.Duration(0), scans[1].spent)
+
+	// Pauses that are over are dropped
+	now = now.Add(time.Minute)
+	assert.True(t, scans[2].pause(time.Second))
+	assert.Len(t, pauses.until, 1)
+}
+
+func TestRetryingServiceHonoursRateLimitDelay(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Run(func(args mock.Arguments) {
+		observed := args.Get(0).(context.Context).Value(responseObserverKey{}).(*observedResponse)
+		observed.record(&http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Ratelimit-Delay": {"0.25"}}})
+	}).Return(getProjectTestData(1, ""), nil)
+	retrying, delays := testRetryingService(mockConnection, testRetryPolicy)
+
+	_, err := retrying.GetProjects(context.Background())
+	assert.Nil(t, err)
+	_, err = retrying.GetProjects(context.Background())
+	assert.Nil(t, err)
+	// The delay holds back the next call without counting as a retry
+	assert.Equal(t, []time.Duration{250 * time.Millisecond}, *delays)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&retrying.stats.retries))
+}
+
+func TestRetryingServiceHonoursRetryAfter(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	server.throttle = 2
+	service, err := NewAzureDevOpsService(server.URL+server.collection, "123", nil, nil)
+	assert.Nil(t, err)
+	retrying, delays := testRetryingService(service, testRetryPolicy)
+
+	projects, err := retrying.GetProjects(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, projects.Value, 1)
+	assert.Equal(t, []time.Duration{onPremRetryAfter, onPremRetryAfter}, *delays)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&retrying.stats.throttled))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&retrying.stats.retries))
+}
+
+func TestScanRetriesAndSummarizesRetries(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "File0", mock.Anything).
+		Return(nil, statusError(http.StatusTooManyRequests)).Once()
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "File0", mock.Anything).
+		Return(getItemContentTestData(), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.retry = retryPolicy{attempts: 3, budget: time.Second, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.Len(t, matchedFiles(results), 1)
+	assert.Equal(t, int64(1), results.Retries.Retries)
+	assert.Equal(t, int64(1), results.Retries.Throttled)
+	assert.True(t, results.Retries.DelaySeconds > 0)
+}
+
+func TestScanWithoutRetriesLeavesTheSummaryOut(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(&[]git.GitRepository{}, nil, nil)
+	results, err := sProjects(mockConnection).Scan()
+	assert.Nil(t, err)
+	assert.Nil(t, results.Retries)
+}
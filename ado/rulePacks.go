@@ -0,0 +1,218 @@
+package ado
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rule finds one kind of content, when group is set only that capture group is reported, the rest of the pattern is
+// context such as the name of the setting a secret is assigned to. A rule with a path only runs on the files it
+// matches and a line matching exclude is skipped by the rule
+type rule struct {
+	id          string
+	description string
+	severity    string
+	pattern     *regexp.Regexp
+	group       int
+	path        *regexp.Regexp
+	exclude     *regexp.Regexp
+}
+
+// appliesTo reports whether the rule runs on the file at path
+func (r rule) appliesTo(path string) bool {
+	return r.path == nil || r.path.MatchString(path)
+}
+
+// find returns the ranges of the line the rule matched, tagged with the rule's id, severity and description
+func (r rule) find(line string) []Range {
+	if r.exclude != nil && r.exclude.MatchString(line) {
+		return nil
+	}
+	var found []Range
+	for _, match := range r.pattern.FindAllStringSubmatchIndex(line, -1) {
+		start, end := match[2*r.group], match[2*r.group+1]
+		if start < 0 {
+			continue
+		}
+		found = append(found, Range{Start: start, End: end, RuleID: r.id, Severity: r.severity, Description: r.description})
+	}
+	return found
+}
+
+// rulePack is a named set of rules loaded from a file, digest changes whenever the file does so results found with an
+// older version of the pack are not read back from the cache
+type rulePack struct {
+	name   string
+	rules  []rule
+	digest string
+}
+
+// rulePacks are the packs a scan can select by name
+type rulePacks map[string]*rulePack
+
+// rulePackFile is the YAML or JSON a rule pack is written in, name defaults to the file name without its extension
+type rulePackFile struct {
+	Name  string               `yaml:"name" json:"name"`
+	Rules []ruleDefinitionFile `yaml:"rules" json:"rules"`
+}
+
+type ruleDefinitionFile struct {
+	ID          string `yaml:"id" json:"id"`
+	Description string `yaml:"description" json:"description"`
+	Severity    string `yaml:"severity" json:"severity"`
+	Pattern     string `yaml:"pattern" json:"pattern"`
+	Path        string `yaml:"path" json:"path"`
+	Exclude     string `yaml:"exclude" json:"exclude"`
+}
+
+// loadRulePacks reads every .yaml, .yml and .json file in directory as a rule pack, an empty directory name loads none
+func loadRulePacks(directory string) (rulePacks, error) {
+	packs := make(rulePacks)
+	if directory == "" {
+		return packs, nil
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		extension := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || (extension != ".yaml" && extension != ".yml" && extension != ".json") {
+			continue
+		}
+		path := filepath.Join(directory, file.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pack, err := parseRulePack(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), extension, content)
+		if err != nil {
+			return nil, fmt.Errorf("rule pack %s: %w", path, err)
+		}
+		if _, ok := packs[pack.name]; ok {
+			return nil, fmt.Errorf("rule pack %s: another file already defines the %q rule pack", path, pack.name)
+		}
+		packs[pack.name] = pack
+	}
+	return packs, nil
+}
+
+// parseRulePack decodes and compiles a rule pack, unknown fields are rejected so a misspelt field isn't silently ignored
+func parseRulePack(defaultName, extension string, content []byte) (*rulePack, error) {
+	var file rulePackFile
+	var err error
+	if extension == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&file)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(true)
+		err = dec.Decode(&file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pack := &rulePack{name: file.Name}
+	if pack.name == "" {
+		pack.name = defaultName
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("no rules defined")
+	}
+	ids := make(map[string]bool)
+	for _, definition := range file.Rules {
+		compiled, err := compileRule(definition)
+		if err != nil {
+			return nil, err
+		}
+		if ids[compiled.id] {
+			return nil, fmt.Errorf("rule %q is defined more than once", compiled.id)
+		}
+		ids[compiled.id] = true
+		pack.rules = append(pack.rules, compiled)
+	}
+
+	sum := sha256.Sum256(content)
+	pack.digest = hex.EncodeToString(sum[:])
+	return pack, nil
+}
+
+func compileRule(definition ruleDefinitionFile) (rule, error) {
+	compiled := rule{id: definition.ID, description: definition.Description, severity: definition.Severity}
+	if compiled.id == "" {
+		return rule{}, fmt.Errorf("every rule needs an id")
+	}
+	switch compiled.severity {
+	case "":
+		compiled.severity = SeverityMedium
+	case SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow:
+	default:
+		return rule{}, fmt.Errorf("rule %q has an unknown severity %q", compiled.id, compiled.severity)
+	}
+	if definition.Pattern == "" {
+		return rule{}, fmt.Errorf("rule %q needs a pattern", compiled.id)
+	}
+
+	var err error
+	compiled.pattern, err = regexp.Compile(definition.Pattern)
+	if err == nil && definition.Path != "" {
+		compiled.path, err = regexp.Compile(definition.Path)
+	}
+	if err == nil && definition.Exclude != "" {
+		compiled.exclude, err = regexp.Compile(definition.Exclude)
+	}
+	if err != nil {
+		return rule{}, fmt.Errorf("rule %q: %w", compiled.id, err)
+	}
+	return compiled, nil
+}
+
+// rulesFor returns the rules of the named packs that apply to the file at path
+func (packs rulePacks) rulesFor(names []string, path string) []rule {
+	var rules []rule
+	for _, name := range names {
+		for _, r := range packs[name].rules {
+			if r.appliesTo(path) {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules
+}
+
+// digests returns the digest of each of the named packs
+func (packs rulePacks) digests(names []string) []string {
+	digests := make([]string, 0, len(names))
+	for _, name := range names {
+		if pack, ok := packs[name]; ok {
+			digests = append(digests, pack.digest)
+		}
+	}
+	return digests
+}
+
+// rulesMatcher reports every match of the rules selected for a file
+type rulesMatcher struct {
+	rules []rule
+}
+
+func (m rulesMatcher) match(line string) (string, []Range) {
+	var ranges []Range
+	for _, r := range m.rules {
+		ranges = append(ranges, r.find(line)...)
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return line, ranges
+}
@@ -0,0 +1,172 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"context"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRulePackYAML = `
+name: platform
+rules:
+  - id: internal-hostname
+    description: Hostnames that must not leave the corporate network
+    severity: high
+    pattern: '[a-z0-9-]+\.corp\.example\.com'
+    exclude: 'docs\.corp\.example\.com'
+  - id: deprecated-http-client
+    description: The old HTTP client is being retired
+    severity: low
+    pattern: 'LegacyHttpClient\('
+    path: '\.cs$'
+`
+
+const testRulePackJSON = `{
+  "rules": [
+    {"id": "banned-config-key", "description": "Debug must be off in shipped config", "pattern": "EnableDebug\\s*=\\s*true", "path": "\\.config$"}
+  ]
+}`
+
+func writeRulePacks(t *testing.T, files map[string]string) string {
+	directory := tempCacheDirectory(t)
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return directory
+}
+
+func TestLoadRulePacks(t *testing.T) {
+	packs, err := loadRulePacks(writeRulePacks(t, map[string]string{
+		"platform.yaml": testRulePackYAML,
+		"config.json":   testRulePackJSON,
+		"README.md":     "not a rule pack",
+	}))
+	assert.Nil(t, err)
+	assert.Len(t, packs, 2)
+
+	platform := packs["platform"]
+	assert.Len(t, platform.rules, 2)
+	assert.Equal(t, "internal-hostname", platform.rules[0].id)
+	assert.Equal(t, SeverityHigh, platform.rules[0].severity)
+	assert.NotEmpty(t, platform.digest)
+
+	config := packs["config"]
+	assert.Equal(t, "banned-config-key", config.rules[0].id)
+	assert.Equal(t, SeverityMedium, config.rules[0].severity)
+}
+
+func TestLoadRulePacksWithoutADirectory(t *testing.T) {
+	packs, err := loadRulePacks("")
+	assert.Nil(t, err)
+	assert.Empty(t, packs)
+}
+
+func TestLoadRulePacksRejectsInvalidPacks(t *testing.T) {
+	for content, message := range map[string]string{
+		"rules:\n  - id: a\n    pattern: '('\n":                          `rule "a": error parsing regexp`,
+		"rules:\n  - id: a\n    pattern: x\n    severity: urgent\n":      `rule "a" has an unknown severity "urgent"`,
+		"rules:\n  - id: a\n    pattern: x\n  - id: a\n    pattern: y\n": `rule "a" is defined more than once`,
+		"rules:\n  - description: no id\n    pattern: x\n":               "every rule needs an id",
+		"rules:\n  - id: a\n":               `rule "a" needs a pattern`,
+		"rules:\n  - id: a\n    regex: x\n": "field regex not found",
+		"name: empty\n":                     "no rules defined",
+	} {
+		_, err := loadRulePacks(writeRulePacks(t, map[string]string{"pack.yml": content}))
+		if assert.NotNil(t, err, content) {
+			assert.Contains(t, err.Error(), message, content)
+		}
+	}
+}
+
+func TestLoadRulePacksRejectsDuplicateNames(t *testing.T) {
+	_, err := loadRulePacks(writeRulePacks(t, map[string]string{
+		"platform.yaml": testRulePackYAML,
+		"other.yaml":    "name: platform\nrules:\n  - id: a\n    pattern: x\n",
+	}))
+	assert.Contains(t, err.Error(), `another file already defines the "platform" rule pack`)
+}
+
+func TestRulesMatcherRecordsWhichRuleFired(t *testing.T) {
+	packs, err := loadRulePacks(writeRulePacks(t, map[string]string{"platform.yaml": testRulePackYAML}))
+	assert.Nil(t, err)
+
+	matcher := rulesMatcher{rules: packs.rulesFor([]string{"platform"}, "/src/Client.cs")}
+	line, ranges := matcher.match(`var client = new LegacyHttpClient("https://build-01.corp.example.com");`)
+	assert.Equal(t, `var client = new LegacyHttpClient("https://build-01.corp.example.com");`, line)
+	assert.Equal(t, []Range{
+		{Start: 17, End: 34, RuleID: "deprecated-http-client", Severity: SeverityLow, Description: "The old HTTP client is being retired"},
+		{Start: 43, End: 68, RuleID: "internal-hostname", Severity: SeverityHigh, Description: "Hostnames that must not leave the corporate network"},
+	}, ranges)
+
+	_, ranges = matcher.match(`see https://docs.corp.example.com and build-01.corp.example.com`)
+	assert.Empty(t, ranges)
+
+	matcher = rulesMatcher{rules: packs.rulesFor([]string{"platform"}, "/README.md")}
+	_, ranges = matcher.match(`new LegacyHttpClient(`)
+	assert.Empty(t, ranges)
+}
+
+func TestScanWithRulePacks(t *testing.T) {
+	packs, err := loadRulePacks(writeRulePacks(t, map[string]string{"config.json": testRulePackJSON}))
+	assert.Nil(t, err)
+
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemsWithPaths("/web.config", "/File.txt"), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return ioutil.NopCloser(strings.NewReader("Content\nEnableDebug = true\n"))
+		}, nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.FileNamePattern = ""
+	scanProjects.criteria.ContentPattern = ""
+	scanProjects.criteria.RulePacks = []string{"config"}
+	scanProjects.rulePacks = packs
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	assert.Len(t, files, 1)
+	assert.Equal(t, "/web.config", files[0].Name)
+	assert.Equal(t, []Range{{
+		Start:       0,
+		End:         18,
+		RuleID:      "banned-config-key",
+		Severity:    SeverityMedium,
+		Description: "Debug must be off in shipped config",
+		Fingerprint: testFingerprint("", "Project0", "Repo0", "/web.config", "banned-config-key", "EnableDebug = true"),
+	}}, *(*files[0].Lines)[0].Ranges)
+}
+
+func TestPostValidatesRulePacks(t *testing.T) {
+	packs, err := loadRulePacks(writeRulePacks(t, map[string]string{"platform.yaml": testRulePackYAML}))
+	assert.Nil(t, err)
+	assertPostValidates(t, API{rulePacks: packs}, []criteriaCase{
+		{`{"RulePacks":["missing"]}`, `unknown rule pack "missing"`},
+		{`{"RulePacks":["platform"],"ContentPattern":"x"}`, "ContentPattern can't be used with RulePacks"},
+		{`{"RulePacks":["platform"],"Mode":"secrets"}`, `RulePacks can't be used in "secrets" mode`},
+		{`{"RulePacks":["platform"]}`, ""},
+	})
+}
+
+func TestCacheKeyChangesWithTheRulePack(t *testing.T) {
+	criteria := &SearchCriteria{RulePacks: []string{"platform"}}
+	before, err := loadRulePacks(writeRulePacks(t, map[string]string{"platform.yaml": testRulePackYAML}))
+	assert.Nil(t, err)
+	after, err := loadRulePacks(writeRulePacks(t, map[string]string{"platform.yaml": testRulePackYAML + "  - id: another\n    pattern: x\n"}))
+	assert.Nil(t, err)
+
+	beforeKey, _ := cacheKey("itsals", "123", criteria, before, nil)
+	afterKey, _ := cacheKey("itsals", "123", criteria, after, nil)
+	assert.NotEqual(t, beforeKey, afterKey)
+}
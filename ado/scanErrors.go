@@ -0,0 +1,75 @@
+package ado
+
+import (
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"sync"
+)
+
+// Operations that can fail during a scan, used to fill in ScanError.Operation
+const (
+	OperationGetProjects     = "GetProjects"
+	OperationGetRepositories = "GetRepositories"
+	OperationGetRefs         = "GetRefs"
+	OperationGetItems        = "GetItems"
+	OperationGetItemContent  = "GetItemContent"
+	OperationGetBlobsZip     = "GetBlobsZip"
+	OperationReadArchive     = "ReadArchive"
+	OperationGetCommits      = "GetCommits"
+	OperationGetChanges      = "GetChanges"
+	OperationReadContent     = "ReadContent"
+	OperationScan            = "Scan"
+)
+
+// scanErrors collects the failures from every goroutine of a scan so they can be reported alongside the results
+type scanErrors struct {
+	mutex  sync.Mutex
+	errors []ScanError
+}
+
+func (e *scanErrors) add(operation, project, repository, path string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.errors = append(e.errors, ScanError{
+		Project:    project,
+		Repository: repository,
+		Path:       path,
+		Operation:  operation,
+		Message:    err.Error(),
+		StatusCode: statusCode(err),
+	})
+}
+
+// countFor returns how many failures were collected for the repository of the project
+func (e *scanErrors) countFor(project, repository string) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	count := 0
+	for _, scanError := range e.errors {
+		if scanError.Project == project && scanError.Repository == repository {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *scanErrors) list() []ScanError {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	list := make([]ScanError, len(e.errors))
+	copy(list, e.errors)
+	return list
+}
+
+// statusCode returns the HTTP status Azure DevOps responded with or zero when the error did not come from a response
+func statusCode(err error) int {
+	var wrappedError azuredevops.WrappedError
+	if errors.As(err, &wrappedError) && wrappedError.StatusCode != nil {
+		return *wrappedError.StatusCode
+	}
+	var wrappedErrorPtr *azuredevops.WrappedError
+	if errors.As(err, &wrappedErrorPtr) && wrappedErrorPtr.StatusCode != nil {
+		return *wrappedErrorPtr.StatusCode
+	}
+	return 0
+}
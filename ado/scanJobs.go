@@ -0,0 +1,480 @@
+package ado
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// States a ScanJob moves through, Cancelling is only reported while a running scan is waiting to notice the request
+const (
+	ScanJobQueued     = "queued"
+	ScanJobRunning    = "running"
+	ScanJobCancelling = "cancelling"
+	ScanJobCompleted  = "completed"
+	ScanJobFailed     = "failed"
+	ScanJobCancelled  = "cancelled"
+)
+
+const scanJobTTL = time.Hour * 24
+
+const defaultMaxRunningScanJobs = 4
+
+// scanJobProgressInterval is how often a running job publishes its progress and checks whether it was cancelled
+var scanJobProgressInterval = time.Second
+
+// scanJobStaleAfter is how long an unfinished job can go without publishing progress before it is reported as failed,
+// the replica running it has stopped
+var scanJobStaleAfter = time.Minute
+
+var (
+	errScanJobStale       = errors.New("the scan stopped reporting progress")
+	errScanJobInterrupted = errors.New("the server shut down before the scan finished")
+)
+
+// ScanJob is the state of an asynchronous scan, it is kept in the Cache so with redis any replica can report on it
+type ScanJob struct {
+	ID        string
+	State     string
+	Progress  Progress
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Owner is who started the scan, it is stored with the job but never written to responses
+	Owner *scanJobOwner `json:",omitempty"`
+}
+
+// scanJobOwner identifies the caller that started a scan job, only the same token on the same collection can see or
+// cancel it as its results hold lines from the repositories that token can read
+type scanJobOwner struct {
+	Collection string
+	Identity   string
+}
+
+func newScanJobOwner(org, personalAccessToken string) *scanJobOwner {
+	return &scanJobOwner{Collection: org, Identity: tokenFingerprint(personalAccessToken)}
+}
+
+func (owner *scanJobOwner) equal(other *scanJobOwner) bool {
+	return owner != nil && other != nil && *owner == *other
+}
+
+func (job *ScanJob) finished() bool {
+	return job.State == ScanJobCompleted || job.State == ScanJobFailed || job.State == ScanJobCancelled
+}
+
+// scanJobStore keeps scan jobs and cancellation requests in jobs and their results in results. A job must not be
+// evicted while it runs so it is only kept with the results when they share a cache that doesn't evict
+type scanJobStore struct {
+	jobs    Cache
+	results Cache
+	runner  *scanJobRunner
+}
+
+// newScanJobStore creates the store for the server's Cache, jobs get a cache of their own when the Cache evicts to stay
+// within a bound. At most maxRunning jobs run on this replica at once
+func newScanJobStore(cache Cache, maxRunning int) (scanJobStore, error) {
+	store := scanJobStore{jobs: cache, results: cache, runner: newScanJobRunner(maxRunning)}
+	switch bounded := cache.(type) {
+	case *MemoryCache:
+		if bounded.maxBytes > 0 {
+			store.jobs = NewMemoryCache(0)
+		}
+	case *FileCache:
+		if bounded.maxBytes > 0 {
+			jobs, err := NewFileCache(filepath.Join(bounded.directory, "jobs"))
+			if err != nil {
+				return scanJobStore{}, err
+			}
+			store.jobs = jobs
+		}
+	}
+	return store, nil
+}
+
+func scanJobKey(id string) string {
+	return fmt.Sprintf("scanjob:%s", id)
+}
+
+func scanJobResultsKey(id string) string {
+	return fmt.Sprintf("scanjob:%s:results", id)
+}
+
+func scanJobCancelKey(id string) string {
+	return fmt.Sprintf("scanjob:%s:cancel", id)
+}
+
+func (store scanJobStore) save(job *ScanJob) error {
+	job.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return store.jobs.Set(scanJobKey(job.ID), value, scanJobTTL)
+}
+
+// get returns nil when the job does not exist, a pending cancellation is reported as ScanJobCancelling and a job that
+// stopped publishing progress as ScanJobFailed
+func (store scanJobStore) get(id string) (*ScanJob, error) {
+	value, err := store.jobs.Get(scanJobKey(id))
+	if err == ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job ScanJob
+	err = json.Unmarshal(value, &job)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.finished() && time.Since(job.UpdatedAt) > scanJobStaleAfter {
+		job.State = ScanJobFailed
+		job.Error = errScanJobStale.Error()
+	}
+	if !job.finished() {
+		cancelled, err := store.cancelRequested(id)
+		if err != nil {
+			return nil, err
+		}
+		if cancelled {
+			job.State = ScanJobCancelling
+		}
+	}
+	return &job, nil
+}
+
+func (store scanJobStore) saveResults(id string, results []byte) error {
+	return store.results.Set(scanJobResultsKey(id), results, scanJobTTL)
+}
+
+func (store scanJobStore) getResults(id string) ([]byte, error) {
+	return store.results.Get(scanJobResultsKey(id))
+}
+
+// requestCancel is kept separate from the job so the running replica can't overwrite it when publishing progress
+func (store scanJobStore) requestCancel(id string) error {
+	return store.jobs.Set(scanJobCancelKey(id), []byte("1"), scanJobTTL)
+}
+
+func (store scanJobStore) cancelRequested(id string) (bool, error) {
+	_, err := store.jobs.Get(scanJobCancelKey(id))
+	if err == ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (api *API) postScanHandler(store scanJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		org, personalAccessToken, criteria := api.decodeScanRequest(w, r)
+		if criteria == nil {
+			return
+		}
+
+		job := &ScanJob{
+			ID:        uuid.New().String(),
+			State:     ScanJobQueued,
+			CreatedAt: time.Now().UTC(),
+			Owner:     newScanJobOwner(org, personalAccessToken),
+		}
+		ctx, err := store.runner.start(job.ID)
+		if err == errScanJobsFull {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		err = store.save(job)
+		if err != nil {
+			store.runner.finish(job.ID)
+			api.logger.LogError(err)
+			log.Println(err)
+			http.Error(w, "unable to store scan job", http.StatusServiceUnavailable)
+			return
+		}
+
+		go api.runScanJob(ctx, store, *job, org, personalAccessToken, criteria)
+
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/scans/%s", job.ID))
+		api.writeScanJob(w, http.StatusAccepted, job)
+	}
+}
+
+func (api *API) getScanHandler(store scanJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		job := api.lookupScanJob(w, r, store)
+		if job == nil {
+			return
+		}
+		api.writeScanJob(w, http.StatusOK, job)
+	}
+}
+
+func (api *API) getScanResultsHandler(store scanJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		job := api.lookupScanJob(w, r, store)
+		if job == nil {
+			return
+		}
+		if job.State != ScanJobCompleted {
+			http.Error(w, fmt.Sprintf("Scan is %s", job.State), http.StatusConflict)
+			return
+		}
+
+		results, err := store.getResults(job.ID)
+		if err == ErrCacheMiss {
+			http.Error(w, "Scan results are no longer available", http.StatusGone)
+			return
+		}
+		if err != nil {
+			api.logger.LogError(err)
+			log.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if format := streamFormat(r); format != "" {
+			api.replayResults(r.Context(), w, format, results)
+			return
+		}
+		api.processResponse(w, results)
+	}
+}
+
+func (api *API) deleteScanHandler(store scanJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		job := api.lookupScanJob(w, r, store)
+		if job == nil {
+			return
+		}
+		if job.finished() {
+			http.Error(w, fmt.Sprintf("Scan is already %s", job.State), http.StatusConflict)
+			return
+		}
+
+		err := store.requestCancel(job.ID)
+		if err != nil {
+			api.logger.LogError(err)
+			log.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		job.State = ScanJobCancelling
+		api.writeScanJob(w, http.StatusAccepted, job)
+	}
+}
+
+// lookupScanJob writes the error response and returns nil when the job can't be found, a job started by another
+// caller is reported as not found so its ID can't be used to tell whether it exists
+func (api *API) lookupScanJob(w http.ResponseWriter, r *http.Request, store scanJobStore) *ScanJob {
+	org, personalAccessToken, ok := api.decodeCaller(w, r)
+	if !ok {
+		return nil
+	}
+	job, err := store.get(mux.Vars(r)["id"])
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+	if job == nil || !job.Owner.equal(newScanJobOwner(org, personalAccessToken)) {
+		http.Error(w, "Scan not found", http.StatusNotFound)
+		return nil
+	}
+	return job
+}
+
+func (api *API) writeScanJob(w http.ResponseWriter, status int, job *ScanJob) {
+	public := *job
+	public.Owner = nil
+	value, err := json.Marshal(public)
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(value)
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+	}
+}
+
+// runScanJob runs the scan in the background, publishing progress to the store until it finishes, is cancelled or the
+// runner shuts down
+func (api *API) runScanJob(ctx context.Context, store scanJobStore, job ScanJob, org, personalAccessToken string, criteria *SearchCriteria) {
+	defer store.runner.finish(job.ID)
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := new(Progress)
+	job.State = ScanJobRunning
+	api.saveScanJob(store, &job)
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go api.watchScanJob(store, job, progress, cancel, done, &wg)
+
+	results, err := api.scan(scanCtx, org, personalAccessToken, criteria, progress, nil)
+	close(done)
+	wg.Wait()
+
+	job.Progress = progress.Snapshot()
+	cancelled, cancelErr := store.cancelRequested(job.ID)
+	if cancelErr != nil {
+		api.logger.LogError(cancelErr)
+		log.Println(cancelErr)
+	}
+
+	switch {
+	case cancelled:
+		job.State = ScanJobCancelled
+	case ctx.Err() != nil:
+		job.State = ScanJobFailed
+		job.Error = errScanJobInterrupted.Error()
+	case err != nil:
+		job.State = ScanJobFailed
+		job.Error = err.Error()
+	default:
+		job.State = ScanJobCompleted
+		err = api.saveScanJobResults(store, job.ID, results)
+		if err != nil {
+			job.State = ScanJobFailed
+			job.Error = err.Error()
+		}
+	}
+	api.saveScanJob(store, &job)
+}
+
+// watchScanJob publishes progress on an interval and cancels the scan once a cancellation has been requested
+func (api *API) watchScanJob(store scanJobStore, job ScanJob, progress *Progress, cancel context.CancelFunc, done chan struct{}, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+
+	ticker := time.NewTicker(scanJobProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cancelled, err := store.cancelRequested(job.ID)
+			if err != nil {
+				api.logger.LogError(err)
+				log.Println(err)
+			}
+			if cancelled {
+				cancel()
+				return
+			}
+			job.Progress = progress.Snapshot()
+			api.saveScanJob(store, &job)
+		}
+	}
+}
+
+func (api *API) saveScanJob(store scanJobStore, job *ScanJob) {
+	err := store.save(job)
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+	}
+}
+
+func (api *API) saveScanJobResults(store scanJobStore, id string, results *Results) error {
+	value, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	if err := store.saveResults(id, value); err != nil {
+		return fmt.Errorf("unable to store the results: %w", err)
+	}
+	return nil
+}
+
+var (
+	errScanJobsFull     = errors.New("too many scans are running, try again later")
+	errScanJobsStopping = errors.New("the server is shutting down")
+)
+
+// scanJobRunner tracks the jobs running on this replica, it turns new jobs away once limit are running and cancels the
+// running ones when the server shuts down
+type scanJobRunner struct {
+	mutex   sync.Mutex
+	limit   int
+	running map[string]context.CancelFunc
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newScanJobRunner(limit int) *scanJobRunner {
+	return &scanJobRunner{limit: limit, running: make(map[string]context.CancelFunc)}
+}
+
+// start reserves a place for the job, the returned context is cancelled when the runner shuts down
+func (runner *scanJobRunner) start(id string) (context.Context, error) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	if runner.stopped {
+		return nil, errScanJobsStopping
+	}
+	if len(runner.running) >= runner.limit {
+		return nil, errScanJobsFull
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runner.running[id] = cancel
+	runner.wg.Add(1)
+	return ctx, nil
+}
+
+func (runner *scanJobRunner) finish(id string) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	if cancel, ok := runner.running[id]; ok {
+		cancel()
+		delete(runner.running, id)
+		runner.wg.Done()
+	}
+}
+
+// shutdown refuses new jobs, cancels the running ones and waits for them to record that they were interrupted
+func (runner *scanJobRunner) shutdown() {
+	runner.mutex.Lock()
+	runner.stopped = true
+	for _, cancel := range runner.running {
+		cancel()
+	}
+	runner.mutex.Unlock()
+
+	runner.wg.Wait()
+}
@@ -0,0 +1,300 @@
+package ado
+
+import (
+	mocks "adoscanner/mocks/ado"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRedisClient() redis.Cmdable {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	return redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+}
+
+func ScanRouter(mockConnection *mocks.Service, client redis.Cmdable, mockLogging *mocks.Logging) *mux.Router {
+	api := API{
+		serviceFactory: staticServiceFactory{service: mockConnection},
+		logger:         mockLogging,
+	}
+
+	store, _ := newScanJobStore(NewRedisCache(client), defaultMaxRunningScanJobs)
+	return scanJobRouter(api, store)
+}
+
+func scanJobRouter(api API, store scanJobStore) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/scans", api.postScanHandler(store)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/scans/{id}", api.getScanHandler(store)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/scans/{id}/results", api.getScanResultsHandler(store)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/scans/{id}", api.deleteScanHandler(store)).Methods(http.MethodDelete)
+	return router
+}
+
+func postScan(t *testing.T, router *mux.Router) ScanJob {
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"File","ContentPattern":"Content"}`)
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/scans", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var job ScanJob
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	assert.Equal(t, "/api/v1/scans/"+job.ID, rr.Header().Get("Location"))
+	return job
+}
+
+func getScan(router *mux.Router, path string) *httptest.ResponseRecorder {
+	return getScanAs(router, path, "itsals", "123")
+}
+
+func getScanAs(router *mux.Router, path, org, pat string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	req.Header.Add("Org", org)
+	req.Header.Add("PAT", pat)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func waitForScanState(t *testing.T, router *mux.Router, id string, state string) ScanJob {
+	var job ScanJob
+	assert.Eventually(t, func() bool {
+		rr := getScan(router, "/api/v1/scans/"+id)
+		if rr.Code != http.StatusOK {
+			return false
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &job)
+		return job.State == state
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestPostScanRequiresOrgHeader(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockLogging := new(mocks.Logging)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/scans", bytes.NewBuffer([]byte(`{}`)))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	ScanRouter(mockConnection, newTestRedisClient(), mockLogging).ServeHTTP(rr, req)
+	assert.Equal(t, 400, rr.Code)
+	assert.Equal(t, "Org header is required\n", rr.Body.String())
+}
+
+func TestPostScanCompletesAndReturnsResults(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
+	mockLogging := new(mocks.Logging)
+	router := ScanRouter(mockConnection, newTestRedisClient(), mockLogging)
+
+	job := postScan(t, router)
+	assert.Equal(t, ScanJobQueued, job.State)
+
+	waitForScanState(t, router, job.ID, ScanJobCompleted)
+
+	rr := getScan(router, "/api/v1/scans/"+job.ID+"/results")
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, `{"Projects":[],"Errors":[],"Incomplete":false}`, rr.Body.String())
+	mockConnection.AssertExpectations(t)
+}
+
+func TestPostScanReportsFailure(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(nil, assert.AnError)
+	mockLogging := new(mocks.Logging)
+	router := ScanRouter(mockConnection, newTestRedisClient(), mockLogging)
+
+	job := postScan(t, router)
+	job = waitForScanState(t, router, job.ID, ScanJobFailed)
+	assert.Equal(t, assert.AnError.Error(), job.Error)
+
+	rr := getScan(router, "/api/v1/scans/"+job.ID+"/results")
+	assert.Equal(t, 409, rr.Code)
+	assert.Equal(t, "Scan is failed\n", rr.Body.String())
+}
+
+func TestDeleteScanCancelsRunningScan(t *testing.T) {
+	scanJobProgressInterval = 10 * time.Millisecond
+	defer func() { scanJobProgressInterval = time.Second }()
+
+	release := make(chan time.Time)
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(2, ""), nil).WaitUntil(release)
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogWarning", mock.Anything)
+	router := ScanRouter(mockConnection, newTestRedisClient(), mockLogging)
+
+	job := postScan(t, router)
+	waitForScanState(t, router, job.ID, ScanJobRunning)
+
+	req, _ := http.NewRequest(http.MethodDelete, "/api/v1/scans/"+job.ID, nil)
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	waitForScanState(t, router, job.ID, ScanJobCancelling)
+
+	// Give the job time to notice the cancellation before the projects are returned
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	job = waitForScanState(t, router, job.ID, ScanJobCancelled)
+	assert.Equal(t, int64(2), job.Progress.ProjectsTotal)
+	mockConnection.AssertNumberOfCalls(t, "GetRepositories", 0)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, "Scan is already cancelled\n", rr.Body.String())
+}
+
+func TestGetScanNotFound(t *testing.T) {
+	router := ScanRouter(new(mocks.Service), newTestRedisClient(), new(mocks.Logging))
+
+	rr := getScan(router, "/api/v1/scans/missing")
+	assert.Equal(t, 404, rr.Code)
+	assert.Equal(t, "Scan not found\n", rr.Body.String())
+
+	rr = getScan(router, "/api/v1/scans/missing/results")
+	assert.Equal(t, 404, rr.Code)
+}
+
+func TestScanJobsAreOnlyVisibleToTheirCaller(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
+	router := ScanRouter(mockConnection, newTestRedisClient(), new(mocks.Logging))
+
+	job := postScan(t, router)
+	waitForScanState(t, router, job.ID, ScanJobCompleted)
+
+	for _, caller := range []struct{ org, pat string }{{"itsals", "456"}, {"other", "123"}} {
+		for _, path := range []string{"/api/v1/scans/" + job.ID, "/api/v1/scans/" + job.ID + "/results"} {
+			rr := getScanAs(router, path, caller.org, caller.pat)
+			assert.Equal(t, http.StatusNotFound, rr.Code)
+			assert.Equal(t, "Scan not found\n", rr.Body.String())
+		}
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/v1/scans/"+job.ID, nil)
+		req.Header.Add("Org", caller.org)
+		req.Header.Add("PAT", caller.pat)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	}
+
+	rr := getScan(router, "/api/v1/scans/"+job.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "Owner")
+
+	rr = getScanAs(router, "/api/v1/scans/"+job.ID, "", "123")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestScanJobsOutliveResultsEvictedFromAMemoryCache(t *testing.T) {
+	store, err := newScanJobStore(NewMemoryCache(200), defaultMaxRunningScanJobs)
+	assert.Nil(t, err)
+	assert.NotEqual(t, store.results, store.jobs)
+
+	running := &ScanJob{ID: "running", State: ScanJobRunning}
+	assert.Nil(t, store.save(running))
+	assert.Nil(t, store.requestCancel(running.ID))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, store.saveResults(fmt.Sprintf("job%d", i), bytes.Repeat([]byte("x"), 100)))
+	}
+
+	job, err := store.get(running.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ScanJobCancelling, job.State)
+	_, err = store.getResults("job0")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestScanJobFailsWhenItsResultsCanNotBeStored(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
+	store, err := newScanJobStore(NewMemoryCache(10), defaultMaxRunningScanJobs)
+	assert.Nil(t, err)
+	router := scanJobRouter(API{serviceFactory: staticServiceFactory{service: mockConnection}, logger: new(mocks.Logging)}, store)
+
+	job := postScan(t, router)
+	job = waitForScanState(t, router, job.ID, ScanJobFailed)
+	assert.Equal(t, "unable to store the results: "+ErrCacheValueTooLarge.Error(), job.Error)
+}
+
+func TestPostScanIsRefusedWhileTooManyScansRunAndAfterShutdown(t *testing.T) {
+	release := make(chan time.Time)
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(new(core.GetProjectsResponseValue), nil).WaitUntil(release)
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogWarning", mock.Anything)
+	store, err := newScanJobStore(NewMemoryCache(0), 1)
+	assert.Nil(t, err)
+	router := scanJobRouter(API{serviceFactory: staticServiceFactory{service: mockConnection}, logger: mockLogging}, store)
+
+	job := postScan(t, router)
+	waitForScanState(t, router, job.ID, ScanJobRunning)
+
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"File","ContentPattern":"Content"}`)
+	post := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/scans", bytes.NewBuffer(jsonCriteria))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Org", "itsals")
+		req.Header.Add("PAT", "123")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := post()
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, errScanJobsFull.Error()+"\n", rr.Body.String())
+
+	stopped := make(chan struct{})
+	go func() {
+		store.runner.shutdown()
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool { return post().Code == http.StatusServiceUnavailable }, time.Second, time.Millisecond)
+	close(release)
+	<-stopped
+
+	job = waitForScanState(t, router, job.ID, ScanJobFailed)
+	assert.Equal(t, errScanJobInterrupted.Error(), job.Error)
+}
+
+func TestScanJobThatStoppedReportingProgressIsFailed(t *testing.T) {
+	store, err := newScanJobStore(NewMemoryCache(0), defaultMaxRunningScanJobs)
+	assert.Nil(t, err)
+	value, _ := json.Marshal(ScanJob{ID: "stale", State: ScanJobRunning, UpdatedAt: time.Now().Add(-2 * scanJobStaleAfter)})
+	assert.Nil(t, store.jobs.Set(scanJobKey("stale"), value, scanJobTTL))
+	assert.Nil(t, store.requestCancel("stale"))
+
+	job, err := store.get("stale")
+	assert.Nil(t, err)
+	assert.Equal(t, ScanJobFailed, job.State)
+	assert.Equal(t, errScanJobStale.Error(), job.Error)
+
+	assert.Nil(t, store.save(&ScanJob{ID: "live", State: ScanJobRunning}))
+	job, err = store.get("live")
+	assert.Nil(t, err)
+	assert.Equal(t, ScanJobRunning, job.State)
+}
@@ -2,69 +2,163 @@ package ado
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"context"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/core"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
 	"io"
+	"io/ioutil"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // ScanProjects uses the Service interface to interact with Azure DevOps and does all the heavy lifting to find data
 type ScanProjects struct {
+	ctx        context.Context
 	adoService Service
-	criteria   *SearchCriteria
-	logger Logging
+	// service is the Service the scan was created with, every Scan wraps it in limits and retries of its own as
+	// adoService
+	service     Service
+	criteria    *SearchCriteria
+	logger      Logging
+	progress    *Progress
+	concurrency Concurrency
+	limits      scanLimits
+	rulePacks   rulePacks
+	baseline    *baseline
+	// defaultExclusions are the server's default path exclusions, exclusions the scan's compiled Exclude patterns
+	defaultExclusions *regexp.Regexp
+	exclusions        exclusions
+	patterns          patterns
+	skipped           skippedRepositories
+	// maxArchiveSize is the largest repository, in bytes, whose files are fetched in one archive when the criteria
+	// leave the choice to the server, zero fetches them one at a time
+	maxArchiveSize int64
+	// retry is the server's retry policy and retries counts what retrying the scan's calls took
+	retry   retryPolicy
+	retries retryStats
+	// pauses are the server's throttling pauses of each organization, nil pauses the scan on its own, and org is the
+	// collection URL of the scan's
+	pauses *orgPauses
+	org    string
+	// state is what incremental scans remember of each repository, nil when the scan reads every file
+	state *incrementalState
+	// blobs is the server's blob cache, nil when it is off, and blobStats counts how the scan's lookups went
+	blobs     *blobCache
+	blobStats blobCacheStats
+	errors    scanErrors
+	onItem    func(projectName string, repository Repository, item Item)
 }
 
 // Scan triggers the scan and aggregates all the Results into the Results struct for easy JSON marshaling to client
 func (s *ScanProjects) Scan() (*Results, error) {
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	if s.progress == nil {
+		s.progress = new(Progress)
+	}
+	s.ctx = withRoundTripCounter(s.ctx, &s.progress.RoundTrips)
+	if s.concurrency == (Concurrency{}) {
+		s.concurrency = defaultConcurrency
+	}
+	if s.retry == (retryPolicy{}) {
+		s.retry = defaultRetryPolicy
+	}
+	if s.baseline == nil {
+		s.baseline = newBaseline("", nil, s.criteria.Baseline)
+	}
+	exclusions, err := newExclusions(s.criteria, s.defaultExclusions)
+	if err != nil {
+		return nil, err
+	}
+	s.exclusions = exclusions
+	s.patterns, err = newPatterns(s.criteria)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := s.criteria.Concurrency.within(s.concurrency)
+	s.limits = newScanLimits(concurrency)
+	if s.service == nil {
+		s.service = s.adoService
+	}
+	// Every HTTP request holds a slot until its response has been read, a call waiting to be retried holds none
+	s.ctx = withRequestLimit(s.ctx, newLimiter(concurrency.Requests))
+	s.adoService = newRetryingService(s.service, s.retry, &s.retries, s.pauses, s.org)
+
 	projectsToScan, err := s.getProjects()
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddInt64(&s.progress.ProjectsTotal, int64(len(projectsToScan)))
 
-	errs := make(chan error)
 	ch := make(chan Project, len(projectsToScan))
 	wg := sync.WaitGroup{}
 	projects := make([]Project, 0, len(projectsToScan))
 
 	for _, project := range projectsToScan {
+		if !s.limits.projects.acquire(s.ctx) {
+			break
+		}
 		wg.Add(1)
-		go s.findContent(project.Name, ch, errs, &wg)
+		go s.findContent(project.Name, ch, &wg)
 	}
 
 	wg.Wait()
 	close(ch)
-	close(errs)
 
 	for proj := range ch {
 		projects = append(projects, proj)
 	}
 
-	return &Results{Projects: &projects}, nil
+	if s.cancelled() {
+		s.errors.add(OperationScan, "", "", "", s.ctx.Err())
+	}
+
+	errors := s.errors.list()
+	results := &Results{
+		Projects:   &projects,
+		Errors:     &errors,
+		Incomplete: len(errors) > 0,
+	}
+	if skipped := s.skipped.list(); len(skipped) > 0 {
+		results.Skipped = &skipped
+	}
+	results.Retries = s.retries.summary()
+	results.BlobCache = s.blobStats.summary()
+	if s.criteria.ExportBaseline {
+		exported := s.baseline.export()
+		results.Baseline = &exported
+	}
+	if len(s.criteria.Baseline) > 0 && !results.Incomplete {
+		disappeared := s.baseline.disappeared()
+		results.Disappeared = &disappeared
+	}
+	return results, nil
+}
+
+// cancelled reports whether the caller has given up on the scan so no new work should be started
+func (s *ScanProjects) cancelled() bool {
+	return s.ctx.Err() != nil
 }
 
 func (s *ScanProjects) getProjects() ([]core.TeamProjectReference, error) {
 	var projects []core.TeamProjectReference
-	response, err := s.adoService.GetProjects()
+	response, err := s.adoService.GetProjects(s.ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	for response != nil {
-		projectsFiltered, err := s.processProjectResponse(response.Value)
-		if err != nil {
-			return nil, err
-		}
-
-		projects = append(projects, projectsFiltered...)
+		projects = append(projects, s.processProjectResponse(response.Value)...)
 
 		if response.ContinuationToken != "" {
-			response, err = s.adoService.GetAdditionalProjects(response.ContinuationToken)
+			response, err = s.adoService.GetAdditionalProjects(s.ctx, response.ContinuationToken)
 			if err != nil {
-				return nil, err
+				s.errors.add(OperationGetProjects, "", "", "", err)
+				return projects, nil
 			}
 		} else {
 			response = nil
@@ -73,40 +167,53 @@ func (s *ScanProjects) getProjects() ([]core.TeamProjectReference, error) {
 	return projects, nil
 }
 
-func (s *ScanProjects) processProjectResponse(projectToFilter []core.TeamProjectReference) (projectsFiltered []core.TeamProjectReference, err error) {
+func (s *ScanProjects) processProjectResponse(projectToFilter []core.TeamProjectReference) (projectsFiltered []core.TeamProjectReference) {
 	for _, project := range projectToFilter {
-		matchResults, err := regexp.MatchString(s.criteria.ProjectNamePattern, *project.Name)
-		if err != nil {
-			return nil, err
-		}
-		if matchResults {
+		if s.patterns.projects.MatchString(*project.Name) && !s.exclusions.project(*project.Name) {
 			projectsFiltered = append(projectsFiltered, project)
 		}
 	}
-	return projectsFiltered, nil
+	return projectsFiltered
 }
 
-func (s *ScanProjects) findContent(projectName *string, project chan Project, errs chan error, parentWg *sync.WaitGroup) {
-	repos, err := s.adoService.GetRepositories(*projectName)
+func (s *ScanProjects) findContent(projectName *string, project chan Project, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+	defer s.limits.projects.release()
+	defer atomic.AddInt64(&s.progress.ProjectsScanned, 1)
+
+	repos, disabled, err := s.adoService.GetRepositories(s.ctx, *projectName)
 	if err != nil {
-		errs <- err
+		s.errors.add(OperationGetRepositories, *projectName, "", "", err)
 		return
 	}
 
-	ch := make(chan Repository, len(*repos))
+	included := make([]git.GitRepository, 0, len(*repos))
+	for _, repo := range *repos {
+		if reason := s.skipReason(repo, disabled[*repo.Name]); reason != "" {
+			s.skipped.add(*projectName, *repo.Name, reason)
+			continue
+		}
+		included = append(included, repo)
+	}
+
+	atomic.AddInt64(&s.progress.RepositoriesTotal, int64(len(included)))
+	ch := make(chan []Repository, len(included))
 	wg := sync.WaitGroup{}
-	repositories := make([]Repository, 0, len(*repos))
+	repositories := make([]Repository, 0, len(included))
 
-	for _, repo := range *repos {
+	for _, repo := range included {
+		if !s.limits.repositories.acquire(s.ctx) {
+			break
+		}
 		wg.Add(1)
-		go s.findFiles(repo.Name, projectName, ch, errs, &wg)
+		go s.findFiles(repo, projectName, ch, &wg)
 	}
 
 	wg.Wait()
 	close(ch)
 
 	for repo := range ch {
-		repositories = append(repositories, repo)
+		repositories = append(repositories, repo...)
 	}
 
 	if len(repositories) > 0 {
@@ -115,55 +222,100 @@ func (s *ScanProjects) findContent(projectName *string, project chan Project, er
 			Repositories: &repositories,
 		}
 	}
-	
-	parentWg.Done()
 }
 
-func (s *ScanProjects) findFiles(repoName, projectName *string, repository chan Repository, errs chan error, parentWg *sync.WaitGroup) {
-	itemsReference, err := s.adoService.GetItems(*projectName, *repoName)
+// findFiles scans every version of the repository the criteria select and sends the versions with matches as one
+// slice so the channel only ever needs room for one send per repository
+func (s *ScanProjects) findFiles(repo git.GitRepository, projectName *string, repository chan []Repository, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+	defer s.limits.repositories.release()
+	defer atomic.AddInt64(&s.progress.RepositoriesScanned, 1)
+
+	repoName := repo.Name
+	versions, err := s.versionsToScan(*projectName, *repoName, repo.DefaultBranch)
 	if err != nil {
-		if !strings.Contains(err.Error(), "Cannot find any branches for the") {
-			s.logger.LogError(err)
-			fmt.Printf("Error Found: %s\n", err)
-		}
+		s.errors.add(OperationGetRefs, *projectName, *repoName, "", err)
 	}
 
-	if itemsReference != nil {
-		items, err := s.findContentInFile(repoName, projectName, itemsReference, errs)
-		if err != nil {
-			errs <- err
-			return
+	var scanned []Repository
+	for _, version := range versions {
+		if s.cancelled() {
+			break
+		}
+		found := Repository{Name: *repoName, Ref: version.ref, Commit: version.commit}
+		var items []Item
+		if s.criteria.History != nil {
+			items = s.findHistory(*projectName, found, version)
+		} else if s.state != nil {
+			items = s.findItemsIncrementally(*projectName, found, version, s.useArchive(repo))
+		} else {
+			items = s.findItems(*projectName, found, version, s.useArchive(repo))
 		}
-
 		if len(items) > 0 {
-			repository <- Repository{
-				Name:  *repoName,
-				Files: &items,
-			}
+			found.Files = &items
+			scanned = append(scanned, found)
+		}
+	}
+
+	if len(scanned) > 0 {
+		repository <- scanned
+	}
+}
+
+// emptyRepository reports whether the error is Azure DevOps saying the repository has no branches, an empty
+// repository has nothing to scan
+func emptyRepository(err error) bool {
+	return strings.Contains(err.Error(), "Cannot find any branches for the")
+}
+
+// findItems scans the files of the repository at the version, fetching the matching ones in one archive when archive
+// is set
+func (s *ScanProjects) findItems(projectName string, repository Repository, version scanVersion, archive bool) []Item {
+	itemsReference, err := s.adoService.GetItems(s.ctx, projectName, repository.Name, version.descriptor)
+	if err != nil {
+		if !emptyRepository(err) && !s.skipMissingCommit(projectName, repository.Name, err) {
+			s.errors.add(OperationGetItems, projectName, repository.Name, "", err)
 		}
+		return nil
 	}
 
-	parentWg.Done()
+	if itemsReference == nil {
+		return nil
+	}
+	return s.findContentInFile(repository, &projectName, version.descriptor, itemsReference, archive)
 }
 
-func (s *ScanProjects) findContentInFile(repoName, projectName *string, itemsReference *[]git.GitItem, errs chan error) ([]Item, error) {
+func (s *ScanProjects) findContentInFile(repository Repository, projectName *string, version *git.GitVersionDescriptor, itemsReference *[]git.GitItem, archive bool) []Item {
 	ch := make(chan Item, len(*itemsReference))
 	wg := sync.WaitGroup{}
 	items := make([]Item, 0, len(*itemsReference))
 
+	var matching []git.GitItem
 	for _, itemRef := range *itemsReference {
-		matchResults, err := regexp.MatchString(s.criteria.FileNamePattern, *itemRef.Path)
-		if err != nil {
-			return nil, err
-		}
-		if *itemRef.GitObjectType == "blob" && matchResults {
-			wg.Add(1)
-			item, err := s.adoService.GetItemContent(*projectName, *repoName, *itemRef.Path)
-			if err != nil {
-				return nil, err
+		if *itemRef.GitObjectType == "blob" && s.patterns.files.MatchString(*itemRef.Path) && !s.exclusions.path(*itemRef.Path) {
+			if s.criteria.pathsOnly() {
+				items = append(items, s.foundPath(repository, *projectName, itemRef))
+				continue
 			}
-			go s.processFile(itemRef.Path, item, ch, errs, &wg)
+			matching = append(matching, itemRef)
+		}
+	}
+	// The blobs an archive would hold are looked up first so the archive can be left out when they are all cached,
+	// otherwise each file is looked up just before it would be downloaded
+	if archive && s.blobs != nil {
+		matching = s.findContentInCachedBlobs(repository, *projectName, matching, ch)
+	}
+	if archive && len(matching) > 0 && s.findContentInArchive(repository, *projectName, matching, ch) {
+		matching = nil
+	}
+
+	for _, itemRef := range matching {
+		if !s.limits.files.acquire(s.ctx) {
+			break
 		}
+		atomic.AddInt64(&s.progress.FilesTotal, 1)
+		wg.Add(1)
+		go s.findContentInItem(itemRef, repository, projectName, version, !archive, ch, &wg)
 	}
 	wg.Wait()
 	close(ch)
@@ -171,32 +323,286 @@ func (s *ScanProjects) findContentInFile(repoName, projectName *string, itemsRef
 	for item := range ch {
 		items = append(items, item)
 	}
-	return items, nil
+	return items
 }
 
-func (s *ScanProjects) processFile(itemName *string, file io.ReadCloser, item chan Item, errs chan error, parentWg *sync.WaitGroup) {
+// findContentInItem downloads and scans the file, the blob cache is tried first unless the file was already looked up
+func (s *ScanProjects) findContentInItem(itemRef git.GitItem, repository Repository, projectName *string, version *git.GitVersionDescriptor, lookUp bool, item chan Item, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+	defer s.limits.files.release()
+	defer atomic.AddInt64(&s.progress.FilesScanned, 1)
+
+	if lookUp && s.scanCachedBlob(repository, *projectName, itemRef, item) {
+		return
+	}
+	repoName := &repository.Name
+	itemName := itemRef.Path
+	file, err := s.adoService.GetItemContent(s.ctx, *projectName, *repoName, *itemName, version)
+	if err != nil {
+		s.errors.add(OperationGetItemContent, *projectName, *repoName, *itemName, err)
+		return
+	}
+	defer file.Close()
+
+	var objectID string
+	if itemRef.ObjectId != nil {
+		objectID = *itemRef.ObjectId
+	}
+	content, err := s.cachingReader(objectID, file)
+	if err != nil {
+		s.errors.add(OperationReadContent, *projectName, *repoName, *itemName, err)
+		return
+	}
+	s.scanItem(*projectName, repository, *itemName, content, item)
+}
 
-	var lines []string
+// findContentInCachedBlobs looks the matching files up in the blob cache, as many at a time as files are scanned, and
+// scans the ones it holds, sending those with matches to item. It returns the files that still have to be downloaded
+func (s *ScanProjects) findContentInCachedBlobs(repository Repository, projectName string, matching []git.GitItem, item chan Item) []git.GitItem {
+	var mutex sync.Mutex
+	var missing []git.GitItem
+	wg := sync.WaitGroup{}
+	for _, itemRef := range matching {
+		if !s.limits.files.acquire(s.ctx) {
+			break
+		}
+		wg.Add(1)
+		go func(itemRef git.GitItem) {
+			defer wg.Done()
+			defer s.limits.files.release()
+			if s.scanCachedBlob(repository, projectName, itemRef, item) {
+				atomic.AddInt64(&s.progress.FilesTotal, 1)
+				atomic.AddInt64(&s.progress.FilesScanned, 1)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			missing = append(missing, itemRef)
+		}(itemRef)
+	}
+	wg.Wait()
+	return missing
+}
+
+// scanCachedBlob scans the file when its blob is in the blob cache, it returns false when it has to be downloaded
+func (s *ScanProjects) scanCachedBlob(repository Repository, projectName string, itemRef git.GitItem, item chan Item) bool {
+	if s.blobs == nil || itemRef.ObjectId == nil {
+		return false
+	}
+	content, ok := s.cachedBlob(*itemRef.ObjectId)
+	if !ok {
+		return false
+	}
+	s.scanItem(projectName, repository, *itemRef.Path, bytes.NewReader(content), item)
+	return true
+}
+
+// scanItem scans the content of a file at the version of the repository being scanned and reports it when it matches,
+// an incremental scan also records every match in the file for the next scan
+func (s *ScanProjects) scanItem(projectName string, repository Repository, path string, file io.Reader, item chan Item) {
+	lines, operation, err := s.matchFile(projectName, repository.Name, path, file, nil)
+	if err != nil {
+		s.errors.add(operation, projectName, repository.Name, path, err)
+	} else if s.state != nil {
+		s.state.record(projectName, repository, path, lines)
+	}
+
+	if found, ok := s.foundItem(projectName, repository, path, lines); ok {
+		item <- found
+	}
+}
+
+// foundItem reports the file with the lines that have new matches, it returns false when there are none
+func (s *ScanProjects) foundItem(projectName string, repository Repository, path string, lines []Line) (Item, bool) {
+	lines = s.newLines(lines)
+	if len(lines) == 0 {
+		return Item{}, false
+	}
+	found := Item{
+		Name:  path,
+		Lines: &lines,
+	}
+	if s.onItem != nil {
+		s.onItem(projectName, repository, found)
+	}
+	return found, true
+}
+
+// foundPath reports a file whose path matched in a scan that only lists paths, its content is never fetched
+func (s *ScanProjects) foundPath(repository Repository, projectName string, itemRef git.GitItem) Item {
+	atomic.AddInt64(&s.progress.FilesTotal, 1)
+	atomic.AddInt64(&s.progress.FilesScanned, 1)
+	found := Item{Name: *itemRef.Path}
+	if itemRef.ObjectId != nil {
+		found.ObjectID = *itemRef.ObjectId
+	}
+	if s.onItem != nil {
+		s.onItem(projectName, repository, found)
+	}
+	return found
+}
+
+// lineMatcher finds the matches in one line of a file, it returns the line as it should be reported which, for secrets,
+// is the line with the secrets masked
+type lineMatcher interface {
+	match(line string) (string, []Range)
+}
+
+// newLineMatcher returns the matcher for the criteria's mode, or for its rule packs when it selects some, a new one is
+// needed for every file as matchers can track state from line to line and rules can be limited to some paths
+func newLineMatcher(criteria *SearchCriteria, packs rulePacks, content *regexp.Regexp, path string) lineMatcher {
+	if criteria.Mode == ModeSecrets {
+		return new(secretMatcher)
+	}
+	if len(criteria.RulePacks) > 0 {
+		return rulesMatcher{rules: packs.rulesFor(criteria.RulePacks, path)}
+	}
+	return contentMatcher{pattern: content}
+}
+
+// contentMatcher matches the criteria's ContentPattern
+type contentMatcher struct {
+	pattern *regexp.Regexp
+}
+
+func (m contentMatcher) match(line string) (string, []Range) {
+	matches := m.pattern.FindAllStringIndex(line, -1)
+	ranges := make([]Range, 0, len(matches))
+	for _, match := range matches {
+		ranges = append(ranges, Range{Start: match[0], End: match[1]})
+	}
+	return line, ranges
+}
+
+// processFile returns the lines with new matches, matches that are suppressed by a comment or accepted in the baseline
+// are left out. When it fails it also returns the operation that failed along with any lines matched before the failure.
+// A file from history only has matches on the lines its commit added, each one checked against the file at head. A file
+// without the literals the content pattern requires is read but not matched line by line
+func (s *ScanProjects) processFile(projectName, repoName, path string, file io.Reader, history *historyFile) ([]Line, string, error) {
+	lines, operation, err := s.matchFile(projectName, repoName, path, file, history)
+	return s.newLines(lines), operation, err
+}
+
+// matchFile is processFile without the baseline, the lines it returns have every match that isn't suppressed
+// fingerprinted whether the baseline accepts it or not
+func (s *ScanProjects) matchFile(projectName, repoName, path string, file io.Reader, history *historyFile) ([]Line, string, error) {
+	if s.patterns.prefilter != nil {
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, OperationReadContent, err
+		}
+		if !s.patterns.prefilter.matches(content) {
+			return nil, "", nil
+		}
+		file = bytes.NewReader(content)
+	}
+	matcher := newLineMatcher(s.criteria, s.rulePacks, s.patterns.content, path)
+	suppression := new(suppression)
+
+	var lines []Line
+	var previous []string
+	var pending []int
+	lineNumber := 0
 	srcScanner := bufio.NewScanner(file)
 	srcScanner.Split(bufio.ScanLines)
 	for srcScanner.Scan() {
-		line := srcScanner.Text()
-		matchResults, err := regexp.MatchString(s.criteria.ContentPattern, line)
-		if err != nil {
-			errs <- err
-			return
+		raw := srcScanner.Text()
+		line, matches := matcher.match(raw)
+		lineNumber++
+		if suppression.suppressed(raw) || s.exclusions.line(raw) || (history != nil && !history.added(lineNumber)) {
+			matches = nil
+		}
+		s.fingerprintMatches(projectName, repoName, path, raw, matches)
+		if history != nil {
+			for i := range matches {
+				// Accepted matches are dropped anyway so the file at head isn't read for them
+				if s.baseline.accepts(matches[i].Fingerprint) {
+					continue
+				}
+				matches[i].AtHead = history.head.contains(path, raw[matches[i].Start:matches[i].End])
+			}
+		}
+
+		pending = s.appendAfterContext(lines, pending, line)
+
+		if len(matches) > 0 {
+			lines = append(lines, newLine(lineNumber, line, matches, previous))
+			if s.criteria.ContextLines > 0 {
+				pending = append(pending, len(lines)-1)
+			}
+		}
+
+		if s.criteria.ContextLines > 0 {
+			previous = append(previous, line)
+			if len(previous) > s.criteria.ContextLines {
+				previous = previous[1:]
+			}
 		}
-		if matchResults {
-			lines = append(lines, line)
+	}
+
+	if err := srcScanner.Err(); err != nil {
+		return lines, OperationReadContent, err
+	}
+	return lines, "", nil
+}
+
+// fingerprintMatches fingerprints the matches using the text of the line before any secrets in it were masked, secrets
+// are left without one when the fingerprints aren't keyed as a short secret could be guessed back from its hash
+func (s *ScanProjects) fingerprintMatches(projectName, repoName, path, line string, matches []Range) {
+	if s.criteria.Mode == ModeSecrets && !s.baseline.keyed() {
+		return
+	}
+	for i, match := range matches {
+		rule := match.RuleID
+		if rule == "" {
+			rule = s.criteria.ContentPattern
+		}
+		matches[i].Fingerprint = s.baseline.fingerprint(projectName, repoName, path, rule, line[match.Start:match.End])
+	}
+}
+
+// newLines returns the lines with only the matches that aren't accepted in the baseline, lines left without any are
+// dropped. Every match is recorded in the baseline as found and the lines passed in are left as they were
+func (s *ScanProjects) newLines(lines []Line) []Line {
+	var kept []Line
+	for _, line := range lines {
+		var ranges []Range
+		for _, match := range *line.Ranges {
+			if s.baseline.isNew(match.Fingerprint) {
+				ranges = append(ranges, match)
+			}
+		}
+		if len(ranges) > 0 {
+			line.Ranges = &ranges
+			kept = append(kept, line)
 		}
 	}
+	return kept
+}
 
-	if len(lines) > 0 {
-		item <- Item{
-			Name:  *itemName,
-			Lines: &lines,
+// appendAfterContext adds the line to every match still waiting on trailing context and returns the matches that need more
+func (s *ScanProjects) appendAfterContext(lines []Line, pending []int, line string) []int {
+	stillPending := pending[:0]
+	for _, index := range pending {
+		after := append(*lines[index].After, line)
+		lines[index].After = &after
+		if len(after) < s.criteria.ContextLines {
+			stillPending = append(stillPending, index)
 		}
 	}
+	return stillPending
+}
+
+func newLine(number int, text string, ranges []Range, previous []string) Line {
+	before := make([]string, len(previous))
+	copy(before, previous)
+	after := make([]string, 0)
 
-	parentWg.Done()
-}
\ No newline at end of file
+	return Line{
+		Number: number,
+		Text:   text,
+		Ranges: &ranges,
+		Before: &before,
+		After:  &after,
+	}
+}
@@ -2,25 +2,35 @@ package ado
 
 import (
 	mocks "adoscanner/mocks/ado"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/core"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
-	GetProjectsFuncName = "GetProjects"
+	GetProjectsFuncName          = "GetProjects"
 	GetAdditionalProjectFuncName = "GetAdditionalProjects"
-	GetRepositoriesFuncName = "GetRepositories"
-	GetItemsFuncName = "GetItems"
-	GetItemContentFuncName = "GetItemContent"
-
+	GetRepositoriesFuncName      = "GetRepositories"
+	GetRefsFuncName              = "GetRefs"
+	GetItemsFuncName             = "GetItems"
+	GetCommitsFuncName           = "GetCommits"
+	GetChangesFuncName           = "GetChanges"
+	GetItemContentFuncName       = "GetItemContent"
+	GetBlobsZipFuncName          = "GetBlobsZip"
+	GetCommitDiffsFuncName       = "GetCommitDiffs"
 )
 
 func sProjects(connections Service) *ScanProjects {
@@ -38,7 +48,7 @@ func sProjects(connections Service) *ScanProjects {
 
 func TestScanWithNotProjectsFound(t *testing.T) {
 	mockConnection := new(mocks.Service)
-	mockConnection.On(GetProjectsFuncName).Return(new(core.GetProjectsResponseValue), nil)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(new(core.GetProjectsResponseValue), nil)
 	results, err := sProjects(mockConnection).Scan()
 	assert.NotNil(t, results)
 	assert.Nil(t, err)
@@ -54,8 +64,8 @@ func TestScanWithNotProjectsFound(t *testing.T) {
 func TestScanWithOneProjectFound(t *testing.T) {
 	numOfProjects := 1
 	mockConnection := new(mocks.Service)
-	mockConnection.On(GetProjectsFuncName).Return(getProjectTestData(numOfProjects, ""), nil)
-	mockConnection.On(GetRepositoriesFuncName, "Project0").Return(new([]git.GitRepository), nil)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(numOfProjects, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(new([]git.GitRepository), nil, nil)
 	results, err := sProjects(mockConnection).Scan()
 	assert.NotNil(t, results)
 	assert.Nil(t, err)
@@ -71,8 +81,8 @@ func TestScanWithOneProjectFound(t *testing.T) {
 func TestScanWithTwoProjectsFound(t *testing.T) {
 	numOfProjects := 2
 	mockConnection := new(mocks.Service)
-	mockConnection.On(GetProjectsFuncName).Return(getProjectTestData(numOfProjects, ""), nil)
-	mockConnection.On(GetRepositoriesFuncName, mock.Anything).Return(new([]git.GitRepository), nil)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(numOfProjects, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, mock.Anything).Return(new([]git.GitRepository), nil, nil)
 	results, err := sProjects(mockConnection).Scan()
 	assert.NotNil(t, results)
 	assert.Nil(t, err)
@@ -88,9 +98,9 @@ func TestScanWithTwoProjectsFound(t *testing.T) {
 func TestScanWithFourProjectsFoundUsingAdditionalProjects(t *testing.T) {
 	numOfProjects := 2
 	mockConnection := new(mocks.Service)
-	mockConnection.On(GetProjectsFuncName).Return(getProjectTestData(numOfProjects, "yes"), nil)
-	mockConnection.On(GetAdditionalProjectFuncName, mock.Anything).Return(getProjectTestData(numOfProjects, ""), nil)
-	mockConnection.On(GetRepositoriesFuncName, mock.Anything).Return(new([]git.GitRepository), nil)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(numOfProjects, "yes"), nil)
+	mockConnection.On(GetAdditionalProjectFuncName, mock.Anything, mock.Anything).Return(getProjectTestData(numOfProjects, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, mock.Anything).Return(new([]git.GitRepository), nil, nil)
 	results, err := sProjects(mockConnection).Scan()
 	assert.NotNil(t, results)
 	assert.Nil(t, err)
@@ -109,20 +119,28 @@ func TestScanWithOneProjectFoundWithOneItem(t *testing.T) {
 	numOfItems := 1
 	expectedResults := Results{
 		Projects: &[]Project{{
-			Name:         "Project0",
+			Name: "Project0",
 			Repositories: &[]Repository{{
-				Name:  "Repo0",
+				Name: "Repo0",
 				Files: &[]Item{{
 					Name: "File0",
-					Lines: &[]string{"Content To Test"},
+					Lines: &[]Line{{
+						Number: 1,
+						Text:   "Content To Test",
+						Ranges: &[]Range{{Start: 0, End: 7, Fingerprint: testFingerprint("", "Project0", "Repo0", "File0", "Content", "Content")}},
+						Before: &[]string{},
+						After:  &[]string{},
+					}},
 				}},
 			}},
-		}}}
+		}},
+		Errors: &[]ScanError{},
+	}
 	mockConnection := new(mocks.Service)
-	mockConnection.On(GetProjectsFuncName).Return(getProjectTestData(numOfProjects, ""), nil)
-	mockConnection.On(GetRepositoriesFuncName, "Project0").Return(getRepositoryTestData(numOfRepos), nil)
-	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything).Return(getItemTestData(numOfItems), nil)
-	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything).Return(getItemContentTestData(), nil)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(numOfProjects, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(numOfRepos), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(numOfItems), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemContentTestData(), nil)
 	results, err := sProjects(mockConnection).Scan()
 	assert.NotNil(t, results)
 	assert.Equal(t, &expectedResults, results)
@@ -136,6 +154,197 @@ func TestScanWithOneProjectFoundWithOneItem(t *testing.T) {
 	mockConnection.AssertExpectations(t)
 }
 
+func TestScanWithContextLinesAndMultipleMatches(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(ioutil.NopCloser(strings.NewReader("one\nContent and Content\ntwo\nthree\nfour\nContent\n")), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.ContextLines = 1
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	fingerprint := testFingerprint("", "Project0", "Repo0", "File0", "Content", "Content")
+	expectedLines := []Line{
+		{
+			Number: 2,
+			Text:   "Content and Content",
+			Ranges: &[]Range{{Start: 0, End: 7, Fingerprint: fingerprint}, {Start: 12, End: 19, Fingerprint: fingerprint}},
+			Before: &[]string{"one"},
+			After:  &[]string{"two"},
+		},
+		{
+			Number: 6,
+			Text:   "Content",
+			Ranges: &[]Range{{Start: 0, End: 7, Fingerprint: fingerprint}},
+			Before: &[]string{"four"},
+			After:  &[]string{},
+		},
+	}
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	assert.Equal(t, expectedLines, *files[0].Lines)
+}
+
+func TestScanReportsPartialFailures(t *testing.T) {
+	status := 404
+	message := "TF401019: The Git repository does not exist"
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(2, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(2), nil, nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project1").Return(nil, nil, errors.New("connection reset"))
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemTestData(2), nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo1", mock.Anything).Return(nil, errors.New("Cannot find any branches for the Repo1 repository."))
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "File0", mock.Anything).Return(getItemContentTestData(), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, "Project0", "Repo0", "File1", mock.Anything).
+		Return(nil, &azuredevops.WrappedError{Message: &message, StatusCode: &status})
+	results, err := sProjects(mockConnection).Scan()
+	assert.Nil(t, err)
+
+	assert.True(t, results.Incomplete)
+	assert.Len(t, *results.Projects, 1)
+	assert.ElementsMatch(t, []ScanError{
+		{Project: "Project1", Operation: OperationGetRepositories, Message: "connection reset"},
+		{Project: "Project0", Repository: "Repo0", Path: "File1", Operation: OperationGetItemContent, Message: message, StatusCode: status},
+	}, *results.Errors)
+
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	assert.Len(t, files, 1)
+	assert.Equal(t, "File0", files[0].Name)
+}
+
+func TestScanReportsFailedProjectPage(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, "yes"), nil)
+	mockConnection.On(GetAdditionalProjectFuncName, mock.Anything, "yes").Return(nil, errors.New("timeout"))
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(new([]git.GitRepository), nil, nil)
+	results, err := sProjects(mockConnection).Scan()
+	assert.Nil(t, err)
+
+	assert.True(t, results.Incomplete)
+	assert.Equal(t, []ScanError{{Operation: OperationGetProjects, Message: "timeout"}}, *results.Errors)
+	mockConnection.AssertNumberOfCalls(t, GetRepositoriesFuncName, 1)
+}
+
+func TestScanReturnsCollectedResultsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(5), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, "File0", mock.Anything).
+		Run(func(mock.Arguments) { cancel() }).
+		Return(getItemContentTestData(), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.ctx = ctx
+	scanProjects.criteria.Concurrency = Concurrency{Files: 1}
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.True(t, results.Incomplete)
+	assert.Contains(t, *results.Errors, ScanError{Operation: OperationScan, Message: context.Canceled.Error()})
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	assert.Len(t, files, 1)
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, 1)
+}
+
+// inFlight records the most calls to the mocked Service that were running at the same time
+type inFlight struct {
+	current int64
+	max     int64
+}
+
+func (f *inFlight) track(mock.Arguments) {
+	current := atomic.AddInt64(&f.current, 1)
+	for {
+		max := atomic.LoadInt64(&f.max)
+		if current <= max || atomic.CompareAndSwapInt64(&f.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	atomic.AddInt64(&f.current, -1)
+}
+
+func TestScanLimitsConcurrentFileDownloads(t *testing.T) {
+	numOfItems := 20
+	downloads := new(inFlight)
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(numOfItems), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(downloads.track).
+		Return(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser {
+			return getItemContentTestData()
+		}, nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Concurrency = Concurrency{Files: 3}
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	files := *(*(*results.Projects)[0].Repositories)[0].Files
+	assert.Len(t, files, numOfItems)
+	assert.True(t, downloads.max <= 3, "expected at most 3 concurrent downloads, got %d", downloads.max)
+	mockConnection.AssertNumberOfCalls(t, GetItemContentFuncName, numOfItems)
+}
+
+func TestScanLimitsInFlightRequests(t *testing.T) {
+	server := newOnPremServer(t, 3)
+	server.resourceAreas = true
+
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, nil, nil)}
+	criteria := &SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "yml", ContentPattern: "password",
+		Concurrency: Concurrency{Requests: 1}}
+	results, err := api.scan(context.Background(), server.URL+server.collection, "123", criteria, new(Progress), nil)
+	assert.Nil(t, err)
+
+	// Paged calls and the resource area lookups make requests of their own, each of them holds the slot
+	assert.Len(t, *results.Projects, 3)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&server.inFlight.max))
+}
+
+func TestRequestLimitIsHeldUntilTheResponseIsRead(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	service, err := NewAzureDevOpsService(server.URL+server.collection, "123", nil, nil)
+	assert.Nil(t, err)
+	requests := newLimiter(1)
+	ctx := withRequestLimit(context.Background(), requests)
+
+	content, err := service.GetBlobsZip(ctx, "Project0", "Repo", []string{onPremConfigBlob})
+	assert.Nil(t, err)
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, requests.acquire(timeout))
+
+	_, _ = ioutil.ReadAll(content)
+	assert.True(t, requests.acquire(context.Background()))
+	requests.release()
+	assert.Nil(t, content.Close())
+	assert.True(t, requests.acquire(context.Background()))
+}
+
+func TestScanDoesNotWrapTheServiceAgainWhenRunTwice(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(nil, statusError(http.StatusServiceUnavailable))
+	scanProjects := sProjects(mockConnection)
+	scanProjects.retry = retryPolicy{attempts: 2, budget: time.Second, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+
+	for scans := 1; scans <= 2; scans++ {
+		_, err := scanProjects.Scan()
+		assert.Equal(t, statusError(http.StatusServiceUnavailable), err)
+		mockConnection.AssertNumberOfCalls(t, GetProjectsFuncName, 2*scans)
+	}
+}
+
+func TestConcurrencyWithinCapsRequestedLimits(t *testing.T) {
+	limits := Concurrency{Projects: 2, Repositories: 4, Files: 8, Requests: 16}
+	requested := Concurrency{Projects: 1, Repositories: 10, Files: 0, Requests: -1}
+	assert.Equal(t, Concurrency{Projects: 1, Repositories: 4, Files: 8, Requests: 16}, requested.within(limits))
+}
+
 func getProjectTestData(numOfProjects int, continuationToken string) *core.GetProjectsResponseValue {
 
 	var projectReferences []core.TeamProjectReference
@@ -179,6 +388,17 @@ func getItemTestData(numOfItems int) *[]git.GitItem {
 	return &gitItems
 }
 
+func getItemsWithPaths(paths ...string) *[]git.GitItem {
+	var gitItems []git.GitItem
+	for i := range paths {
+		gitItems = append(gitItems, git.GitItem{
+			Path:          &paths[i],
+			GitObjectType: &git.GitObjectTypeValues.Blob,
+		})
+	}
+	return &gitItems
+}
+
 func getItemContentTestData() io.ReadCloser {
 	return ioutil.NopCloser(strings.NewReader("Content To Test\nboo"))
-}
\ No newline at end of file
+}
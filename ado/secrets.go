@@ -0,0 +1,183 @@
+package ado
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Severities reported with every secret finding, from the most to the least urgent to rotate
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+)
+
+const (
+	// privateKeyRuleID matches the header of a private key, the key itself is on the lines that follow
+	privateKeyRuleID = "private-key"
+	// entropyRuleID is reported for quoted strings that look random enough to be a credential no other rule knows about
+	entropyRuleID = "high-entropy-string"
+	// entropyRuleDescription is reported with entropyRuleID as that rule has no definition in secretRules
+	entropyRuleDescription = "A quoted string random enough to be a credential"
+	// entropyMinLength keeps short quoted strings, which can't carry enough entropy to tell apart from words, out
+	entropyMinLength = 20
+	// entropyThreshold is the Shannon entropy, in bits per character, a quoted string needs to be reported
+	entropyThreshold = 4.0
+	// maskVisibleChars is how much of a long secret is left readable so a finding can be told apart from another
+	maskVisibleChars = 4
+)
+
+// secretRules is the built in rule pack, the most specific rules come first so they win when findings overlap
+var secretRules = []rule{
+	{
+		id:          privateKeyRuleID,
+		description: "The header of a private key",
+		severity:    SeverityCritical,
+		pattern:     regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?-----`),
+	},
+	{
+		id:          "azure-storage-key",
+		description: "An Azure storage account key in a connection string",
+		severity:    SeverityCritical,
+		pattern:     regexp.MustCompile(`(?i)AccountKey\s*=\s*([A-Za-z0-9+/]{86}==)`),
+		group:       1,
+	},
+	{
+		id:          "aws-secret-access-key",
+		description: "An AWS secret access key",
+		severity:    SeverityCritical,
+		pattern:     regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+]{40})\b`),
+		group:       1,
+	},
+	{
+		id:          "aws-access-key-id",
+		description: "An AWS access key ID",
+		severity:    SeverityHigh,
+		pattern:     regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		id:          "azure-devops-pat",
+		description: "An Azure DevOps personal access token",
+		severity:    SeverityHigh,
+		pattern:     regexp.MustCompile(`\b(?:[a-z2-7]{52}|[A-Za-z0-9]{76}AZDO[A-Za-z0-9]{4})\b`),
+	},
+	{
+		id:          "sql-connection-string",
+		description: "The password in a SQL Server connection string",
+		severity:    SeverityHigh,
+		pattern:     regexp.MustCompile(`(?i)(?:Server|Data Source)\s*=[^;]*;.*?\b(?:Password|Pwd)\s*=\s*([^;'"\s]+)`),
+		group:       1,
+	},
+	{
+		id:          "jwt",
+		description: "A JSON Web Token",
+		severity:    SeverityMedium,
+		pattern:     regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),
+	},
+}
+
+var (
+	quotedString  = regexp.MustCompile(`["']([A-Za-z0-9+/=_.-]+)["']`)
+	privateKeyEnd = regexp.MustCompile(`-----END (?:RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?-----`)
+)
+
+// secretMatcher runs the rule pack over a file a line at a time, it keeps track of whether it is inside a private key
+// so the body of the key is masked as well as its header
+type secretMatcher struct {
+	inPrivateKey bool
+}
+
+func (m *secretMatcher) match(line string) (string, []Range) {
+	if m.inPrivateKey {
+		if privateKeyEnd.MatchString(line) {
+			m.inPrivateKey = false
+			return line, nil
+		}
+		return maskAll(line), nil
+	}
+
+	var findings []Range
+	for _, r := range secretRules {
+		for _, finding := range r.find(line) {
+			findings = appendFinding(findings, finding)
+			if r.id == privateKeyRuleID && !privateKeyEnd.MatchString(line[finding.End:]) {
+				m.inPrivateKey = true
+			}
+		}
+	}
+	for _, match := range quotedString.FindAllStringSubmatchIndex(line, -1) {
+		start, end := match[2], match[3]
+		if looksRandom(line[start:end]) {
+			findings = appendFinding(findings, Range{Start: start, End: end, RuleID: entropyRuleID, Severity: SeverityLow, Description: entropyRuleDescription})
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return maskFindings(line, findings), findings
+}
+
+// appendFinding adds the finding unless it overlaps one found by an earlier, more specific, rule
+func appendFinding(findings []Range, finding Range) []Range {
+	for _, existing := range findings {
+		if finding.Start < existing.End && existing.Start < finding.End {
+			return findings
+		}
+	}
+	return append(findings, finding)
+}
+
+// maskFindings replaces each secret with asterisks of the same length so the ranges still line up with the text,
+// the private key rule matches the header which is left readable as the key itself is on the lines after it
+func maskFindings(line string, findings []Range) string {
+	if len(findings) == 0 {
+		return line
+	}
+	masked := []byte(line)
+	for _, finding := range findings {
+		if finding.RuleID == privateKeyRuleID {
+			continue
+		}
+		visible := 0
+		if finding.End-finding.Start >= 3*maskVisibleChars {
+			visible = maskVisibleChars
+		}
+		for i := finding.Start + visible; i < finding.End; i++ {
+			masked[i] = '*'
+		}
+	}
+	return string(masked)
+}
+
+// maskAll masks every character of the line other than leading whitespace
+func maskAll(line string) string {
+	trimmed := strings.TrimLeft(line, " \t")
+	return line[:len(line)-len(trimmed)] + strings.Repeat("*", len(trimmed))
+}
+
+// looksRandom reports whether a quoted string is long and random enough to be a generated credential, generated values
+// mix letters with digits where paths, URLs and names that are just as long usually don't
+func looksRandom(value string) bool {
+	return len(value) >= entropyMinLength &&
+		strings.ContainsAny(value, "0123456789") &&
+		strings.IndexFunc(value, unicode.IsLetter) >= 0 &&
+		shannonEntropy(value) >= entropyThreshold
+}
+
+// shannonEntropy returns the average number of bits of information carried by each character of value
+func shannonEntropy(value string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range value {
+		counts[r]++
+	}
+	length := float64(len(value))
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
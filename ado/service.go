@@ -2,108 +2,253 @@ package ado
 
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/microsoft/azure-devops-go-api/azuredevops"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/core"
 	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
 	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// projectPageSize is the number of projects requested at a time, servers that don't return continuation tokens are
+// paged with $skip for as long as they return full pages
+const projectPageSize = 100
+
+// Page sizes used when walking the history of a repository, commits and the changes of a commit are both paged with
+// skip and top
+const (
+	commitPageSize = 100
+	changePageSize = 1000
+)
+
+// skipTokenPrefix marks a continuation token made up by the service for a server that pages with $skip
+const skipTokenPrefix = "skip:"
+
+// byteOrderMark is trimmed from a response body before it is decoded, as the client does
+var byteOrderMark = []byte("\xef\xbb\xbf")
+
+// resourceAreasLocationID is the location of the resource areas API, which older Azure DevOps Server and TFS
+// collections do not register
+var resourceAreasLocationID = uuid.MustParse("e81700f7-3be2-46de-8624-2eb35882fcaa")
+
 // Service interface is used to provide you access the API you intend to scan and enable it to be mocked for testing
 type Service interface {
-	GetProjects() (*core.GetProjectsResponseValue, error)
-	GetAdditionalProjects(continuationToken string) (*core.GetProjectsResponseValue, error)
-	GetRepositories(projectName string) (*[]git.GitRepository, error)
-	GetItems(projectName string, repoName string) (*[]git.GitItem, error)
-	GetItemContent(projectName string, repoName string, path string) (io.ReadCloser, error)
-	CreateConnection(orgURL, pat string) error
+	GetProjects(ctx context.Context) (*core.GetProjectsResponseValue, error)
+	GetAdditionalProjects(ctx context.Context, continuationToken string) (*core.GetProjectsResponseValue, error)
+	GetRepositories(ctx context.Context, projectName string) (*[]git.GitRepository, map[string]bool, error)
+	GetRefs(ctx context.Context, projectName string, repoName string, filter string) (*[]git.GitRef, error)
+	GetItems(ctx context.Context, projectName string, repoName string, version *git.GitVersionDescriptor) (*[]git.GitItem, error)
+	GetItemContent(ctx context.Context, projectName string, repoName string, path string, version *git.GitVersionDescriptor) (io.ReadCloser, error)
+	GetBlobsZip(ctx context.Context, projectName string, repoName string, blobIDs []string) (io.ReadCloser, error)
+	GetCommits(ctx context.Context, projectName string, repoName string, searchCriteria git.GitQueryCommitsCriteria) (*[]git.GitCommitRef, error)
+	GetChanges(ctx context.Context, projectName string, repoName string, commitID string) (*git.GitCommitChanges, error)
+	GetCommitDiffs(ctx context.Context, projectName string, repoName string, baseCommit string, targetCommit string) (*git.GitCommitDiffs, error)
 }
 
-// AzureDevOpsService implements the Service interface and provides you the access to the Azure DevOps APIs
+// AzureDevOpsService implements the Service interface and provides you the access to the Azure DevOps APIs, each one
+// is bound to the organization and token it was created with. The area clients are created on first use and shared by
+// every goroutine using the service, so their resource area lookups and connections are reused
 type AzureDevOpsService struct {
 	connection *azuredevops.Connection
+	transport  *adoTransport
+	hosts      hostAllowlist
+	mutex      sync.Mutex
+	coreClient core.Client
+	gitClient  git.Client
 }
 
-// CreateConnection establishes the connection used by the other methods in the interface
-func (conn *AzureDevOpsService) CreateConnection(orgURL, pat string) error {
-	conn.connection = azuredevops.NewPatConnection(orgURL, pat)
-	if conn.connection == nil {
-		return errors.New("unable to connect to azure devops")
+// NewAzureDevOpsService establishes the connection used by the methods in the interface, its requests are sent over
+// transport, or the default transport when it is nil, and only follow redirects to the hosts allowed
+func NewAzureDevOpsService(orgURL, pat string, transport http.RoundTripper, hosts hostAllowlist) (*AzureDevOpsService, error) {
+	connection := azuredevops.NewPatConnection(orgURL, pat)
+	if connection == nil {
+		return nil, errors.New("unable to connect to azure devops")
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
 
-	return nil
+	service := &AzureDevOpsService{connection: connection, transport: &adoTransport{next: transport}, hosts: hosts}
+	// The resource areas are looked up with the collection's client before any area client exists
+	configureClient(connection.GetClientByUrl(connection.BaseUrl), service.transport, hosts)
+	return service, nil
 }
 
-func (conn *AzureDevOpsService) getCoreClient() (core.Client, error) {
-	coreClient, err := core.NewClient(context.Background(), conn.connection)
+// getCoreClient returns the client for the core area, on a server without the resource areas API every area is
+// served from the collection URL. A client that couldn't be created is tried again on the next call
+func (conn *AzureDevOpsService) getCoreClient(ctx context.Context) (core.Client, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.coreClient != nil {
+		return conn.coreClient, nil
+	}
+
+	coreClient, err := core.NewClient(ctx, conn.connection)
+	if resourceAreasNotRegistered(err) {
+		coreClient, err = &core.ClientImpl{Client: *conn.connection.GetClientByUrl(conn.connection.BaseUrl)}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	configureClient(&coreClient.(*core.ClientImpl).Client, conn.transport, conn.hosts)
+	conn.coreClient = coreClient
 	return coreClient, nil
 }
 
-func (conn *AzureDevOpsService) getGitClient() (git.Client, error) {
-	gitClient, err := git.NewClient(context.Background(), conn.connection)
+func (conn *AzureDevOpsService) getGitClient(ctx context.Context) (git.Client, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.gitClient != nil {
+		return conn.gitClient, nil
+	}
+
+	gitClient, err := git.NewClient(ctx, conn.connection)
+	if resourceAreasNotRegistered(err) {
+		gitClient, err = &git.ClientImpl{Client: *conn.connection.GetClientByUrl(conn.connection.BaseUrl)}, nil
+	}
 	if err != nil {
-			return nil, err
-		}
+		return nil, err
+	}
+	configureClient(&gitClient.(*git.ClientImpl).Client, conn.transport, conn.hosts)
+	conn.gitClient = gitClient
 	return gitClient, nil
 }
 
 // GetProjects scans for projects that match the Project Search Criteria
-func (conn *AzureDevOpsService) GetProjects() (*core.GetProjectsResponseValue, error) {
-	coreClient, err := conn.getCoreClient()
+func (conn *AzureDevOpsService) GetProjects(ctx context.Context) (*core.GetProjectsResponseValue, error) {
+	coreClient, err := conn.getCoreClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := coreClient.GetProjects(context.Background(), core.GetProjectsArgs{})
+	top := projectPageSize
+	response, err := coreClient.GetProjects(ctx, core.GetProjectsArgs{Top: &top})
 	if err != nil {
 		return nil, err
 	}
 
-	return response, nil
+	return withSkipToken(response, 0), nil
 }
 
 // GetAdditionalProjects uses a continuation token to scan for more projects
-func (conn *AzureDevOpsService) GetAdditionalProjects(continuationToken string) (*core.GetProjectsResponseValue, error) {
-	coreClient, err := conn.getCoreClient()
+func (conn *AzureDevOpsService) GetAdditionalProjects(ctx context.Context, continuationToken string) (*core.GetProjectsResponseValue, error) {
+	coreClient, err := conn.getCoreClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := coreClient.GetProjects(context.Background(), core.GetProjectsArgs{ContinuationToken: &continuationToken})
+	top := projectPageSize
+	if strings.HasPrefix(continuationToken, skipTokenPrefix) {
+		skip, err := strconv.Atoi(strings.TrimPrefix(continuationToken, skipTokenPrefix))
+		if err != nil {
+			return nil, err
+		}
+		response, err := coreClient.GetProjects(ctx, core.GetProjectsArgs{Top: &top, Skip: &skip})
+		if err != nil {
+			return nil, err
+		}
+		return withSkipToken(response, skip), nil
+	}
+
+	response, err := coreClient.GetProjects(ctx, core.GetProjectsArgs{Top: &top, ContinuationToken: &continuationToken})
 	if err != nil {
 		return nil, err
 	}
 
-	return response, nil
+	return withSkipToken(response, 0), nil
+}
+
+// withSkipToken gives a full page from a server that doesn't send continuation tokens, as older Azure DevOps Server
+// versions don't, a token that asks for the next page with $skip
+func withSkipToken(response *core.GetProjectsResponseValue, skip int) *core.GetProjectsResponseValue {
+	if response != nil && response.ContinuationToken == "" && len(response.Value) >= projectPageSize {
+		response.ContinuationToken = fmt.Sprintf("%s%d", skipTokenPrefix, skip+len(response.Value))
+	}
+	return response
+}
+
+func resourceAreasNotRegistered(err error) bool {
+	var notRegistered *azuredevops.LocationIdNotRegisteredError
+	return errors.As(err, &notRegistered) && notRegistered.LocationId == resourceAreasLocationID
 }
 
-// GetRepositories scans all repositories for a project and processes any repo that has a default branch
-func (conn *AzureDevOpsService) GetRepositories(projectName string) (*[]git.GitRepository, error) {
-	gitClient, err := conn.getGitClient()
+// repositoryDisabled is the isDisabled field of a repository, which the client's GitRepository predates
+type repositoryDisabled struct {
+	Name       *string `json:"name"`
+	IsDisabled *bool   `json:"isDisabled"`
+}
+
+// GetRepositories lists the repositories of the project along with the names of the ones that are disabled, the
+// client's GetRepositories drops the isDisabled field so it is read from a copy of the response body
+func (conn *AzureDevOpsService) GetRepositories(ctx context.Context, projectName string) (*[]git.GitRepository, map[string]bool, error) {
+	gitClient, err := conn.getGitClient(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	repos, err := gitClient.GetRepositories(context.Background(), git.GetRepositoriesArgs{Project: &projectName})
+	body := new(responseBody)
+	repos, err := gitClient.GetRepositories(withResponseBody(ctx, body), git.GetRepositoriesArgs{Project: &projectName})
+	if err != nil {
+		return nil, nil, err
+	}
+	var states struct {
+		Value []repositoryDisabled `json:"value"`
+	}
+	if err := json.Unmarshal(bytes.TrimPrefix(body.bytes(), byteOrderMark), &states); err != nil {
+		return nil, nil, err
+	}
+
+	disabled := make(map[string]bool)
+	for _, state := range states.Value {
+		if state.IsDisabled != nil && *state.IsDisabled && state.Name != nil {
+			disabled[*state.Name] = true
+		}
+	}
+	return repos, disabled, nil
+}
+
+// GetRefs lists every ref of the repository whose name, without the leading "refs/", starts with filter, such as
+// "heads/" for branches or "tags/" for tags. Annotated tags are peeled so they can be resolved to their commit
+func (conn *AzureDevOpsService) GetRefs(ctx context.Context, projectName, repoName, filter string) (*[]git.GitRef, error) {
+	gitClient, err := conn.getGitClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return repos, nil
+	peelTags := true
+	args := git.GetRefsArgs{RepositoryId: &repoName, Project: &projectName, Filter: &filter, PeelTags: &peelTags}
+	var refs []git.GitRef
+	for {
+		response, err := gitClient.GetRefs(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, response.Value...)
+		if response.ContinuationToken == "" {
+			return &refs, nil
+		}
+		continuationToken := response.ContinuationToken
+		args.ContinuationToken = &continuationToken
+	}
 }
 
-// GetItems scans all items in repository that matches the search criteria for file name
-func (conn *AzureDevOpsService) GetItems(projectName, repoName string) (*[]git.GitItem, error){
-	gitClient, err := conn.getGitClient()
+// GetItems scans all items in repository that matches the search criteria for file name, a nil version lists the
+// default branch
+func (conn *AzureDevOpsService) GetItems(ctx context.Context, projectName, repoName string, version *git.GitVersionDescriptor) (*[]git.GitItem, error) {
+	gitClient, err := conn.getGitClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	itemsReference, err := gitClient.GetItems(context.Background(), git.GetItemsArgs{RepositoryId: &repoName, Project: &projectName, RecursionLevel: &git.VersionControlRecursionTypeValues.Full})
+	itemsReference, err := gitClient.GetItems(ctx, git.GetItemsArgs{RepositoryId: &repoName, Project: &projectName, RecursionLevel: &git.VersionControlRecursionTypeValues.Full, VersionDescriptor: version})
 	if err != nil {
 		return nil, err
 	}
@@ -111,18 +256,111 @@ func (conn *AzureDevOpsService) GetItems(projectName, repoName string) (*[]git.G
 	return itemsReference, nil
 }
 
-// GetItemContent scans all lines in a file and returns a list of each line that contains the search criteria
-func (conn *AzureDevOpsService) GetItemContent(projectName, repoName, path string) (io.ReadCloser, error){
-	gitClient, err := conn.getGitClient()
+// GetItemContent scans all lines in a file and returns a list of each line that contains the search criteria, a nil
+// version reads the file from the default branch
+func (conn *AzureDevOpsService) GetItemContent(ctx context.Context, projectName, repoName, path string, version *git.GitVersionDescriptor) (io.ReadCloser, error) {
+	gitClient, err := conn.getGitClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	includeContent := true
-	item, err := gitClient.GetItemContent(context.Background(), git.GetItemContentArgs{RepositoryId: &repoName, Project: &projectName, Path: &path, IncludeContent: &includeContent})
+	item, err := gitClient.GetItemContent(ctx, git.GetItemContentArgs{RepositoryId: &repoName, Project: &projectName, Path: &path, IncludeContent: &includeContent, VersionDescriptor: version})
 	if err != nil {
 		return nil, err
 	}
 
 	return item, nil
-}
\ No newline at end of file
+}
+
+// GetBlobsZip downloads the blobs in one zip archive, each entry is named after the ID of its blob
+func (conn *AzureDevOpsService) GetBlobsZip(ctx context.Context, projectName, repoName string, blobIDs []string) (io.ReadCloser, error) {
+	gitClient, err := conn.getGitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gitClient.GetBlobsZip(ctx, git.GetBlobsZipArgs{RepositoryId: &repoName, Project: &projectName, BlobIds: &blobIDs})
+}
+
+// GetCommits lists the commits matching searchCriteria newest first, a page at a time until there are no more or
+// searchCriteria.Top commits have been listed
+func (conn *AzureDevOpsService) GetCommits(ctx context.Context, projectName, repoName string, searchCriteria git.GitQueryCommitsCriteria) (*[]git.GitCommitRef, error) {
+	gitClient, err := conn.getGitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := 0
+	if searchCriteria.Top != nil {
+		limit = *searchCriteria.Top
+	}
+	commits := make([]git.GitCommitRef, 0)
+	for {
+		top, skip := commitPageSize, len(commits)
+		if limit > 0 && limit-skip < top {
+			top = limit - skip
+		}
+		searchCriteria.Top, searchCriteria.Skip = &top, &skip
+		page, err := gitClient.GetCommits(ctx, git.GetCommitsArgs{RepositoryId: &repoName, Project: &projectName, SearchCriteria: &searchCriteria})
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, *page...)
+		if len(*page) < top || (limit > 0 && len(commits) >= limit) {
+			return &commits, nil
+		}
+	}
+}
+
+// GetChanges lists every file the commit changed compared to its first parent
+func (conn *AzureDevOpsService) GetChanges(ctx context.Context, projectName, repoName, commitID string) (*git.GitCommitChanges, error) {
+	gitClient, err := conn.getGitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]interface{}, 0)
+	for {
+		top, skip := changePageSize, len(changes)
+		page, err := gitClient.GetChanges(ctx, git.GetChangesArgs{CommitId: &commitID, RepositoryId: &repoName, Project: &projectName, Top: &top, Skip: &skip})
+		if err != nil {
+			return nil, err
+		}
+		if page.Changes != nil {
+			changes = append(changes, *page.Changes...)
+		}
+		if page.Changes == nil || len(*page.Changes) < top {
+			return &git.GitCommitChanges{ChangeCounts: page.ChangeCounts, Changes: &changes}, nil
+		}
+	}
+}
+
+// GetCommitDiffs lists every file that differs between the trees of the two commits, not just the changes made since
+// they diverged
+func (conn *AzureDevOpsService) GetCommitDiffs(ctx context.Context, projectName, repoName, baseCommit, targetCommit string) (*git.GitCommitDiffs, error) {
+	gitClient, err := conn.getGitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	diffCommonCommit := false
+	base := git.GitBaseVersionDescriptor{BaseVersion: &baseCommit, BaseVersionType: &git.GitVersionTypeValues.Commit}
+	target := git.GitTargetVersionDescriptor{TargetVersion: &targetCommit, TargetVersionType: &git.GitVersionTypeValues.Commit}
+	changes := make([]interface{}, 0)
+	for {
+		top, skip := changePageSize, len(changes)
+		page, err := gitClient.GetCommitDiffs(ctx, git.GetCommitDiffsArgs{RepositoryId: &repoName, Project: &projectName,
+			DiffCommonCommit: &diffCommonCommit, Top: &top, Skip: &skip, BaseVersionDescriptor: &base, TargetVersionDescriptor: &target})
+		if err != nil {
+			return nil, err
+		}
+		if page.Changes != nil {
+			changes = append(changes, *page.Changes...)
+		}
+		if page.Changes == nil || len(*page.Changes) < top {
+			page.Changes = &changes
+			return page, nil
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package ado
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// ServiceFactory builds a Service scoped to a single organization and token so concurrent requests never share
+// credentials
+type ServiceFactory interface {
+	NewService(orgURL, pat string) (Service, error)
+}
+
+// AzureDevOpsServiceFactory creates AzureDevOpsServices that send their requests over transport and only follow
+// redirects to hosts, when poolSize is above zero the most recently used connections are kept and reused for requests
+// with the same organization and token
+type AzureDevOpsServiceFactory struct {
+	poolSize  int
+	transport http.RoundTripper
+	hosts     hostAllowlist
+	mutex     sync.Mutex
+	pool      map[string]*list.Element
+	recent    *list.List
+}
+
+type pooledService struct {
+	key     string
+	service *AzureDevOpsService
+}
+
+// NewAzureDevOpsServiceFactory creates a factory that keeps up to poolSize connections, zero disables pooling, sends
+// requests over transport, nil meaning the default transport, and only follows redirects to hosts
+func NewAzureDevOpsServiceFactory(poolSize int, transport http.RoundTripper, hosts hostAllowlist) *AzureDevOpsServiceFactory {
+	return &AzureDevOpsServiceFactory{
+		poolSize:  poolSize,
+		transport: transport,
+		hosts:     hosts,
+		pool:      make(map[string]*list.Element),
+		recent:    list.New(),
+	}
+}
+
+// NewService returns a Service connected to orgURL with pat, reusing a pooled connection when there is one
+func (factory *AzureDevOpsServiceFactory) NewService(orgURL, pat string) (Service, error) {
+	if factory.poolSize <= 0 {
+		return NewAzureDevOpsService(orgURL, pat, factory.transport, factory.hosts)
+	}
+
+	key := orgURL + "|" + tokenFingerprint(pat)
+
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+
+	if element, ok := factory.pool[key]; ok {
+		factory.recent.MoveToFront(element)
+		return element.Value.(*pooledService).service, nil
+	}
+
+	service, err := NewAzureDevOpsService(orgURL, pat, factory.transport, factory.hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	factory.pool[key] = factory.recent.PushFront(&pooledService{key: key, service: service})
+	if factory.recent.Len() > factory.poolSize {
+		oldest := factory.recent.Back()
+		factory.recent.Remove(oldest)
+		delete(factory.pool, oldest.Value.(*pooledService).key)
+	}
+	return service, nil
+}
+
+// tokenFingerprint identifies a token without keeping the token itself around
+func tokenFingerprint(pat string) string {
+	sum := sha256.Sum256([]byte(pat))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package ado
+
+import (
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestServiceFactoryWithoutPoolingCreatesNewServices(t *testing.T) {
+	factory := NewAzureDevOpsServiceFactory(0, nil, nil)
+	first, err := factory.NewService("https://dev.azure.com/org", "token")
+	assert.Nil(t, err)
+	second, err := factory.NewService("https://dev.azure.com/org", "token")
+	assert.Nil(t, err)
+	assert.NotSame(t, first, second)
+}
+
+func TestServiceFactoryPoolsByOrganizationAndToken(t *testing.T) {
+	factory := NewAzureDevOpsServiceFactory(2, nil, nil)
+	first, _ := factory.NewService("https://dev.azure.com/org", "token")
+	same, _ := factory.NewService("https://dev.azure.com/org", "token")
+	otherToken, _ := factory.NewService("https://dev.azure.com/org", "other")
+	assert.Same(t, first, same)
+	assert.NotSame(t, first, otherToken)
+
+	// A third connection pushes the least recently used one out of the pool
+	_, _ = factory.NewService("https://dev.azure.com/another", "token")
+	evicted, _ := factory.NewService("https://dev.azure.com/org", "token")
+	assert.NotSame(t, first, evicted)
+	for key := range factory.pool {
+		assert.NotContains(t, key, "|token", "tokens should only be kept as fingerprints")
+	}
+}
+
+func TestServiceFactoryIsolatesConcurrentOrganizations(t *testing.T) {
+	for _, poolSize := range []int{0, 4} {
+		factory := NewAzureDevOpsServiceFactory(poolSize, nil, nil)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				orgURL := fmt.Sprintf("https://dev.azure.com/org%d", i%8)
+				pat := fmt.Sprintf("pat%d", i%8)
+
+				service, err := factory.NewService(orgURL, pat)
+				assert.Nil(t, err)
+				connection := service.(*AzureDevOpsService).connection
+				assert.Equal(t, orgURL, connection.BaseUrl)
+				assert.Equal(t, azuredevops.CreateBasicAuthHeaderValue("", pat), connection.AuthorizationString)
+			}(i)
+		}
+		wg.Wait()
+	}
+}
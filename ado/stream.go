@@ -0,0 +1,280 @@
+package ado
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media types a client can Accept to have results streamed while the scan runs
+const (
+	MediaTypeNDJSON      = "application/x-ndjson"
+	MediaTypeEventStream = "text/event-stream"
+)
+
+// Types of StreamRecord, a stream is always closed by either a summary or an error record
+const (
+	StreamRecordFile     = "file"
+	StreamRecordProgress = "progress"
+	StreamRecordSummary  = "summary"
+	StreamRecordError    = "error"
+)
+
+// streamProgressInterval is how often a progress record is written while the scan runs
+var streamProgressInterval = time.Second
+
+// StreamRecord is a single entry of a streamed response, only the fields for its Type are set
+type StreamRecord struct {
+	Type       string
+	Project    string         `json:",omitempty"`
+	Repository string         `json:",omitempty"`
+	Ref        string         `json:",omitempty"`
+	Commit     string         `json:",omitempty"`
+	File       *Item          `json:",omitempty"`
+	Progress   *Progress      `json:",omitempty"`
+	Summary    *StreamSummary `json:",omitempty"`
+	Error      string         `json:",omitempty"`
+}
+
+// StreamSummary closes a stream with the totals, anything that went wrong during the scan and, when the criteria used
+// a baseline, the same baseline fields as the Results
+type StreamSummary struct {
+	Files       int
+	Errors      *[]ScanError
+	Incomplete  bool
+	Skipped     *[]SkippedRepository `json:",omitempty"`
+	Retries     *RetrySummary        `json:",omitempty"`
+	BlobCache   *BlobCacheSummary    `json:",omitempty"`
+	Baseline    *[]string            `json:",omitempty"`
+	Disappeared *[]string            `json:",omitempty"`
+}
+
+// streamFormat returns the streaming media type the client accepts or an empty string when it wants a single document
+func streamFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, MediaTypeNDJSON):
+		return MediaTypeNDJSON
+	case strings.Contains(accept, MediaTypeEventStream):
+		return MediaTypeEventStream
+	default:
+		return ""
+	}
+}
+
+// connectionKey is the context key of the connection a request was read from
+type connectionKey struct{}
+
+// withConnection is the server's ConnContext, it keeps the connection in the context of its requests so a stream can
+// move the write deadline on as it writes
+func withConnection(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connectionKey{}, conn)
+}
+
+// streamWriter writes records from any goroutine, the headers are only sent with the first record so an error that
+// happens before anything was written can still be sent as a normal error response. A stream outlives the server's
+// WriteTimeout so each record is given that long to be written instead of the whole response
+type streamWriter struct {
+	mutex   sync.Mutex
+	w       http.ResponseWriter
+	format  string
+	conn    net.Conn
+	timeout time.Duration
+	started bool
+	err     error
+}
+
+func newStreamWriter(ctx context.Context, w http.ResponseWriter, format string) *streamWriter {
+	stream := &streamWriter{w: w, format: format}
+	stream.conn, _ = ctx.Value(connectionKey{}).(net.Conn)
+	if server, ok := ctx.Value(http.ServerContextKey).(*http.Server); ok {
+		stream.timeout = server.WriteTimeout
+	}
+	return stream
+}
+
+func (stream *streamWriter) hasStarted() bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.started
+}
+
+// write sends the record and flushes it to the client, once a write fails every later write is quietly skipped
+func (stream *streamWriter) write(record StreamRecord) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.err != nil {
+		return nil
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if stream.conn != nil && stream.timeout > 0 {
+		if err := stream.conn.SetWriteDeadline(time.Now().Add(stream.timeout)); err != nil {
+			stream.err = err
+			return err
+		}
+	}
+
+	if !stream.started {
+		stream.w.Header().Set("Content-Type", stream.format)
+		stream.w.Header().Set("Cache-Control", "no-cache")
+		stream.w.WriteHeader(http.StatusOK)
+		stream.started = true
+	}
+
+	if stream.format == MediaTypeEventStream {
+		_, err = fmt.Fprintf(stream.w, "event: %s\ndata: %s\n\n", record.Type, value)
+	} else {
+		_, err = fmt.Fprintf(stream.w, "%s\n", value)
+	}
+	if err != nil {
+		stream.err = err
+		return err
+	}
+
+	if flusher, ok := stream.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func summaryRecord(results *Results) StreamRecord {
+	files := 0
+	for _, project := range *results.Projects {
+		for _, repository := range *project.Repositories {
+			files += len(*repository.Files)
+		}
+	}
+	return StreamRecord{
+		Type: StreamRecordSummary,
+		Summary: &StreamSummary{
+			Files:       files,
+			Errors:      results.Errors,
+			Incomplete:  results.Incomplete,
+			Skipped:     results.Skipped,
+			Retries:     results.Retries,
+			BlobCache:   results.BlobCache,
+			Baseline:    results.Baseline,
+			Disappeared: results.Disappeared,
+		},
+	}
+}
+
+// streamContentFromAdo scans while writing every matching file and periodic progress to the client, complete results
+// are cached the same way as a regular request so either kind of request can be answered from the cache
+func (api *API) streamContentFromAdo(ctx context.Context, w http.ResponseWriter, format string, cache Cache, resultsKey, org, personalAccessToken string, criteria *SearchCriteria) {
+	stream := newStreamWriter(ctx, w, format)
+	progress := new(Progress)
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go api.streamProgress(stream, progress, done, &wg)
+
+	results, err := api.scan(ctx, org, personalAccessToken, criteria, progress, func(projectName string, repository Repository, item Item) {
+		api.writeStreamRecord(stream, StreamRecord{
+			Type:       StreamRecordFile,
+			Project:    projectName,
+			Repository: repository.Name,
+			Ref:        repository.Ref,
+			Commit:     repository.Commit,
+			File:       &item,
+		})
+	})
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		if !stream.hasStarted() {
+			api.writeScanError(w, err)
+			return
+		}
+		api.logger.LogError(err)
+		api.writeStreamRecord(stream, StreamRecord{Type: StreamRecordError, Error: err.Error()})
+		return
+	}
+
+	api.writeStreamRecord(stream, summaryRecord(results))
+
+	if !results.Incomplete {
+		response, err := cachedResults(results)
+		if err == nil {
+			err = cache.Set(resultsKey, response, time.Hour*24)
+		}
+		if err != nil {
+			api.logger.LogError(err)
+			log.Println(err)
+		}
+	}
+}
+
+func (api *API) streamProgress(stream *streamWriter, progress *Progress, done chan struct{}, parentWg *sync.WaitGroup) {
+	defer parentWg.Done()
+
+	ticker := time.NewTicker(streamProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			snapshot := progress.Snapshot()
+			api.writeStreamRecord(stream, StreamRecord{Type: StreamRecordProgress, Progress: &snapshot})
+		}
+	}
+}
+
+// replayResults streams previously stored Results in the same format as a live scan
+func (api *API) replayResults(ctx context.Context, w http.ResponseWriter, format string, value []byte) {
+	var results Results
+	err := json.Unmarshal(value, &results)
+	if err == nil && results.Projects == nil {
+		err = errors.New("stored results have no projects")
+	}
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	stream := newStreamWriter(ctx, w, format)
+	for _, project := range *results.Projects {
+		for _, repository := range *project.Repositories {
+			for i := range *repository.Files {
+				api.writeStreamRecord(stream, StreamRecord{
+					Type:       StreamRecordFile,
+					Project:    project.Name,
+					Repository: repository.Name,
+					Ref:        repository.Ref,
+					Commit:     repository.Commit,
+					File:       &(*repository.Files)[i],
+				})
+			}
+		}
+	}
+	if results.Errors == nil {
+		results.Errors = &[]ScanError{}
+	}
+	api.writeStreamRecord(stream, summaryRecord(&results))
+}
+
+func (api *API) writeStreamRecord(stream *streamWriter, record StreamRecord) {
+	err := stream.write(record)
+	if err != nil {
+		api.logger.LogError(err)
+		log.Println(err)
+	}
+}
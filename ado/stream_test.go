@@ -0,0 +1,193 @@
+package ado
+
+import (
+	mocks "adoscanner/mocks/ado"
+	"bytes"
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func streamRequest(accept string) *http.Request {
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"File","ContentPattern":"Content"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/Results", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", accept)
+	req.Header.Add("Org", "itsals")
+	req.Header.Add("PAT", "123")
+	return req
+}
+
+func streamTestResults() Results {
+	return Results{
+		Projects: &[]Project{{
+			Name: "Project0",
+			Repositories: &[]Repository{{
+				Name: "Repo0",
+				Files: &[]Item{{
+					Name: "File0",
+					Lines: &[]Line{{
+						Number: 1,
+						Text:   "Content To Test",
+						Ranges: &[]Range{{Start: 0, End: 7, Fingerprint: testFingerprint("https://dev.azure.com/itsals", "Project0", "Repo0", "File0", "Content", "Content")}},
+						Before: &[]string{},
+						After:  &[]string{},
+					}},
+				}},
+			}},
+		}},
+		Errors: &[]ScanError{},
+	}
+}
+
+func TestPostStreamsNDJSONWhileScanning(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On("GetRepositories", mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On("GetItems", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On("GetItemContent", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemContentTestData(), nil)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+	mockRedis.On("Set", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewStatusResult("OK", nil))
+
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, streamRequest(MediaTypeNDJSON))
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, MediaTypeNDJSON, rr.Header().Get("Content-Type"))
+
+	var records []StreamRecord
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		var record StreamRecord
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		if record.Type != StreamRecordProgress {
+			records = append(records, record)
+		}
+	}
+
+	expected := streamTestResults()
+	file := (*(*(*expected.Projects)[0].Repositories)[0].Files)[0]
+	assert.Equal(t, []StreamRecord{
+		{Type: StreamRecordFile, Project: "Project0", Repository: "Repo0", File: &file},
+		{Type: StreamRecordSummary, Summary: &StreamSummary{Files: 1, Errors: &[]ScanError{}}},
+	}, records)
+
+	cached, _ := json.Marshal(expected)
+	mockRedis.AssertCalled(t, "Set", mock.Anything, cached, mock.Anything)
+}
+
+func TestPostReplaysCachedResultsAsServerSentEvents(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	cached, _ := json.Marshal(streamTestResults())
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult(string(cached), nil))
+
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, streamRequest(MediaTypeEventStream))
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, MediaTypeEventStream, rr.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n\n"), "\n\n")
+	assert.Len(t, events, 2)
+	assert.True(t, strings.HasPrefix(events[0], "event: file\ndata: {\"Type\":\"file\",\"Project\":\"Project0\",\"Repository\":\"Repo0\""))
+	assert.Equal(t, "event: summary\ndata: {\"Type\":\"summary\",\"Summary\":{\"Files\":1,\"Errors\":[],\"Incomplete\":false}}", events[1])
+	mockConnection.AssertNumberOfCalls(t, "GetProjects", 0)
+}
+
+func TestPostReplaysTheVersionOfEveryFile(t *testing.T) {
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	results := streamTestResults()
+	main := (*(*results.Projects)[0].Repositories)[0]
+	main.Ref, main.Commit = "refs/heads/main", testFirstCommit
+	release := main
+	release.Ref, release.Commit = "refs/heads/release", testSecondCommit
+	(*results.Projects)[0].Repositories = &[]Repository{main, release}
+	cached, _ := json.Marshal(results)
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult(string(cached), nil))
+
+	rr := httptest.NewRecorder()
+	Router(new(mocks.Service), mockRedis, mockLogging).ServeHTTP(rr, streamRequest(MediaTypeNDJSON))
+	assert.Equal(t, 200, rr.Code)
+
+	var versions [][2]string
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		var record StreamRecord
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		if record.Type == StreamRecordFile {
+			versions = append(versions, [2]string{record.Ref, record.Commit})
+		}
+	}
+	assert.Equal(t, [][2]string{{"refs/heads/main", testFirstCommit}, {"refs/heads/release", testSecondCommit}}, versions)
+}
+
+func TestPostStreamReturnsErrorBeforeAnythingIsWritten(t *testing.T) {
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(nil, assert.AnError)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	mockLogging.On("LogError", mock.Anything)
+
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+
+	rr := httptest.NewRecorder()
+	Router(mockConnection, mockRedis, mockLogging).ServeHTTP(rr, streamRequest(MediaTypeNDJSON))
+	assert.Equal(t, 500, rr.Code)
+	assert.Equal(t, "Internal Server Error\n", rr.Body.String())
+	mockRedis.AssertNumberOfCalls(t, "Set", 0)
+}
+
+func TestPostStreamOutlivesTheServerWriteTimeout(t *testing.T) {
+	streamProgressInterval = 20 * time.Millisecond
+	defer func() { streamProgressInterval = time.Second }()
+
+	mockConnection := new(mocks.Service)
+	mockConnection.On("GetProjects", mock.Anything).Return(getProjectTestData(1, ""), nil).After(500 * time.Millisecond)
+	mockConnection.On("GetRepositories", mock.Anything, "Project0").Return(getRepositoryTestData(1), nil, nil)
+	mockConnection.On("GetItems", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On("GetItemContent", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemContentTestData(), nil)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+
+	mockRedis := newTestRedis()
+	mockRedis.On("Get", mock.Anything).Return(redis.NewStringResult("", redis.Nil))
+	mockRedis.On("Set", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewStatusResult("OK", nil))
+
+	server := httptest.NewUnstartedServer(Router(mockConnection, mockRedis, mockLogging))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Config.ConnContext = withConnection
+	server.Start()
+	defer server.Close()
+
+	req := streamRequest(MediaTypeNDJSON)
+	req.URL, _ = req.URL.Parse(server.URL + "/api/v1/Results")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	var last StreamRecord
+	assert.Nil(t, json.Unmarshal([]byte(lines[len(lines)-1]), &last))
+	assert.Equal(t, StreamRecordSummary, last.Type)
+	assert.Equal(t, 1, last.Summary.Files)
+}
@@ -0,0 +1,172 @@
+package ado
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// idleConnTimeout is how long a kept alive connection to Azure DevOps may sit unused before it is closed
+const idleConnTimeout = 90 * time.Second
+
+// newTransport returns a transport that keeps up to maxIdlePerHost connections to each host alive between requests, the
+// default keeps two so a scan making more requests than that at once keeps opening new connections. HTTP/2 is
+// attempted for every TLS connection
+func newTransport(maxIdlePerHost int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+	return transport
+}
+
+// maxRedirects is how many redirects a request follows, the same as the standard library's default
+const maxRedirects = 10
+
+// configureClient sends the requests of client over transport and only follows redirects hosts allows. The Azure
+// DevOps client builds its http.Client without a transport and keeps it unexported, every copy of the client shares it
+// so it is set once before the client is first used and left alone after that
+func configureClient(client *azuredevops.Client, transport http.RoundTripper, hosts hostAllowlist) {
+	httpClient := (*http.Client)(unsafe.Pointer(reflect.ValueOf(client).Elem().FieldByName("client").Pointer()))
+	if httpClient.Transport == nil {
+		httpClient.Transport = transport
+		httpClient.CheckRedirect = hosts.checkRedirect
+	}
+}
+
+// checkRedirect refuses a redirect to a host the allowlist doesn't allow as the token would be sent on to it, staying
+// on the host the request was sent to is always allowed
+func (allowlist hostAllowlist) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme == via[0].URL.Scheme && strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return nil
+	}
+	if !allowlist.allows(req.URL) {
+		return fmt.Errorf("redirect to %s://%s is not allowed", req.URL.Scheme, req.URL.Host)
+	}
+	return nil
+}
+
+// adoTransport holds requests to the rate and request limits their context carries, counts the round trips of requests
+// whose context carries a counter and shows the responses of requests whose context carries an observer to it, the
+// client turns failed responses into errors without their headers
+type adoTransport struct {
+	next http.RoundTripper
+}
+
+type roundTripsKey struct{}
+
+type responseObserverKey struct{}
+
+type responseBodyKey struct{}
+
+// withRoundTripCounter returns a context whose requests add their round trips to counter
+func withRoundTripCounter(ctx context.Context, counter *int64) context.Context {
+	return context.WithValue(ctx, roundTripsKey{}, counter)
+}
+
+// observedResponse keeps the status and headers of the last response to a request made with its context
+type observedResponse struct {
+	mutex  sync.Mutex
+	status int
+	header http.Header
+}
+
+// withResponseObserver returns a context whose responses are recorded in observed
+func withResponseObserver(ctx context.Context, observed *observedResponse) context.Context {
+	return context.WithValue(ctx, responseObserverKey{}, observed)
+}
+
+func (o *observedResponse) record(response *http.Response) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.status = response.StatusCode
+	o.header = response.Header.Clone()
+}
+
+// last returns the status and headers of the last response, the status is zero when there wasn't one
+func (o *observedResponse) last() (int, http.Header) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.status, o.header
+}
+
+// responseBody keeps a copy of the body of the last response to a request made with its context, as much of it as was
+// read, for fields the client's models leave out
+type responseBody struct {
+	mutex sync.Mutex
+	body  bytes.Buffer
+}
+
+// withResponseBody returns a context whose response bodies are copied to body as they are read
+func withResponseBody(ctx context.Context, body *responseBody) context.Context {
+	return context.WithValue(ctx, responseBodyKey{}, body)
+}
+
+func (b *responseBody) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.body.Write(p)
+}
+
+func (b *responseBody) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.body.Reset()
+}
+
+// bytes returns the body copied so far
+func (b *responseBody) bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte(nil), b.body.Bytes()...)
+}
+
+// teeBody copies what is read from the body of a response to a responseBody
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// RoundTrip waits for a token from the rate limit and a slot of every request limit in the request's context, counts
+// and observes the request and sends it on. The token comes first so a request waiting for its organization's bucket
+// doesn't hold a slot other organizations' requests could use. The slots are held until the response has been read or
+// closed, a response without a body gives them back straight away as the client doesn't close those
+func (t *adoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := takeRateLimitToken(req.Context()); err != nil {
+		return nil, err
+	}
+	limits := requestLimits(req.Context())
+	if !acquireAll(req.Context(), limits) {
+		return nil, req.Context().Err()
+	}
+	if counter, ok := req.Context().Value(roundTripsKey{}).(*int64); ok {
+		atomic.AddInt64(counter, 1)
+	}
+	response, err := t.next.RoundTrip(req)
+	if err != nil || response.Body == nil || response.Body == http.NoBody || response.ContentLength == 0 {
+		releaseAll(limits)
+	} else {
+		response.Body = &limitedBody{ReadCloser: response.Body, limits: limits}
+	}
+	if observed, ok := req.Context().Value(responseObserverKey{}).(*observedResponse); ok && response != nil {
+		observed.record(response)
+	}
+	if body, ok := req.Context().Value(responseBodyKey{}).(*responseBody); ok && response != nil && response.Body != nil {
+		body.reset()
+		response.Body = teeBody{Reader: io.TeeReader(response.Body, body), Closer: response.Body}
+	}
+	return response, err
+}
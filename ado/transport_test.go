@@ -0,0 +1,86 @@
+package ado
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTransport counts the requests sent over it
+type countingTransport struct {
+	requests int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewTransportKeepsConnectionsAlive(t *testing.T) {
+	transport := newTransport(32)
+	assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, idleConnTimeout, transport.IdleConnTimeout)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.False(t, transport.DisableKeepAlives)
+}
+
+func TestServiceSendsEveryRequestOverItsTransport(t *testing.T) {
+	defaultTransport := http.DefaultTransport
+	server := newOnPremServer(t, 2)
+	server.resourceAreas = true
+	transport := new(countingTransport)
+
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, transport, nil)}
+	criteria := &SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "yml", ContentPattern: "password"}
+	results, err := api.scan(context.Background(), server.URL+server.collection, "123", criteria, new(Progress), nil)
+	assert.Nil(t, err)
+	assert.Len(t, *results.Projects, 2)
+
+	// The resource area lookups are sent over it too
+	assert.Equal(t, atomic.LoadInt64(&server.roundTrips), atomic.LoadInt64(&transport.requests))
+	assert.True(t, http.DefaultTransport == defaultTransport)
+}
+
+func TestServiceCreatesClientsOnce(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	server.resourceAreas = true
+	service, err := NewAzureDevOpsService(server.URL+server.collection, "123", nil, nil)
+	assert.Nil(t, err)
+
+	clients := make([]interface{}, 8)
+	wg := sync.WaitGroup{}
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := service.getGitClient(context.Background())
+			assert.Nil(t, err)
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		assert.True(t, client == clients[0])
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&server.resourceAreaLookups))
+}
+
+func TestScanCountsRoundTrips(t *testing.T) {
+	server := newOnPremServer(t, 3)
+	server.resourceAreas = true
+
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, nil, nil)}
+	criteria := &SearchCriteria{ProjectNamePattern: "Project", FileNamePattern: "yml", ContentPattern: "password"}
+	progress := new(Progress)
+	results, err := api.scan(context.Background(), server.URL+server.collection, "123", criteria, progress, nil)
+	assert.Nil(t, err)
+	assert.Len(t, *results.Projects, 3)
+
+	// The core and git clients look the resource areas up once each, not once for every call
+	assert.Equal(t, int64(2), atomic.LoadInt64(&server.resourceAreaLookups))
+	assert.Equal(t, atomic.LoadInt64(&server.roundTrips), progress.RoundTrips)
+}
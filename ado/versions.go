@@ -0,0 +1,132 @@
+package ado
+
+import (
+	"fmt"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Filters the refs API lists branches and tags with, the names it returns start with "refs/" and the filter
+const (
+	branchRefFilter = "heads/"
+	tagRefFilter    = "tags/"
+	branchRefPrefix = "refs/" + branchRefFilter
+	tagRefPrefix    = "refs/" + tagRefFilter
+)
+
+// commitSHA is the full SHA-1 a SearchCriteria.Commit has to be given as
+var commitSHA = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// scanVersion is one version of a repository to scan, ref and commit are what gets reported in the Repository and
+// descriptor is what is sent to Azure DevOps, a nil descriptor scans the default branch
+type scanVersion struct {
+	ref        string
+	commit     string
+	descriptor *git.GitVersionDescriptor
+}
+
+// commitVersion scans the repository as it was at commit, refs are resolved to their commit up front so every file of
+// a version is read from the same commit even when the ref moves during the scan
+func commitVersion(ref, commit string) scanVersion {
+	return scanVersion{
+		ref:    ref,
+		commit: commit,
+		descriptor: &git.GitVersionDescriptor{
+			Version:     &commit,
+			VersionType: &git.GitVersionTypeValues.Commit,
+		},
+	}
+}
+
+// scansDefaultBranch reports whether the criteria leave the version to scan up to each repository's default branch
+func (c *SearchCriteria) scansDefaultBranch() bool {
+	return c.Branches == "" && len(c.Tags) == 0 && c.Commit == ""
+}
+
+// validateVersions checks the branch pattern compiles and the commit is a full SHA, a commit can't be combined with
+// branches or tags as it is a single version of every repository already
+func (c *SearchCriteria) validateVersions() error {
+	if c.Commit != "" {
+		if !commitSHA.MatchString(c.Commit) {
+			return fmt.Errorf("Commit must be a full 40 character SHA")
+		}
+		if c.Branches != "" || len(c.Tags) > 0 {
+			return fmt.Errorf("Commit can't be used with Branches or Tags")
+		}
+	}
+	if _, err := regexp.Compile(c.Branches); err != nil {
+		return fmt.Errorf("Branches isn't a valid pattern: %w", err)
+	}
+	return nil
+}
+
+// versionsToScan returns the versions of the repository the criteria select, with no version criteria that is the
+// default branch and otherwise every branch matching Branches and every tag listed in Tags. When listing refs fails
+// it returns the error and the versions that could be resolved
+func (s *ScanProjects) versionsToScan(projectName, repoName string, defaultBranch *string) ([]scanVersion, error) {
+	if s.criteria.scansDefaultBranch() {
+		version := scanVersion{}
+		if defaultBranch != nil {
+			version.ref = *defaultBranch
+		}
+		return []scanVersion{version}, nil
+	}
+	if s.criteria.Commit != "" {
+		return []scanVersion{commitVersion("", strings.ToLower(s.criteria.Commit))}, nil
+	}
+
+	var versions []scanVersion
+	if s.criteria.Branches != "" {
+		branches, err := s.adoService.GetRefs(s.ctx, projectName, repoName, branchRefFilter)
+		if err != nil {
+			return versions, err
+		}
+		pattern, err := regexp.Compile(s.criteria.Branches)
+		if err != nil {
+			return versions, err
+		}
+		for _, ref := range *branches {
+			if pattern.MatchString(strings.TrimPrefix(*ref.Name, branchRefPrefix)) {
+				versions = append(versions, commitVersion(*ref.Name, refCommit(ref)))
+			}
+		}
+	}
+	if len(s.criteria.Tags) > 0 {
+		tags, err := s.adoService.GetRefs(s.ctx, projectName, repoName, tagRefFilter)
+		if err != nil {
+			return versions, err
+		}
+		wanted := make(map[string]bool, len(s.criteria.Tags))
+		for _, tag := range s.criteria.Tags {
+			wanted[tag] = true
+		}
+		for _, ref := range *tags {
+			if wanted[strings.TrimPrefix(*ref.Name, tagRefPrefix)] {
+				versions = append(versions, commitVersion(*ref.Name, refCommit(ref)))
+			}
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].ref < versions[j].ref })
+	return versions, nil
+}
+
+// skipMissingCommit records the repository as skipped when err is Azure DevOps saying the criteria's Commit isn't in
+// it, a Commit is looked for in every repository that matched and most of them won't have it
+func (s *ScanProjects) skipMissingCommit(projectName, repoName string, err error) bool {
+	if s.criteria.Commit == "" || (statusCode(err) != http.StatusNotFound && !strings.Contains(err.Error(), "TF401175")) {
+		return false
+	}
+	s.skipped.add(projectName, repoName, SkipReasonNoCommit)
+	return true
+}
+
+// refCommit returns the commit a ref points to, annotated tags point to a tag object so their peeled commit is used
+func refCommit(ref git.GitRef) string {
+	if ref.PeeledObjectId != nil && *ref.PeeledObjectId != "" {
+		return *ref.PeeledObjectId
+	}
+	return *ref.ObjectId
+}
@@ -0,0 +1,201 @@
+package ado
+
+import (
+	"adoscanner/mocks/ado"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/microsoft/azure-devops-go-api/azuredevops"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testMainCommit    = "1111111111111111111111111111111111111111"
+	testReleaseCommit = "2222222222222222222222222222222222222222"
+	testTagObject     = "3333333333333333333333333333333333333333"
+)
+
+func getRefTestData(refs ...string) *[]git.GitRef {
+	var gitRefs []git.GitRef
+	for i := 0; i+1 < len(refs); i += 2 {
+		gitRefs = append(gitRefs, git.GitRef{Name: &refs[i], ObjectId: &refs[i+1]})
+	}
+	return &gitRefs
+}
+
+// versionedConnection serves one repository with one file at every version, the version a file was read at is
+// returned as its content so the results show which version was scanned
+func versionedConnection(repositories *[]git.GitRepository) *mocks.Service {
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(repositories, nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(_ context.Context, _, _, _ string, version *git.GitVersionDescriptor) io.ReadCloser {
+			if version == nil {
+				return getItemContentTestData()
+			}
+			return ioutil.NopCloser(strings.NewReader("Content at " + *version.Version))
+		}, nil)
+	return mockConnection
+}
+
+func scannedVersions(results *Results) [][3]string {
+	var versions [][3]string
+	for _, repository := range *(*results.Projects)[0].Repositories {
+		versions = append(versions, [3]string{repository.Ref, repository.Commit, (*(*repository.Files)[0].Lines)[0].Text})
+	}
+	return versions
+}
+
+func TestScanReportsTheDefaultBranch(t *testing.T) {
+	defaultBranch := "refs/heads/main"
+	repositories := getRepositoryTestData(1)
+	(*repositories)[0].DefaultBranch = &defaultBranch
+	mockConnection := versionedConnection(repositories)
+	results, err := sProjects(mockConnection).Scan()
+	assert.Nil(t, err)
+
+	assert.Equal(t, [][3]string{{"refs/heads/main", "", "Content To Test"}}, scannedVersions(results))
+	mockConnection.AssertNotCalled(t, GetRefsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockConnection.AssertCalled(t, GetItemsFuncName, mock.Anything, "Project0", "Repo0", (*git.GitVersionDescriptor)(nil))
+}
+
+func TestScanMatchingBranchesAndTags(t *testing.T) {
+	peeled := testReleaseCommit
+	tags := getRefTestData("refs/tags/v1.0", testTagObject, "refs/tags/v2.0", testMainCommit)
+	(*tags)[0].PeeledObjectId = &peeled
+	mockConnection := versionedConnection(getRepositoryTestData(1))
+	mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", "heads/").
+		Return(getRefTestData("refs/heads/main", testMainCommit, "refs/heads/release/1.0", testReleaseCommit, "refs/heads/feature/main", testTagObject), nil)
+	mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", "tags/").Return(tags, nil)
+
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Branches = "^(main|release/.*)$"
+	scanProjects.criteria.Tags = []string{"v1.0"}
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.Equal(t, [][3]string{
+		{"refs/heads/main", testMainCommit, "Content at " + testMainCommit},
+		{"refs/heads/release/1.0", testReleaseCommit, "Content at " + testReleaseCommit},
+		{"refs/tags/v1.0", testReleaseCommit, "Content at " + testReleaseCommit},
+	}, scannedVersions(results))
+	mockConnection.AssertCalled(t, GetItemsFuncName, mock.Anything, "Project0", "Repo0", &git.GitVersionDescriptor{
+		Version:     &peeled,
+		VersionType: &git.GitVersionTypeValues.Commit,
+	})
+}
+
+func TestScanACommit(t *testing.T) {
+	mockConnection := versionedConnection(getRepositoryTestData(1))
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Commit = "ABCDEF0123456789ABCDEF0123456789ABCDEF01"
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	commit := "abcdef0123456789abcdef0123456789abcdef01"
+	assert.Equal(t, [][3]string{{"", commit, "Content at " + commit}}, scannedVersions(results))
+	mockConnection.AssertNotCalled(t, GetRefsFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestScanACommitSkipsRepositoriesWithoutIt(t *testing.T) {
+	status := http.StatusNotFound
+	message := "TF401175: The version descriptor <Commit: " + testMainCommit + "> could not be resolved to a version in the repository Repo1"
+	mockConnection := new(mocks.Service)
+	mockConnection.On(GetProjectsFuncName, mock.Anything).Return(getProjectTestData(1, ""), nil)
+	mockConnection.On(GetRepositoriesFuncName, mock.Anything, "Project0").Return(getRepositoryTestData(2), nil, nil)
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo1", mock.Anything).
+		Return(nil, azuredevops.WrappedError{Message: &message, StatusCode: &status})
+	mockConnection.On(GetItemsFuncName, mock.Anything, "Project0", "Repo0", mock.Anything).Return(getItemTestData(1), nil)
+	mockConnection.On(GetItemContentFuncName, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(getItemContentTestData(), nil)
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Commit = testMainCommit
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.False(t, results.Incomplete)
+	assert.Empty(t, *results.Errors)
+	repositories := *(*results.Projects)[0].Repositories
+	assert.Len(t, repositories, 1)
+	assert.Equal(t, "Repo0", repositories[0].Name)
+	assert.Equal(t, []SkippedRepository{{Project: "Project0", Repository: "Repo1", Reason: SkipReasonNoCommit}}, *results.Skipped)
+}
+
+func TestScanReportsRefsThatCantBeListed(t *testing.T) {
+	mockConnection := versionedConnection(getRepositoryTestData(1))
+	mockConnection.On(GetRefsFuncName, mock.Anything, "Project0", "Repo0", "heads/").Return(nil, errors.New("connection reset"))
+	scanProjects := sProjects(mockConnection)
+	scanProjects.criteria.Branches = "main"
+	results, err := scanProjects.Scan()
+	assert.Nil(t, err)
+
+	assert.True(t, results.Incomplete)
+	assert.Empty(t, *results.Projects)
+	assert.Equal(t, []ScanError{{Project: "Project0", Repository: "Repo0", Operation: OperationGetRefs, Message: "connection reset"}}, *results.Errors)
+}
+
+func TestPostValidatesVersions(t *testing.T) {
+	assertPostValidates(t, API{}, []criteriaCase{
+		{`{"Commit":"abc123"}`, "Commit must be a full 40 character SHA"},
+		{`{"Commit":"` + testMainCommit + `","Branches":"main"}`, "Commit can't be used with Branches or Tags"},
+		{`{"Commit":"` + testMainCommit + `","Tags":["v1.0"]}`, "Commit can't be used with Branches or Tags"},
+		{`{"Branches":"release/("}`, "Branches isn't a valid pattern: error parsing regexp: missing closing ): `release/(`"},
+		{`{"Commit":"` + testMainCommit + `"}`, ""},
+		{`{"Branches":"release/.*","Tags":["v1.0"]}`, ""},
+	})
+}
+
+func TestCacheKeyChangesWithTheVersion(t *testing.T) {
+	assertCacheKeys(t, []cacheKeyCase{
+		{"branches", SearchCriteria{ContentPattern: "password"}, SearchCriteria{ContentPattern: "password", Branches: "main"}, false},
+		{"branches or tags", SearchCriteria{ContentPattern: "password", Branches: "main"},
+			SearchCriteria{ContentPattern: "password", Tags: []string{"v1.0", "v2.0"}}, false},
+		{"tag order", SearchCriteria{ContentPattern: "password", Tags: []string{"v1.0", "v2.0"}},
+			SearchCriteria{ContentPattern: "password", Tags: []string{"v2.0", "v1.0"}}, true},
+	})
+}
+
+func TestPostScansBranchesAndTagsOnPremCollection(t *testing.T) {
+	server := newOnPremServer(t, 1)
+	hosts, err := parseHostAllowlist(server.URL)
+	assert.Nil(t, err)
+
+	mockLogging := new(mocks.Logging)
+	mockLogging.On("LogInfo", mock.Anything)
+	api := API{serviceFactory: NewAzureDevOpsServiceFactory(0, nil, nil), logger: mockLogging, hosts: hosts}
+
+	jsonCriteria := []byte(`{"ProjectNamePattern":"Project","FileNamePattern":"yml","ContentPattern":"password","Branches":".","Tags":["v1.0"]}`)
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(jsonCriteria))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org", server.URL+server.collection)
+	req.Header.Add("PAT", "123")
+	rr := httptest.NewRecorder()
+	api.postCacheHandler(NewMemoryCache(1024*1024)).ServeHTTP(rr, req)
+
+	assert.Equal(t, 200, rr.Code)
+	var results Results
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	assert.False(t, results.Incomplete, rr.Body.String())
+	var scanned []string
+	for _, repository := range *(*results.Projects)[0].Repositories {
+		scanned = append(scanned, repository.Ref+"@"+repository.Commit)
+	}
+	assert.Equal(t, []string{
+		"refs/heads/main@" + testMainCommit,
+		"refs/heads/release/1.0@" + testReleaseCommit,
+		"refs/tags/v1.0@" + testReleaseCommit,
+	}, scanned)
+	assert.ElementsMatch(t, []string{"commit:" + testMainCommit, "commit:" + testReleaseCommit, "commit:" + testReleaseCommit}, server.versions)
+}
@@ -3,6 +3,8 @@
 package mocks
 
 import (
+	context "context"
+
 	core "github.com/microsoft/azure-devops-go-api/azuredevops/core"
 	git "github.com/microsoft/azure-devops-go-api/azuredevops/git"
 
@@ -16,36 +18,114 @@ type Service struct {
 	mock.Mock
 }
 
-// CreateConnection provides a mock function with given fields: orgURL, pat
-func (_m *Service) CreateConnection(orgURL string, pat string) error {
-	ret := _m.Called(orgURL, pat)
+// GetAdditionalProjects provides a mock function with given fields: ctx, continuationToken
+func (_m *Service) GetAdditionalProjects(ctx context.Context, continuationToken string) (*core.GetProjectsResponseValue, error) {
+	ret := _m.Called(ctx, continuationToken)
+
+	var r0 *core.GetProjectsResponseValue
+	if rf, ok := ret.Get(0).(func(context.Context, string) *core.GetProjectsResponseValue); ok {
+		r0 = rf(ctx, continuationToken)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*core.GetProjectsResponseValue)
+		}
+	}
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(orgURL, pat)
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, continuationToken)
 	} else {
-		r0 = ret.Error(0)
+		r1 = ret.Error(1)
 	}
 
-	return r0
+	return r0, r1
 }
 
-// GetAdditionalProjects provides a mock function with given fields: continuationToken
-func (_m *Service) GetAdditionalProjects(continuationToken string) (*core.GetProjectsResponseValue, error) {
-	ret := _m.Called(continuationToken)
+// GetBlobsZip provides a mock function with given fields: ctx, projectName, repoName, blobIDs
+func (_m *Service) GetBlobsZip(ctx context.Context, projectName string, repoName string, blobIDs []string) (io.ReadCloser, error) {
+	ret := _m.Called(ctx, projectName, repoName, blobIDs)
 
-	var r0 *core.GetProjectsResponseValue
-	if rf, ok := ret.Get(0).(func(string) *core.GetProjectsResponseValue); ok {
-		r0 = rf(continuationToken)
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, []string) io.ReadCloser); ok {
+		r0 = rf(ctx, projectName, repoName, blobIDs)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(*core.GetProjectsResponseValue)
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, []string) error); ok {
+		r1 = rf(ctx, projectName, repoName, blobIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetChanges provides a mock function with given fields: ctx, projectName, repoName, commitID
+func (_m *Service) GetChanges(ctx context.Context, projectName string, repoName string, commitID string) (*git.GitCommitChanges, error) {
+	ret := _m.Called(ctx, projectName, repoName, commitID)
+
+	var r0 *git.GitCommitChanges
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) *git.GitCommitChanges); ok {
+		r0 = rf(ctx, projectName, repoName, commitID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*git.GitCommitChanges)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, projectName, repoName, commitID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetCommitDiffs provides a mock function with given fields: ctx, projectName, repoName, baseCommit, targetCommit
+func (_m *Service) GetCommitDiffs(ctx context.Context, projectName string, repoName string, baseCommit string, targetCommit string) (*git.GitCommitDiffs, error) {
+	ret := _m.Called(ctx, projectName, repoName, baseCommit, targetCommit)
+
+	var r0 *git.GitCommitDiffs
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, string) *git.GitCommitDiffs); ok {
+		r0 = rf(ctx, projectName, repoName, baseCommit, targetCommit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*git.GitCommitDiffs)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, string) error); ok {
+		r1 = rf(ctx, projectName, repoName, baseCommit, targetCommit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetCommits provides a mock function with given fields: ctx, projectName, repoName, searchCriteria
+func (_m *Service) GetCommits(ctx context.Context, projectName string, repoName string, searchCriteria git.GitQueryCommitsCriteria) (*[]git.GitCommitRef, error) {
+	ret := _m.Called(ctx, projectName, repoName, searchCriteria)
+
+	var r0 *[]git.GitCommitRef
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, git.GitQueryCommitsCriteria) *[]git.GitCommitRef); ok {
+		r0 = rf(ctx, projectName, repoName, searchCriteria)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*[]git.GitCommitRef)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(continuationToken)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, git.GitQueryCommitsCriteria) error); ok {
+		r1 = rf(ctx, projectName, repoName, searchCriteria)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -53,13 +133,13 @@ func (_m *Service) GetAdditionalProjects(continuationToken string) (*core.GetPro
 	return r0, r1
 }
 
-// GetItemContent provides a mock function with given fields: projectName, repoName, path
-func (_m *Service) GetItemContent(projectName string, repoName string, path string) (io.ReadCloser, error) {
-	ret := _m.Called(projectName, repoName, path)
+// GetItemContent provides a mock function with given fields: ctx, projectName, repoName, path, version
+func (_m *Service) GetItemContent(ctx context.Context, projectName string, repoName string, path string, version *git.GitVersionDescriptor) (io.ReadCloser, error) {
+	ret := _m.Called(ctx, projectName, repoName, path, version)
 
 	var r0 io.ReadCloser
-	if rf, ok := ret.Get(0).(func(string, string, string) io.ReadCloser); ok {
-		r0 = rf(projectName, repoName, path)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, *git.GitVersionDescriptor) io.ReadCloser); ok {
+		r0 = rf(ctx, projectName, repoName, path, version)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(io.ReadCloser)
@@ -67,8 +147,8 @@ func (_m *Service) GetItemContent(projectName string, repoName string, path stri
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
-		r1 = rf(projectName, repoName, path)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, *git.GitVersionDescriptor) error); ok {
+		r1 = rf(ctx, projectName, repoName, path, version)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -76,13 +156,13 @@ func (_m *Service) GetItemContent(projectName string, repoName string, path stri
 	return r0, r1
 }
 
-// GetItems provides a mock function with given fields: projectName, repoName
-func (_m *Service) GetItems(projectName string, repoName string) (*[]git.GitItem, error) {
-	ret := _m.Called(projectName, repoName)
+// GetItems provides a mock function with given fields: ctx, projectName, repoName, version
+func (_m *Service) GetItems(ctx context.Context, projectName string, repoName string, version *git.GitVersionDescriptor) (*[]git.GitItem, error) {
+	ret := _m.Called(ctx, projectName, repoName, version)
 
 	var r0 *[]git.GitItem
-	if rf, ok := ret.Get(0).(func(string, string) *[]git.GitItem); ok {
-		r0 = rf(projectName, repoName)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, *git.GitVersionDescriptor) *[]git.GitItem); ok {
+		r0 = rf(ctx, projectName, repoName, version)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*[]git.GitItem)
@@ -90,8 +170,8 @@ func (_m *Service) GetItems(projectName string, repoName string) (*[]git.GitItem
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(projectName, repoName)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, *git.GitVersionDescriptor) error); ok {
+		r1 = rf(ctx, projectName, repoName, version)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -99,13 +179,13 @@ func (_m *Service) GetItems(projectName string, repoName string) (*[]git.GitItem
 	return r0, r1
 }
 
-// GetProjects provides a mock function with given fields:
-func (_m *Service) GetProjects() (*core.GetProjectsResponseValue, error) {
-	ret := _m.Called()
+// GetProjects provides a mock function with given fields: ctx
+func (_m *Service) GetProjects(ctx context.Context) (*core.GetProjectsResponseValue, error) {
+	ret := _m.Called(ctx)
 
 	var r0 *core.GetProjectsResponseValue
-	if rf, ok := ret.Get(0).(func() *core.GetProjectsResponseValue); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) *core.GetProjectsResponseValue); ok {
+		r0 = rf(ctx)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*core.GetProjectsResponseValue)
@@ -113,8 +193,8 @@ func (_m *Service) GetProjects() (*core.GetProjectsResponseValue, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -122,25 +202,57 @@ func (_m *Service) GetProjects() (*core.GetProjectsResponseValue, error) {
 	return r0, r1
 }
 
-// GetRepositories provides a mock function with given fields: projectName
-func (_m *Service) GetRepositories(projectName string) (*[]git.GitRepository, error) {
-	ret := _m.Called(projectName)
+// GetRefs provides a mock function with given fields: ctx, projectName, repoName, filter
+func (_m *Service) GetRefs(ctx context.Context, projectName string, repoName string, filter string) (*[]git.GitRef, error) {
+	ret := _m.Called(ctx, projectName, repoName, filter)
 
-	var r0 *[]git.GitRepository
-	if rf, ok := ret.Get(0).(func(string) *[]git.GitRepository); ok {
-		r0 = rf(projectName)
+	var r0 *[]git.GitRef
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) *[]git.GitRef); ok {
+		r0 = rf(ctx, projectName, repoName, filter)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(*[]git.GitRepository)
+			r0 = ret.Get(0).(*[]git.GitRef)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(projectName)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, projectName, repoName, filter)
 	} else {
 		r1 = ret.Error(1)
 	}
 
 	return r0, r1
 }
+
+// GetRepositories provides a mock function with given fields: ctx, projectName
+func (_m *Service) GetRepositories(ctx context.Context, projectName string) (*[]git.GitRepository, map[string]bool, error) {
+	ret := _m.Called(ctx, projectName)
+
+	var r0 *[]git.GitRepository
+	if rf, ok := ret.Get(0).(func(context.Context, string) *[]git.GitRepository); ok {
+		r0 = rf(ctx, projectName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*[]git.GitRepository)
+		}
+	}
+
+	var r1 map[string]bool
+	if rf, ok := ret.Get(1).(func(context.Context, string) map[string]bool); ok {
+		r1 = rf(ctx, projectName)
+	} else {
+		if ret.Get(1) != nil {
+			r1 = ret.Get(1).(map[string]bool)
+		}
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string) error); ok {
+		r2 = rf(ctx, projectName)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}